@@ -1,30 +1,32 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
-	"math/rand"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
 
 	"github.com/daviddengcn/go-ljson-conf"
 	"github.com/daviddengcn/go-shell/pkg"
+	"github.com/daviddengcn/go-shell/shell"
 	"github.com/daviddengcn/go-villa"
 )
 
-func genFilename() villa.Path {
-	if true {
-		return villa.Path("/tmp")
-	}
-	dir := villa.Path(os.TempDir())
-	for {
-		base := villa.Path(fmt.Sprintf("go-shell-%08x", rand.Int63n(math.MaxInt64)))
-		fn := dir.Join(base)
-		if !fn.Exists() {
-			return fn
-		}
-	}
+// genFilename creates a unique temporary directory for a launch, so that
+// concurrent shells do not share it.
+func genFilename() (villa.Path, error) {
+	dir, err := ioutil.TempDir("", "go-shell-")
+	return villa.Path(dir), err
 }
 
 const mainGoSrc = `package main
@@ -34,46 +36,347 @@ import(
 )
 
 func main() {
-	shell.Run(&gImportedPkgs)
+	shell.HistoryFile = %q
+	shell.ImportPaths = gImportPaths
+	shell.Main(&gImportedPkgs)
 }
 `
 
 func main() {
+	// The arguments are passed to the shell, see shell.Main.
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-e src | script] [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.String("e", "", "run `src` instead of a script file")
+	flag.Parse()
+	interactive := flag.NFlag() == 0 && flag.NArg() == 0
+
 	conf, _ := ljconf.Load("shell.json")
 	imports := conf.Object("import", nil)
 	importList := make([]pkg.ImportAs, 0, len(imports))
 	for p, a := range imports {
 		importList = append(importList, pkg.ImportAs{Alias: fmt.Sprint(a), Path: p})
 	}
+	if flag.NFlag() == 0 && flag.NArg() > 0 && flag.Arg(0) != "-" {
+		// packages imported by the script
+		src, err := ioutil.ReadFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		importList = addImports(importList, shell.ScriptImports(string(src)))
+	}
+
+	typeArgs := conf.StringList("instantiate", []string{"int", "string", "float64"})
+	historyFile := conf.String("history", "~/.go-shell_history")
+	// limits of each input, which need no rebuild
+	maxSteps := conf.Int("limits.steps", 0)
+	timeout := conf.String("limits.time", "")
+	maxAlloc := conf.Int("limits.memory", 0)
+	sandbox := ""
+	if obj := conf.Object("sandbox", nil); obj != nil {
+		bs, err := json.Marshal(obj)
+		if err != nil {
+			log.Fatalf("Invalid sandbox in shell.json: %v", err)
+		}
+		sandbox = string(bs)
+	}
+
+	base, err := genFilename()
+	if err != nil {
+		log.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(base.S())
+
+	b := &builder{
+		conf:        conf,
+		base:        base,
+		g:           &pkg.GoCmd{Dir: base},
+		typeArgs:    typeArgs,
+		historyFile: historyFile,
+	}
+	defer b.cleanUp()
+
+	// Ctrl-C is sent to the shell as well, which cancels the input running
+	// with it, so the launcher keeps running. The signal is caught instead
+	// of ignored, which the shell would inherit.
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+
+	// The shell exits with shell.RestartExitCode when packages are imported
+	// in it, and is rebuilt with them and restarted with the session kept in
+	// fnSession.
+	fnSession := base.Join("session.json")
+	// the executable and the imports of the last successful build, nil if
+	// none
+	var fnExe villa.Path
+	var built []pkg.ImportAs
+	for {
+		if exe, err := b.build(importList); err != nil {
+			if built == nil {
+				log.Fatalf("Building go-shell failed: %v", err)
+			}
+			// Keep the previous binary, the shell reports the imports
+			// failed.
+			importList = built
+		} else {
+			fnExe, built = exe, append([]pkg.ImportAs{}, importList...)
+		}
+
+		cmd := fnExe.Command(os.Args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+		cmd.Env = append(os.Environ(), shell.SessionEnv+"="+fnSession.S())
+		if maxSteps > 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", shell.MaxStepsEnv, maxSteps))
+		}
+		if timeout != "" {
+			cmd.Env = append(cmd.Env, shell.TimeoutEnv+"="+timeout)
+		}
+		if maxAlloc > 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", shell.MaxAllocEnv, maxAlloc))
+		}
+		if sandbox != "" {
+			cmd.Env = append(cmd.Env, shell.SandboxEnv+"="+sandbox)
+		}
+		err := cmd.Run()
+		exitErr, isExitErr := err.(*exec.ExitError)
+		if isExitErr && interactive && exitErr.ExitCode() == shell.RestartExitCode {
+			sess, err := shell.LoadSession(fnSession.S())
+			if err != nil {
+				log.Fatalf("Loading session %s failed: %v", fnSession, err)
+			}
+			importList = addImports(built, sess.Imports)
+			continue
+		}
+		if err != nil {
+			b.cleanUp()
+			os.RemoveAll(base.S())
+			if isExitErr {
+				// e.g. a script failed, reported by the shell
+				os.Exit(exitErr.ExitCode())
+			}
+			log.Fatalf("go-shell failed: %v", err)
+		}
+		return
+	}
+}
+
+// addImports returns imports with the ones of added not in it appended.
+func addImports(imports []pkg.ImportAs, added []shell.Import) []pkg.ImportAs {
+	res := append([]pkg.ImportAs{}, imports...)
+	for _, imp := range added {
+		found := false
+		for _, ia := range res {
+			if ia.Path == imp.Path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, pkg.ImportAs{Alias: imp.Alias, Path: imp.Path})
+		}
+	}
+	return res
+}
+
+// shellRequire returns the requirement of the go-shell module, replaced with
+// the source directory of the launcher if it is a module, or of the version
+// the launcher is built with, the latest one if unknown.
+func shellRequire() pkg.Require {
+	req := pkg.Require{Path: "github.com/daviddengcn/go-shell"}
+	if _, fn, _, ok := runtime.Caller(0); ok {
+		if dir := villa.Path(fn).Dir(); dir.Join("go.mod").Exists() {
+			req.Dir = dir
+			return req
+		}
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Path == req.Path && info.Main.Version != "(devel)" {
+		req.Version = info.Main.Version
+	}
+	return req
+}
 
-	base := genFilename()
-	fmt.Println("base", base)
-	if err := base.MkdirAll(0755); err != nil {
-		log.Fatalf("Mkdirs failed: %v", err)
+// initModule creates the module the shell is built in, and returns the
+// directory of the generated sources: base, or a directory in the user's
+// own module if configured, so that its internal packages can be imported.
+// The go.mod of the user's module is left intact, a copy of it in base is
+// used with -modfile.
+func initModule(g *pkg.GoCmd, base villa.Path, conf *ljconf.Conf) villa.Path {
+	reqs := []pkg.Require{shellRequire()}
+	for p, v := range conf.Object("require", nil) {
+		reqs = append(reqs, pkg.Require{Path: p, Version: fmt.Sprint(v)})
 	}
-	fnMainGo := base.Join("main.go")
-	if err := ioutil.WriteFile(fnMainGo.S(), []byte(mainGoSrc), 0644); err != nil {
-		log.Fatalf("WriteFile to %s failed: %v", fnMainGo, err)
+	for p, dir := range conf.Object("replace", nil) {
+		reqs = append(reqs, pkg.Require{Path: p, Dir: villa.Path(fmt.Sprint(dir))})
 	}
 
-	fnPkgGo := base.Join("pkg.go")
-	func() {
-		f, err := fnPkgGo.Create()
+	if conf.Bool("offline", false) {
+		env, err := g.OfflineEnv()
 		if err != nil {
-			log.Fatalf("Create file %s failed: %v", fnPkgGo, err)
+			log.Fatalf("Locating the module cache failed: %v", err)
 		}
-		defer f.Close()
+		g.Env = append(g.Env, env...)
+	}
+
+	src, mainDir := base, villa.Path("")
+	goFlags := "-mod=mod"
+	fnMod := base.Join("go.mod")
+	if dir := conf.String("module", ""); dir != "" {
+		var err error
+		if mainDir, err = villa.Path(dir).Abs(); err != nil {
+			log.Fatalf("Locating module %s failed: %v", dir, err)
+		}
+		if _, err := pkg.ModulePath(mainDir); err != nil {
+			log.Fatalf("Loading module %s failed: %v", dir, err)
+		}
+		// A directory of its own, so that concurrent shells of the module
+		// do not share it. The leading underscore keeps it out of ./...
+		dir, err := os.MkdirTemp(mainDir.S(), "_goshell")
+		if err != nil {
+			log.Fatalf("Creating directory in module %s failed: %v", mainDir, err)
+		}
+		src = villa.Path(dir)
+		goFlags += " -modfile=" + fnMod.S()
+	}
+	g.Env = append(g.Env, "GOFLAGS="+strings.TrimSpace(os.Getenv("GOFLAGS")+" "+goFlags))
+
+	if err := g.InitModule(fnMod, mainDir, reqs); err != nil {
+		log.Fatalf("Initializing module failed: %v", err)
+	}
+	return src
+}
+
+// builder builds the shell for import sets, caching the executables.
+type builder struct {
+	conf *ljconf.Conf
+	// the temporary directory of the launch
+	base        villa.Path
+	g           *pkg.GoCmd
+	typeArgs    []string
+	historyFile string
+	// the directory of the generated sources, empty before the first build
+	src villa.Path
+}
+
+// cleanUp removes the directory of the generated sources created in the
+// user's module, if any.
+func (b *builder) cleanUp() {
+	if b.src != "" && b.src != b.base {
+		os.RemoveAll(b.src.S())
+	}
+}
+
+// cacheable returns false if the shell is built with local modules, whose
+// sources may change without changing the cache key.
+func (b *builder) cacheable() bool {
+	return b.conf.String("module", "") == "" && len(b.conf.Object("replace", nil)) == 0
+}
+
+// cacheKey returns the hash identifying the shell built with imports.
+// Besides imports, the shell depends on the Go version and the target
+// platform, the launcher, which contains go-shell, and the configuration of
+// the generated sources.
+func (b *builder) cacheKey(imports []pkg.ImportAs) (string, error) {
+	h := sha256.New()
+	env, err := b.g.Command("env", "GOVERSION", "GOOS", "GOARCH", "GOFLAGS").Output()
+	if err != nil {
+		return "", err
+	}
+	h.Write(env)
+
+	launcher, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	bs, err := ioutil.ReadFile(launcher)
+	if err != nil {
+		return "", err
+	}
+	h.Write(bs)
+
+	imports = append([]pkg.ImportAs(nil), imports...)
+	sort.Slice(imports, func(i, j int) bool {
+		return imports[i].Path < imports[j].Path
+	})
+	for _, ia := range imports {
+		fmt.Fprintf(h, "import %s %q\n", ia.Alias, ia.Path)
+	}
+	requires := b.conf.Object("require", nil)
+	paths := make([]string, 0, len(requires))
+	for p := range requires {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(h, "require %s %v\n", p, requires[p])
+	}
+	fmt.Fprintf(h, "instantiate %q\nhistory %q\n", b.typeArgs, b.historyFile)
 
-		if err := pkg.GenSource(importList, f); err != nil {
-			log.Fatalf("GenSource failed: %v", err)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// build returns the executable of the shell with the bindings of imports. It
+// is built once into the cache directory, and reused by later launches.
+func (b *builder) build(imports []pkg.ImportAs) (villa.Path, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil || !b.cacheable() {
+		fnExe := b.base.Join("go-shell")
+		return fnExe, b.generate(imports, fnExe)
+	}
+
+	key, err := b.cacheKey(imports)
+	if err != nil {
+		return "", err
+	}
+	dir := villa.Path(cacheDir).Join("go-shell")
+	fnExe := dir.Join(key)
+	if fnExe.Exists() {
+		return fnExe, nil
+	}
+	if err := dir.MkdirAll(0755); err != nil {
+		return "", err
+	}
+	// Built under a unique name and renamed, since concurrent shells may
+	// build the same one.
+	fnTmp := dir.Join(fmt.Sprintf("%s.%d.tmp", key, os.Getpid()))
+	if err := b.generate(imports, fnTmp); err != nil {
+		os.Remove(fnTmp.S())
+		return "", err
+	}
+	return fnExe, os.Rename(fnTmp.S(), fnExe.S())
+}
+
+// generate generates the sources of the shell with the bindings of imports,
+// and builds them into the executable fnExe. The module is created at the
+// first time.
+func (b *builder) generate(imports []pkg.ImportAs, fnExe villa.Path) error {
+	if b.src == "" {
+		b.src = b.base
+		if b.g.ModuleMode() {
+			b.src = initModule(b.g, b.base, b.conf)
 		}
-	}()
+		b.g.Dir = b.src
+	}
+	g := b.g
 
-	cmd := villa.Path("go").Command("run", fnMainGo.S(), fnPkgGo.S())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("go run failed: %v", err)
+	fnMainGo := g.Dir.Join("main.go")
+	if err := ioutil.WriteFile(fnMainGo.S(), []byte(fmt.Sprintf(mainGoSrc, b.historyFile)), 0644); err != nil {
+		return err
 	}
+
+	fnPkgGo := g.Dir.Join("pkg.go")
+	f, err := fnPkgGo.Create()
+	if err != nil {
+		return err
+	}
+	if err := pkg.GenSource(g, imports, b.typeArgs, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return g.Run("build", "-o", fnExe.S(), fnMainGo.S(), fnPkgGo.S())
 }
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// parseTypeArgs returns the types of typeArgs, each of which is a type, e.g.
+// "int" or "[]string", or a comma-separated list of types, e.g. "string, int",
+// of expressions of predeclared types. Others are ignored.
+func parseTypeArgs(typeArgs []string) [][]types.Type {
+	var tpss [][]types.Type
+	for _, arg := range typeArgs {
+		var tps []types.Type
+		for _, s := range splitTypeList(arg) {
+			tv, err := types.Eval(token.NewFileSet(), nil, token.NoPos, s)
+			if err != nil || !tv.IsType() {
+				tps = nil
+				break
+			}
+			tps = append(tps, tv.Type)
+		}
+		if len(tps) > 0 {
+			tpss = append(tpss, tps)
+		}
+	}
+	return tpss
+}
+
+// splitTypeList splits s at the commas out of brackets, parentheses and
+// braces, e.g. "map[string]int, func(int, int)" into two types.
+func splitTypeList(s string) []string {
+	var list []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[', '(', '{':
+			depth++
+		case ']', ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				list = append(list, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(list, strings.TrimSpace(s[start:]))
+}
+
+// coreType returns the composite type of a constraint like ~[]E or map[K]V,
+// which determines the type argument from other type arguments, or nil if
+// none.
+func coreType(constraint types.Type) types.Type {
+	iface, ok := constraint.Underlying().(*types.Interface)
+	if !ok || iface.NumMethods() > 0 || iface.NumEmbeddeds() != 1 {
+		return nil
+	}
+	tp := iface.EmbeddedType(0)
+	if u, ok := tp.(*types.Union); ok {
+		if u.Len() != 1 {
+			return nil
+		}
+		tp = u.Term(0).Type()
+	}
+	if _, ok := tp.Underlying().(*types.Interface); ok {
+		return coreType(tp)
+	}
+	switch tp.Underlying().(type) {
+	case *types.Slice, *types.Array, *types.Map, *types.Chan, *types.Pointer:
+		return tp.Underlying()
+	}
+	return nil
+}
+
+// subst replaces the type parameters in tp with their type arguments in
+// targs.
+func subst(tp types.Type, targs map[*types.TypeParam]types.Type) types.Type {
+	switch tp := tp.(type) {
+	case *types.TypeParam:
+		if arg, ok := targs[tp]; ok {
+			return arg
+		}
+	case *types.Slice:
+		return types.NewSlice(subst(tp.Elem(), targs))
+	case *types.Array:
+		return types.NewArray(subst(tp.Elem(), targs), tp.Len())
+	case *types.Map:
+		return types.NewMap(subst(tp.Key(), targs), subst(tp.Elem(), targs))
+	case *types.Chan:
+		return types.NewChan(tp.Dir(), subst(tp.Elem(), targs))
+	case *types.Pointer:
+		return types.NewPointer(subst(tp.Elem(), targs))
+	}
+	return tp
+}
+
+// genericInstances returns the explicit instantiations, e.g.
+// slices.Contains[[]int, int], of a generic function refName of signature
+// sig. The type parameters whose types are not determined by a core type
+// constraint are assigned each of typeArgs: all of them the same type if it
+// is a single one, e.g. maps.Keys[map[int]int, int, int], or each its own one
+// if it lists as many types as the parameters, e.g. "string, int" for
+// maps.Keys[map[string]int, string, int]. Instances not satisfying the
+// constraints are dropped.
+func genericInstances(refName string, sig *types.Signature, typeArgs [][]types.Type) []string {
+	params := sig.TypeParams()
+
+	var free []*types.TypeParam
+	for i := 0; i < params.Len(); i++ {
+		if coreType(params.At(i).Constraint()) == nil {
+			free = append(free, params.At(i))
+		}
+	}
+
+	var instances []string
+	seen := make(map[string]bool)
+	for _, tps := range typeArgs {
+		if len(tps) != 1 && len(tps) != len(free) {
+			continue
+		}
+		targs := make(map[*types.TypeParam]types.Type)
+		for k, param := range free {
+			if len(tps) == 1 {
+				targs[param] = tps[0]
+			} else {
+				targs[param] = tps[k]
+			}
+		}
+
+		args := make([]types.Type, params.Len())
+		strs := make([]string, params.Len())
+		for i := range args {
+			param := params.At(i)
+			if core := coreType(param.Constraint()); core != nil {
+				args[i] = subst(core, targs)
+			} else {
+				args[i] = targs[param]
+			}
+			strs[i] = types.TypeString(args[i], nil)
+		}
+		inst := refName + "[" + strings.Join(strs, ", ") + "]"
+		if seen[inst] {
+			continue
+		}
+		seen[inst] = true
+		if _, err := types.Instantiate(nil, sig, args, true); err != nil {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+
+	return instances
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/daviddengcn/go-villa"
+)
+
+// GoCmd runs go commands in the context the shell is generated and built in.
+type GoCmd struct {
+	// The directory the commands run in, the current one if empty
+	Dir villa.Path
+	// Environment variables added to the ones of the process, e.g.
+	// GOFLAGS=-mod=mod
+	Env []string
+}
+
+// Command returns the go command with args.
+func (g *GoCmd) Command(args ...string) *exec.Cmd {
+	cmd := villa.Path("go").Command(args...)
+	cmd.Dir = g.Dir.S()
+	cmd.Env = append(os.Environ(), g.Env...)
+	return cmd
+}
+
+// Run runs the go command with args, its output shown.
+func (g *GoCmd) Run(args ...string) error {
+	cmd := g.Command(args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// A package loaded by go list.
+type Package struct {
+	ImportPath string
+	Name       string
+	Dir        string
+	GoFiles    []string
+	// The file of the export data of the compiled package
+	Export string
+	Error  *struct {
+		Err string
+	}
+}
+
+// LoadPackages loads the packages of paths and their dependencies with go
+// list, the way golang.org/x/tools/go/packages does, with the packages
+// compiled for the export data. In module mode with -mod=mod, modules
+// providing missing packages are looked up and added to the go.mod.
+func (g *GoCmd) LoadPackages(paths ...string) (map[string]*Package, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := g.Command(append([]string{"list", "-e", "-json", "-export", "-deps"}, paths...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list failed: %v\n%s", err, stderr.Bytes())
+	}
+
+	pkgs := make(map[string]*Package)
+	for dec := json.NewDecoder(&stdout); ; {
+		p := &Package{}
+		if err := dec.Decode(p); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if p.Error != nil {
+			return nil, fmt.Errorf("loading package %s failed: %s", p.ImportPath, p.Error.Err)
+		}
+		pkgs[p.ImportPath] = p
+	}
+	return pkgs, nil
+}
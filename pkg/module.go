@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/daviddengcn/go-villa"
+)
+
+// The path of the module generated for the shell when it is not built in
+// the user's own module.
+const SessionModule = "goshell.local/session"
+
+// A module required by the generated shell.
+type Require struct {
+	Path string
+	// The required version, ignored if Dir is set
+	Version string
+	// The local directory replacing the module, if not empty
+	Dir villa.Path
+}
+
+// ModuleMode returns true if the go command works in module mode, i.e.
+// GO111MODULE is not off.
+func (g *GoCmd) ModuleMode() bool {
+	out, err := g.Command("env", "GO111MODULE").Output()
+	return err != nil || strings.TrimSpace(string(out)) != "off"
+}
+
+// ModCache returns the directory of the module cache, i.e. GOMODCACHE.
+func (g *GoCmd) ModCache() (villa.Path, error) {
+	out, err := g.Command("env", "GOMODCACHE").Output()
+	if err != nil {
+		return "", err
+	}
+	return villa.Path(strings.TrimSpace(string(out))), nil
+}
+
+// OfflineEnv returns the environment variables for resolving modules from
+// the module cache only, without network access.
+func (g *GoCmd) OfflineEnv() ([]string, error) {
+	cache, err := g.ModCache()
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"GOPROXY=file://" + filepath.ToSlash(cache.Join("cache", "download").S()),
+		"GOSUMDB=off",
+	}, nil
+}
+
+// ModulePath returns the module path declared in the go.mod of dir.
+func ModulePath(dir villa.Path) (string, error) {
+	fn := dir.Join("go.mod")
+	bs, err := ioutil.ReadFile(fn.S())
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "`\""), nil
+		}
+	}
+	return "", fmt.Errorf("no module directive in %s", fn)
+}
+
+// InitModule writes fnMod, the go.mod of the generated shell, requiring
+// reqs. If mainDir is not empty, it is a copy of the go.mod, and go.sum, of
+// the module in mainDir, which the shell is built in so that the internal
+// packages of it can be imported. The shell is built with -modfile=fnMod
+// then. Otherwise, fnMod is of a new module named SessionModule, and has to
+// be the go.mod in g.Dir.
+func (g *GoCmd) InitModule(fnMod, mainDir villa.Path, reqs []Require) error {
+	if mainDir != "" {
+		if err := copyFile(mainDir.Join("go.mod"), fnMod); err != nil {
+			return err
+		}
+		fnSum := villa.Path(strings.TrimSuffix(fnMod.S(), ".mod") + ".sum")
+		if err := copyFile(mainDir.Join("go.sum"), fnSum); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		os.Remove(fnMod.S())
+		if err := g.Run("mod", "init", SessionModule); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"mod", "edit"}
+	for _, req := range reqs {
+		switch {
+		case req.Dir != "":
+			dir, err := req.Dir.Abs()
+			if err != nil {
+				return err
+			}
+			args = append(args, "-require="+req.Path+"@v0.0.0", "-replace="+req.Path+"="+dir.S())
+		case req.Version != "":
+			args = append(args, "-require="+req.Path+"@"+req.Version)
+		}
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	return g.Run(append(args, fnMod.S())...)
+}
+
+func copyFile(src, dst villa.Path) error {
+	bs, err := ioutil.ReadFile(src.S())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst.S(), bs, 0644)
+}
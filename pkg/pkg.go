@@ -2,61 +2,109 @@ package pkg
 
 import (
 	"fmt"
-	"go/ast"
-	"go/build"
-	"go/parser"
+	"go/constant"
+	"go/importer"
 	"go/token"
+	"go/types"
 	"io"
+	"math"
 	"os"
+	"sort"
 	"strconv"
-	"strings"
 
 	"github.com/golangplus/bytes"
 
-	"github.com/daviddengcn/go-villa"
-	gosl "github.com/daviddengcn/gosl/builtin"
 	"github.com/golangplus/fmt"
 )
 
-var (
-	GoRoot  villa.Path
-	GoPaths []villa.Path
-)
-
-func init() {
-	lines := strings.Split(gosl.Eval("go", "env", "GOROOT", "GOPATH"), "\n")
-	GoRoot = villa.Path(lines[0])
-	paths := strings.Split(lines[1], string(os.PathSeparator))
-	GoPaths = make([]villa.Path, 0, len(paths))
-	for _, path := range paths {
-		GoPaths = append(GoPaths, villa.Path(path))
-	}
-}
-
 type ImportAs struct {
 	Alias string
 	Path  string
 }
 
-func isCaptilized(s string) bool {
-	if s == "" {
-		return false
+// GenSource generates the source of the bindings of exported objects in
+// imports, loaded with g and type-checked by go/types, so that only the files
+// matching the build constraints of the current GOOS/GOARCH are used. Generic
+// functions are instantiated with each of typeArgs, e.g. "int" or
+// "string, int", satisfying their constraints, or skipped if none does, see
+// genericInstances. The output is sorted by import paths and names.
+func GenSource(g *GoCmd, imports []ImportAs, typeArgs []string, out io.Writer) error {
+	var paths []string
+	for _, ia := range imports {
+		if ia.Alias != "_" {
+			paths = append(paths, ia.Path)
+		}
+	}
+	pkgs, err := g.LoadPackages(paths...)
+	if err != nil {
+		return err
 	}
 
-	return s[0] >= 'A' && s[0] <= 'Z'
-}
+	sorted := append([]ImportAs(nil), imports...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	imports = sorted
+
+	fset := token.NewFileSet()
+	importer := importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
+		p := pkgs[path]
+		if p == nil || p.Export == "" {
+			return nil, fmt.Errorf("no export data of package %s", path)
+		}
+		return os.Open(p.Export)
+	})
+	targs := parseTypeArgs(typeArgs)
+
+	pkgSrcs := make(map[string]*bytesp.Slice)
+	// package names to import paths
+	pkgPaths := make(map[string]string)
+	// import paths of the packages referred to by the bindings
+	used := make(map[string]bool)
+	for _, ia := range imports {
+		if ia.Alias == "_" {
+			// side-effect only import
+			continue
+		}
+
+		tpkg, err := importer.Import(ia.Path)
+		if err != nil {
+			return fmt.Errorf("loading package %s failed: %v", ia.Path, err)
+		}
+		pkgName := tpkg.Name()
+		switch ia.Alias {
+		case "":
+		case ".":
+			pkgName = ""
+		default:
+			pkgName = ia.Alias
+		}
+		if _, ok := pkgSrcs[pkgName]; !ok {
+			// a new package
+			pkgSrcs[pkgName] = bytesp.NewPSlice(nil)
+			pkgPaths[pkgName] = ia.Path
+		}
+		if genBindings(pkgSrcs[pkgName], pkgName, tpkg, targs) {
+			used[ia.Path] = true
+		}
+	}
 
-func GenSource(imports []ImportAs, out io.Writer) error {
 	fmt.Fprintln(out, `package main`)
 
 	fmt.Fprintln(out, `import(
     "github.com/daviddengcn/go-shell/vm"`)
 	for _, ia := range imports {
-		fmt.Fprintln(out, `    `+ia.Alias+` `+strconv.Quote(ia.Path))
+		alias := ia.Alias
+		if !used[ia.Path] {
+			// e.g. a package of constraints only, which is still
+			// initialized
+			alias = "_"
+		}
+		fmt.Fprintln(out, `    `+alias+` `+strconv.Quote(ia.Path))
 	}
 	fmt.Fprintln(out, `)`)
 
-	fmt.Fprintln(out, `
+	fmt.Fprint(out, `
 var(
 	valueOf = reflect.ValueOf
 	typeOf = gsvm.PtrToTypeValue
@@ -68,66 +116,134 @@ func elemOf(vl interface{}) reflect.Value {
 `)
 
 	fmtp.Fprintfln(out, "var gImportedPkgs = gsvm.PackageNameSpace{Packages: map[string]gsvm.Package{")
-	pkgSrcs := make(map[string]*bytesp.Slice)
-	for _, ia := range imports {
-		if ia.Alias == "_" {
-			// side-effect only import
+	for _, pkgName := range sortedKeys(pkgPaths) {
+		fmtp.Fprintfln(out, "    %s: gsvm.Package{", strconv.Quote(pkgName))
+		out.Write(*pkgSrcs[pkgName])
+		fmt.Fprintln(out, "    },")
+	}
+	fmt.Fprintln(out, "}}")
+
+	fmt.Fprintln(out, "var gImportPaths = map[string]string{")
+	for _, pkgName := range sortedKeys(pkgPaths) {
+		fmtp.Fprintfln(out, "    %s: %s,", strconv.Quote(pkgName), strconv.Quote(pkgPaths[pkgName]))
+	}
+	fmt.Fprintln(out, "}")
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// genBindings generates the entries of the exported objects of tpkg, in
+// the order of their names, of the gsvm.Package named pkgName. It returns
+// false if all of them are skipped, and so tpkg is not referred to.
+func genBindings(out *bytesp.Slice, pkgName string, tpkg *types.Package, typeArgs [][]types.Type) (referred bool) {
+	scope := tpkg.Scope()
+	for _, objName := range scope.Names() {
+		obj := scope.Lookup(objName)
+		if !obj.Exported() {
 			continue
 		}
 
-		fs := token.NewFileSet()
-		pkgInfo, _ := build.Import(ia.Path, "", 0)
-		dir := villa.Path(pkgInfo.Dir)
-		fmt.Println("import", ia.Alias, strconv.Quote(ia.Path))
-		for _, goFile := range pkgInfo.GoFiles {
-			fn := dir.Join(goFile)
-			f, err := parser.ParseFile(fs, fn.S(), nil, 0)
-			if err != nil {
-				villa.Fatalf("Parse %s failed: %v", fn.S(), err)
+		refName := objName
+		if pkgName != "" {
+			refName = pkgName + "." + objName
+		}
+
+		switch obj := obj.(type) {
+		case *types.Const:
+			if basic, ok := obj.Type().(*types.Basic); ok && basic.Info()&types.IsUntyped != 0 {
+				// The value instead of refName, which may overflow the
+				// default type, e.g. math.MaxUint64.
+				kind, lit, ok := untypedLiteral(basic, obj.Val())
+				if !ok {
+					fmtp.Fprintfln(out, "    // %s: constant overflowing float64 skipped", objName)
+					continue
+				}
+				fmtp.Fprintfln(out, "    %s: gsvm.UntypedConstant(%s, %s),",
+					strconv.Quote(objName), strconv.Quote(kind), strconv.Quote(lit))
+				continue
 			}
-			pkgName := f.Name.Name
-			if ia.Alias != "" {
-				pkgName = ia.Alias
+			fmtp.Fprintfln(out, "    %s: valueOf(%s),", strconv.Quote(objName), refName)
+			referred = true
+		case *types.TypeName:
+			if isGenericType(obj.Type()) {
+				fmtp.Fprintfln(out, "    // %s: generic type skipped", objName)
+				continue
 			}
-			if _, ok := pkgSrcs[pkgName]; !ok {
-				// a new package
-				pkgSrcs[pkgName] = bytesp.NewPSlice(nil)
+			if iface, ok := obj.Type().Underlying().(*types.Interface); ok && !iface.IsMethodSet() {
+				fmtp.Fprintfln(out, "    // %s: constraint skipped", objName)
+				continue
 			}
-			for objName, obj := range f.Scope.Objects {
-				if !isCaptilized(objName) {
+			fmtp.Fprintfln(out, "    %s: typeOf((*%s)(nil)),", strconv.Quote(objName), refName)
+			referred = true
+		case *types.Var:
+			fmtp.Fprintfln(out, "    %s: elemOf(&%s),", strconv.Quote(objName), refName)
+			referred = true
+		case *types.Func:
+			if sig := obj.Type().(*types.Signature); sig.TypeParams().Len() > 0 {
+				instances := genericInstances(refName, sig, typeArgs)
+				if len(instances) == 0 {
+					fmtp.Fprintfln(out, "    // %s: generic function skipped", objName)
 					continue
 				}
-
-				refName := objName
-				if pkgName != "" {
-					refName = pkgName + "." + objName
-				}
-
-				switch obj.Kind {
-				case ast.Con:
-					if objName == "MaxUint64" {
-						// a Go bug
-						continue
-					}
-					fmtp.Fprintfln(pkgSrcs[pkgName], "    %s: valueOf(%s),", strconv.Quote(objName), refName)
-				case ast.Typ:
-					fmtp.Fprintfln(pkgSrcs[pkgName], "    %s: typeOf((*%s)(nil)),",
-						strconv.Quote(objName), refName)
-				case ast.Var:
-					fmtp.Fprintfln(pkgSrcs[pkgName], "    %s: elemOf(&%s),", strconv.Quote(objName), refName)
-				case ast.Fun:
-					fmtp.Fprintfln(pkgSrcs[pkgName], "    %s: valueOf(%s),", strconv.Quote(objName), refName)
+				fmtp.Fprintfln(out, "    %s: gsvm.NewInstances(", strconv.Quote(objName))
+				for _, inst := range instances {
+					fmtp.Fprintfln(out, "        valueOf(%s),", inst)
 				}
+				fmtp.Fprintfln(out, "    ),")
+				referred = true
+				continue
 			}
+			fmtp.Fprintfln(out, "    %s: valueOf(%s),", strconv.Quote(objName), refName)
+			referred = true
 		}
 	}
+	return referred
+}
 
-	for pkgName, src := range pkgSrcs {
-		fmtp.Fprintfln(out, "    %s: gsvm.Package{", strconv.Quote(pkgName))
-		fmt.Fprintf(out, string(*src))
-		fmt.Fprintln(out, "    },")
-	}
-	fmt.Fprintln(out, "}}")
+// isGenericType returns true if tp is a generic named type or alias which is
+// not instantiated.
+func isGenericType(tp types.Type) bool {
+	generic, ok := tp.(interface {
+		TypeParams() *types.TypeParamList
+		TypeArgs() *types.TypeList
+	})
+	return ok && generic.TypeParams().Len() > 0 && generic.TypeArgs().Len() == 0
+}
 
-	return nil
+// untypedLiteral returns the kind and the Go literal of an untyped constant
+// for gsvm.UntypedConstant. ok is false if the constant overflows float64.
+func untypedLiteral(tp *types.Basic, vl constant.Value) (kind, lit string, ok bool) {
+	switch tp.Kind() {
+	case types.UntypedBool:
+		return "bool", vl.ExactString(), true
+	case types.UntypedInt:
+		return "int", vl.ExactString(), true
+	case types.UntypedRune:
+		return "rune", vl.ExactString(), true
+	case types.UntypedFloat:
+		f, _ := constant.Float64Val(vl)
+		if math.IsInf(f, 0) {
+			return "", "", false
+		}
+		return "float", strconv.FormatFloat(f, 'g', -1, 64), true
+	case types.UntypedComplex:
+		re, _ := constant.Float64Val(constant.Real(vl))
+		im, _ := constant.Float64Val(constant.Imag(vl))
+		if math.IsInf(re, 0) || math.IsInf(im, 0) {
+			return "", "", false
+		}
+		return "complex", strconv.FormatComplex(complex(re, im), 'g', -1, 128), true
+	case types.UntypedString:
+		return "string", vl.ExactString(), true
+	}
+	return "", "", false
 }
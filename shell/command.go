@@ -0,0 +1,222 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/daviddengcn/go-shell/vm"
+)
+
+// errQuit is returned by the :quit command.
+var errQuit = errors.New("quit")
+
+// A meta-command of the shell, typed with a leading colon, e.g. :help.
+type command struct {
+	name string
+	// usage of the argument
+	arg  string
+	help string
+	run  func(vm gsvm.Machine, arg string) error
+	// whether the command changes the definitions, and is recorded in the
+	// session
+	stateful bool
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"help", "", "show this help", cmdHelp, false},
+		{"vars", "", "list definitions with their types", cmdVars, false},
+		{"type", "<expr>", "show the type of an expression without evaluating it", cmdType, false},
+		{"doc", "<pkg>[.<name>]", "show the documentation of an imported package or symbol", cmdDoc, false},
+		{"reset", "", "remove all definitions", cmdReset, true},
+		{"load", "<file>", "evaluate a Go file, running its main function if any", cmdLoad, true},
+		{"quit", "", "exit the shell", cmdQuit, false},
+	}
+}
+
+// isCommand returns true if input is a meta-command. Go source never starts
+// with a colon.
+func isCommand(input string) bool {
+	return strings.HasPrefix(strings.TrimSpace(input), ":")
+}
+
+// findCommand returns the command with the name, or the only command whose
+// name starts with it.
+func findCommand(name string) (*command, error) {
+	var found []*command
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, nil
+		}
+		if strings.HasPrefix(cmd.name, name) {
+			found = append(found, cmd)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("unknown command :%s, type :help for the available commands", name)
+	case 1:
+		return found[0], nil
+	}
+	var names []string
+	for _, cmd := range found {
+		names = append(names, ":"+cmd.name)
+	}
+	return nil, fmt.Errorf("ambiguous command :%s, could be %s", name, strings.Join(names, ", "))
+}
+
+// splitCommand returns the name and the argument of a command.
+func splitCommand(input string) (name, arg string) {
+	input = strings.TrimPrefix(strings.TrimSpace(input), ":")
+	if i := strings.IndexAny(input, " \t"); i >= 0 {
+		return input[:i], strings.TrimSpace(input[i+1:])
+	}
+	return input, ""
+}
+
+func runCommand(vm gsvm.Machine, input string) error {
+	name, arg := splitCommand(input)
+	cmd, err := findCommand(name)
+	if err != nil {
+		return err
+	}
+	if cmd.arg == "" && arg != "" {
+		return fmt.Errorf(":%s takes no arguments", cmd.name)
+	}
+	if cmd.arg != "" && arg == "" {
+		return fmt.Errorf("usage: :%s %s", cmd.name, cmd.arg)
+	}
+	return cmd.run(vm, arg)
+}
+
+// completeCommand completes the name of a command, or the argument of it as
+// Go source.
+func completeCommand(vm gsvm.Machine, text string) (partial string, candidates []string) {
+	text = strings.TrimLeft(text, " \t")
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		return vm.Complete(text[i+1:])
+	}
+	partial = strings.TrimPrefix(text, ":")
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd.name, partial) {
+			candidates = append(candidates, cmd.name)
+		}
+	}
+	return partial, candidates
+}
+
+func cmdHelp(vm gsvm.Machine, arg string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Commands, which can be abbreviated to a unique prefix:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  :%s %s\t%s\n", cmd.name, cmd.arg, cmd.help)
+	}
+	return w.Flush()
+}
+
+// typeList returns the types separated by commas, in parentheses if more
+// than one.
+func typeList(tps []reflect.Type) string {
+	strs := make([]string, len(tps))
+	for i, tp := range tps {
+		strs[i] = gsvm.TypeString(tp)
+	}
+	if len(strs) == 1 {
+		return strs[0]
+	}
+	return "(" + strings.Join(strs, ", ") + ")"
+}
+
+func cmdVars(vm gsvm.Machine, arg string) error {
+	globals := vm.Globals()
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		vl := globals[name]
+		switch vl.Type() {
+		case gsvm.ConstValueType:
+			fmt.Fprintf(w, "const %s\t%s\n", name, gsvm.TypeString(vl.Field(0).Interface().(reflect.Value).Type()))
+		case gsvm.TypeValueType:
+			fmt.Fprintf(w, "type %s\t%v\n", name, vl.Interface().(gsvm.TypeValue).Type)
+		case gsvm.GenericTypeType:
+			fmt.Fprintf(w, "type %s\tgeneric type\n", name)
+		case gsvm.ConstraintType:
+			fmt.Fprintf(w, "type %s\tconstraint\n", name)
+		case gsvm.GenericFuncType:
+			fmt.Fprintf(w, "func %s\tgeneric function\n", name)
+		default:
+			fmt.Fprintf(w, "var %s\t%s\n", name, gsvm.TypeString(vl.Type()))
+		}
+	}
+	return w.Flush()
+}
+
+func cmdType(vm gsvm.Machine, arg string) error {
+	tps, err := vm.TypeOf(arg)
+	if err != nil {
+		return err
+	}
+	if len(tps) == 0 {
+		fmt.Println(arg, "is used as a value but has no value")
+		return nil
+	}
+	fmt.Println(typeList(tps))
+	return nil
+}
+
+func cmdDoc(vm gsvm.Machine, arg string) error {
+	pkg, name := arg, ""
+	if i := strings.Index(arg, "."); i >= 0 {
+		pkg, name = arg[:i], arg[i+1:]
+	}
+	path, ok := ImportPaths[pkg]
+	if !ok {
+		// a symbol of a dot-imported package
+		if path, ok = ImportPaths[""]; !ok || name != "" {
+			return fmt.Errorf("package %s is not imported", pkg)
+		}
+		name = pkg
+	}
+
+	args := []string{"doc", path}
+	if name != "" {
+		args = append(args, name)
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func cmdReset(vm gsvm.Machine, arg string) error {
+	vm.Reset()
+	return nil
+}
+
+// cmdLoad evaluates a file. Package clauses and imports of Go source files are
+// skipped, imported packages have to be bound in the shell already.
+func cmdLoad(vm gsvm.Machine, fn string) error {
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	return runSource(vm, fn, string(src))
+}
+
+func cmdQuit(vm gsvm.Machine, arg string) error {
+	return errQuit
+}
@@ -0,0 +1,638 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by ReadLine when Ctrl-C is pressed.
+var errInterrupted = errors.New("interrupted")
+
+// lineReader reads inputs from the user.
+type lineReader interface {
+	// ReadLine shows prompt and returns an input without the trailing newline.
+	ReadLine(prompt string) (string, error)
+	// AddHistory records a complete input.
+	AddHistory(input string) error
+	Close() error
+}
+
+// newLineReader returns a line editor if stdin is a terminal, or a plain
+// reader otherwise. The history is persisted in historyFile if not empty.
+func newLineReader(historyFile string, incomplete func(text string) bool,
+	complete func(text string) (partial string, candidates []string)) lineReader {
+	h, err := openHistory(historyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "History file %s not available: %v\n", historyFile, err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !isTerminal(fd) {
+		return &plainReader{in: bufio.NewReader(os.Stdin), history: h}
+	}
+	return &editor{
+		fd:         fd,
+		in:         bufio.NewReader(os.Stdin),
+		out:        os.Stdout,
+		incomplete: incomplete,
+		complete:   complete,
+		history:    h,
+	}
+}
+
+// plainReader reads lines without editing, used when stdin is not a
+// terminal.
+type plainReader struct {
+	in      *bufio.Reader
+	history *history
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := r.in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func (r *plainReader) AddHistory(input string) error {
+	return r.history.Add(input)
+}
+
+func (r *plainReader) Close() error {
+	return r.history.Close()
+}
+
+// Control characters.
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyCtrlJ     = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlT     = 20
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyCtrlY     = 25
+	keyEsc       = 27
+	keyBackspace = 127
+)
+
+// Special keys decoded from escape sequences.
+const (
+	keyUnknown rune = -(iota + 1)
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyWordLeft
+	keyWordRight
+	keyDeleteWord
+	keyBackspaceWord
+)
+
+// editor is a terminal line editor with emacs key bindings. An incomplete
+// input is continued in a new line of the same buffer when Enter is pressed,
+// so that all lines of it can be edited before it is submitted.
+type editor struct {
+	fd  int
+	in  *bufio.Reader
+	out io.Writer
+	// returns true if text is incomplete
+	incomplete func(text string) bool
+	// returns the identifier before the end of text and its completions
+	complete func(text string) (partial string, candidates []string)
+	history  *history
+
+	prompt string
+	buf    []rune
+	pos    int
+	// row of the cursor relative to the first row, as last rendered
+	cursorRow int
+	// last killed text, for yanking
+	killed []rune
+	// a key read ahead, e.g. the one finishing a reverse search
+	pending rune
+}
+
+func (e *editor) AddHistory(input string) error {
+	return e.history.Add(input)
+}
+
+func (e *editor) Close() error {
+	return e.history.Close()
+}
+
+func (e *editor) ReadLine(prompt string) (string, error) {
+	st, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restoreTerm(e.fd, st)
+
+	e.prompt, e.buf, e.pos, e.cursorRow = prompt, nil, 0, 0
+	// index of the history entry shown, len(entries) for the new input
+	histIdx := len(e.history.entries)
+	// the new input, saved while browsing the history
+	var saved []rune
+	showHistory := func(idx int) {
+		if histIdx == len(e.history.entries) {
+			saved = e.buf
+		}
+		histIdx = idx
+		if idx == len(e.history.entries) {
+			e.buf = saved
+		} else {
+			e.buf = []rune(e.history.entries[idx])
+		}
+		e.pos = len(e.buf)
+	}
+
+	e.refresh()
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case keyEnter, keyCtrlJ:
+			text := string(e.buf)
+			if e.incomplete != nil && e.incomplete(text) {
+				e.insert('\n')
+				break
+			}
+			e.pos = len(e.buf)
+			e.refresh()
+			e.write("\r\n")
+			return text, nil
+
+		case keyCtrlC:
+			e.pos = len(e.buf)
+			e.refresh()
+			e.write("^C\r\n")
+			return "", errInterrupted
+
+		case keyCtrlD:
+			if len(e.buf) == 0 {
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+
+		case keyCtrlA, keyHome:
+			e.pos = e.lineStart()
+		case keyCtrlE, keyEnd:
+			e.pos = e.lineEnd()
+		case keyCtrlB, keyLeft:
+			if e.pos > 0 {
+				e.pos--
+			}
+		case keyCtrlF, keyRight:
+			if e.pos < len(e.buf) {
+				e.pos++
+			}
+		case keyWordLeft:
+			e.pos = e.wordLeft()
+		case keyWordRight:
+			e.pos = e.wordRight()
+
+		case keyCtrlH, keyBackspace:
+			if e.pos > 0 {
+				e.delete(e.pos-1, e.pos)
+			}
+		case keyDelete:
+			e.delete(e.pos, e.pos+1)
+		case keyCtrlK:
+			e.kill(e.pos, e.lineEnd())
+		case keyCtrlU:
+			e.kill(e.lineStart(), e.pos)
+		case keyCtrlW, keyBackspaceWord:
+			e.kill(e.wordLeft(), e.pos)
+		case keyDeleteWord:
+			e.kill(e.pos, e.wordRight())
+		case keyCtrlY:
+			for _, r := range e.killed {
+				e.insert(r)
+			}
+		case keyCtrlT:
+			if e.pos > 0 && len(e.buf) > 1 {
+				if e.pos == len(e.buf) {
+					e.pos--
+				}
+				e.buf[e.pos-1], e.buf[e.pos] = e.buf[e.pos], e.buf[e.pos-1]
+				e.pos++
+			}
+
+		case keyCtrlP, keyUp:
+			if start := e.lineStart(); start > 0 {
+				// move to the previous line of a multi-line input
+				col := e.pos - start
+				e.pos = e.lineStartAt(start-1) + col
+				if end := start - 1; e.pos > end {
+					e.pos = end
+				}
+			} else if histIdx > 0 {
+				showHistory(histIdx - 1)
+			}
+		case keyCtrlN, keyDown:
+			if end := e.lineEnd(); end < len(e.buf) {
+				// move to the next line of a multi-line input
+				col := e.pos - e.lineStart()
+				e.pos = end + 1 + col
+				if nextEnd := e.lineEndAt(end + 1); e.pos > nextEnd {
+					e.pos = nextEnd
+				}
+			} else if histIdx < len(e.history.entries) {
+				showHistory(histIdx + 1)
+			}
+
+		case keyCtrlR:
+			if idx, ok := e.reverseSearch(); ok {
+				showHistory(idx)
+			}
+
+		case keyCtrlL:
+			e.write("\x1b[H\x1b[2J")
+			e.cursorRow = 0
+
+		case keyTab:
+			e.completeAtCursor()
+
+		default:
+			if key >= ' ' {
+				e.insert(key)
+			}
+		}
+		e.refresh()
+	}
+}
+
+func (e *editor) write(s string) {
+	io.WriteString(e.out, s)
+}
+
+// readKey reads a key, decoding escape sequences of special keys.
+func (e *editor) readKey() (rune, error) {
+	if e.pending != 0 {
+		key := e.pending
+		e.pending = 0
+		return key, nil
+	}
+
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != keyEsc {
+		return r, err
+	}
+
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case '[', 'O':
+		// CSI or SS3: parameters followed by a final byte
+		var seq []rune
+		for {
+			c, _, err := e.in.ReadRune()
+			if err != nil {
+				return 0, err
+			}
+			seq = append(seq, c)
+			if c >= 0x40 && c <= 0x7e {
+				break
+			}
+		}
+		switch string(seq) {
+		case "A":
+			return keyUp, nil
+		case "B":
+			return keyDown, nil
+		case "C":
+			return keyRight, nil
+		case "D":
+			return keyLeft, nil
+		case "H", "1~", "7~":
+			return keyHome, nil
+		case "F", "4~", "8~":
+			return keyEnd, nil
+		case "3~":
+			return keyDelete, nil
+		case "1;5C", "1;3C":
+			return keyWordRight, nil
+		case "1;5D", "1;3D":
+			return keyWordLeft, nil
+		}
+	// Alt-<key> is sent as ESC <key>.
+	case 'b', 'B':
+		return keyWordLeft, nil
+	case 'f', 'F':
+		return keyWordRight, nil
+	case 'd', 'D':
+		return keyDeleteWord, nil
+	case keyBackspace, keyCtrlH:
+		return keyBackspaceWord, nil
+	}
+	return keyUnknown, nil
+}
+
+func (e *editor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+// delete removes buf[from:to] and moves the cursor to from.
+func (e *editor) delete(from, to int) {
+	if to > len(e.buf) {
+		to = len(e.buf)
+	}
+	if from >= to {
+		return
+	}
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.pos = from
+}
+
+// kill deletes buf[from:to] and saves it for yanking.
+func (e *editor) kill(from, to int) {
+	if from >= to {
+		return
+	}
+	e.killed = append([]rune(nil), e.buf[from:to]...)
+	e.delete(from, to)
+}
+
+// lineStartAt returns the start of the line containing pos.
+func (e *editor) lineStartAt(pos int) int {
+	for pos > 0 && e.buf[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+// lineEndAt returns the end of the line containing pos.
+func (e *editor) lineEndAt(pos int) int {
+	for pos < len(e.buf) && e.buf[pos] != '\n' {
+		pos++
+	}
+	return pos
+}
+
+func (e *editor) lineStart() int {
+	return e.lineStartAt(e.pos)
+}
+
+func (e *editor) lineEnd() int {
+	return e.lineEndAt(e.pos)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordLeft returns the start of the word before the cursor.
+func (e *editor) wordLeft() int {
+	pos := e.pos
+	for pos > 0 && !isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(e.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// wordRight returns the end of the word after the cursor.
+func (e *editor) wordRight() int {
+	pos := e.pos
+	for pos < len(e.buf) && !isWordRune(e.buf[pos]) {
+		pos++
+	}
+	for pos < len(e.buf) && isWordRune(e.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// refresh redraws the prompt and the buffer, and places the cursor. Lines
+// after the first one are prompted with PS2. Long lines are assumed to be
+// wrapped by the terminal.
+func (e *editor) refresh() {
+	cols := termWidth(e.fd)
+
+	var b bytes.Buffer
+	// go back to the first row and clear everything after
+	b.WriteString("\r")
+	if e.cursorRow > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", e.cursorRow)
+	}
+	b.WriteString("\x1b[J")
+
+	row, col := 0, 0
+	curRow, curCol := 0, 0
+	prompt := e.prompt
+	start := 0
+	for {
+		end := e.lineEndAt(start)
+		line := e.buf[start:end]
+		b.WriteString(prompt)
+		b.WriteString(strings.Replace(string(line), "\t", " ", -1))
+
+		width := len([]rune(prompt)) + len(line)
+		if e.pos >= start && e.pos <= end {
+			offs := len([]rune(prompt)) + e.pos - start
+			curRow, curCol = row+offs/cols, offs%cols
+		}
+		if width > 0 && width%cols == 0 {
+			// the cursor is pending at the last column, move it to the
+			// next row
+			b.WriteString("\r\n")
+		}
+		row, col = row+width/cols, width%cols
+
+		if end == len(e.buf) {
+			break
+		}
+		b.WriteString("\r\n")
+		row, col = row+1, 0
+		prompt, start = PS2, end+1
+	}
+
+	if row > curRow {
+		fmt.Fprintf(&b, "\x1b[%dA", row-curRow)
+	}
+	if col != curCol {
+		b.WriteString("\r")
+		if curCol > 0 {
+			fmt.Fprintf(&b, "\x1b[%dC", curCol)
+		}
+	}
+	e.cursorRow = curRow
+	e.out.Write(b.Bytes())
+}
+
+// reverseSearch searches the history incrementally for a query typed by the
+// user, and returns the index of the entry found. ok is false if the search
+// is cancelled with Ctrl-G. A key finishing the search other than Enter is
+// kept to be processed by ReadLine.
+func (e *editor) reverseSearch() (idx int, ok bool) {
+	prompt, buf, pos := e.prompt, e.buf, e.pos
+	entries := e.history.entries
+
+	var query []rune
+	idx = len(entries)
+	found := true
+	// search searches entries before from for query.
+	search := func(from int) {
+		if from > len(entries) {
+			from = len(entries)
+		}
+		for i := from - 1; i >= 0; i-- {
+			if strings.Contains(entries[i], string(query)) {
+				idx, found = i, true
+				return
+			}
+		}
+		found = false
+	}
+
+	for {
+		label := "(reverse-i-search)`"
+		if !found {
+			label = "(failed reverse-i-search)`"
+		}
+		e.prompt = label + string(query) + "': "
+		if idx < len(entries) {
+			e.buf = []rune(entries[idx])
+			e.pos = len(e.buf)
+			if i := strings.Index(entries[idx], string(query)); i >= 0 {
+				e.pos = len([]rune(entries[idx][:i]))
+			}
+		}
+		e.refresh()
+
+		key, err := e.readKey()
+		if err != nil {
+			key = keyCtrlG
+		}
+		switch {
+		case key == keyCtrlR:
+			if idx > 0 {
+				search(idx)
+			}
+		case key == keyCtrlH || key == keyBackspace:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				search(len(entries))
+			}
+		case key == keyCtrlG:
+			e.prompt, e.buf, e.pos = prompt, buf, pos
+			return 0, false
+		case key >= ' ':
+			query = append(query, key)
+			search(idx + 1)
+		default:
+			e.prompt, e.buf, e.pos = prompt, buf, pos
+			e.pending = key
+			return idx, idx < len(entries)
+		}
+	}
+}
+
+// completeAtCursor completes the identifier before the cursor. If there are
+// several candidates, their common prefix is inserted, or they are listed if
+// the prefix is already typed. A tab is inserted if there is nothing to
+// complete, e.g. for indentation.
+func (e *editor) completeAtCursor() {
+	text := string(e.buf[:e.pos])
+	if e.complete == nil || strings.TrimSpace(string(e.buf[e.lineStart():e.pos])) == "" {
+		e.insert('\t')
+		return
+	}
+
+	partial, candidates := e.complete(text)
+	if len(candidates) == 0 {
+		e.write("\a")
+		return
+	}
+
+	prefix := candidates[0]
+	for _, cand := range candidates[1:] {
+		for !strings.HasPrefix(cand, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	if len(prefix) > len(partial) {
+		for _, r := range prefix[len(partial):] {
+			e.insert(r)
+		}
+		return
+	}
+	if len(candidates) == 1 {
+		return
+	}
+
+	// list candidates in columns below the input
+	pos := e.pos
+	e.pos = len(e.buf)
+	e.refresh()
+	e.write("\r\n" + columns(candidates, termWidth(e.fd)))
+	e.pos, e.cursorRow = pos, 0
+}
+
+// columns lays out words in columns fitting width.
+func columns(words []string, width int) string {
+	colWidth := 0
+	for _, w := range words {
+		if len(w) > colWidth {
+			colWidth = len(w)
+		}
+	}
+	colWidth += 2
+	nCols := width / colWidth
+	if nCols < 1 {
+		nCols = 1
+	}
+	nRows := (len(words) + nCols - 1) / nCols
+
+	var b bytes.Buffer
+	for r := 0; r < nRows; r++ {
+		for c := 0; c < nCols; c++ {
+			i := c*nRows + r
+			if i >= len(words) {
+				break
+			}
+			if c < nCols-1 && i+nRows < len(words) {
+				fmt.Fprintf(&b, "%-*s", colWidth, words[i])
+			} else {
+				b.WriteString(words[i])
+			}
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package shell
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// history holds previous inputs, persisted to a file if opened with one.
+type history struct {
+	entries []string
+	// nil if not persisted
+	file *os.File
+}
+
+var historyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// unescapeHistory reverses historyEscaper.
+func unescapeHistory(line string) string {
+	if !strings.Contains(line, `\`) {
+		return line
+	}
+	var res []byte
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) {
+			i++
+			if line[i] == 'n' {
+				res = append(res, '\n')
+				continue
+			}
+		}
+		res = append(res, line[i])
+	}
+	return string(res)
+}
+
+// expandHome replaces a leading ~ in fn with the home directory.
+func expandHome(fn string) string {
+	if fn != "~" && !strings.HasPrefix(fn, "~/") {
+		return fn
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fn
+	}
+	return filepath.Join(home, fn[1:])
+}
+
+// openHistory loads the history in file fn, one entry per line with newlines
+// escaped, and opens it for appending new entries. At most HistorySize of the
+// latest entries are kept; the file is rewritten if it has more. An empty fn
+// returns a history in memory only.
+func openHistory(fn string) (*history, error) {
+	h := &history{}
+	if fn == "" {
+		return h, nil
+	}
+	fn = expandHome(fn)
+
+	if f, err := os.Open(fn); err == nil {
+		s := bufio.NewScanner(f)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			h.entries = append(h.entries, unescapeHistory(s.Text()))
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return h, err
+		}
+	} else if !os.IsNotExist(err) {
+		return h, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if len(h.entries) > HistorySize {
+		h.entries = h.entries[len(h.entries)-HistorySize:]
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(fn, flags, 0600)
+	if err != nil {
+		return h, err
+	}
+	h.file = f
+	if flags&os.O_TRUNC != 0 {
+		for _, entry := range h.entries {
+			if err := h.write(entry); err != nil {
+				return h, err
+			}
+		}
+	}
+	return h, nil
+}
+
+func (h *history) write(entry string) error {
+	_, err := h.file.WriteString(historyEscaper.Replace(entry) + "\n")
+	return err
+}
+
+// Add appends entry to the history unless it is blank or the same as the
+// last one.
+func (h *history) Add(entry string) error {
+	if strings.TrimSpace(entry) == "" {
+		return nil
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry {
+		return nil
+	}
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > HistorySize {
+		h.entries = h.entries[len(h.entries)-HistorySize:]
+	}
+	if h.file == nil {
+		return nil
+	}
+	return h.write(entry)
+}
+
+func (h *history) Close() error {
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
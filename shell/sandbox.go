@@ -0,0 +1,69 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/daviddengcn/go-shell/vm"
+)
+
+// SandboxEnv is the environment variable of the policy restricting the
+// symbols of packages accessible, set by the go-shell launcher from the
+// sandbox of shell.json, in JSON, e.g.
+//
+//	{"default": "deny", "allow": ["fmt", "strings"], "deny": ["os.Remove*"],
+//	 "audit": "~/.go-shell_audit.log"}
+//
+// See gsvm.Policy for the patterns. Accesses denied are logged to the audit
+// file, or stderr if it is empty.
+const SandboxEnv = "GO_SHELL_SANDBOX"
+
+type sandboxConf struct {
+	Allow   []string `json:"allow"`
+	Deny    []string `json:"deny"`
+	Default string   `json:"default"`
+	Audit   string   `json:"audit"`
+}
+
+// loadSandbox sets the policy of SandboxEnv, if any, on initNS.
+func loadSandbox(initNS gsvm.NameSpace) error {
+	s := os.Getenv(SandboxEnv)
+	if s == "" {
+		return nil
+	}
+	var conf sandboxConf
+	if err := json.Unmarshal([]byte(s), &conf); err != nil {
+		return fmt.Errorf("invalid %s: %v", SandboxEnv, err)
+	}
+	if conf.Default != "" && conf.Default != "allow" && conf.Default != "deny" {
+		return fmt.Errorf("invalid %s: default must be allow or deny, got %q", SandboxEnv, conf.Default)
+	}
+	pns, ok := initNS.(*gsvm.PackageNameSpace)
+	if !ok {
+		return fmt.Errorf("%s is not supported by %T", SandboxEnv, initNS)
+	}
+
+	var out io.Writer = os.Stderr
+	if conf.Audit != "" {
+		f, err := os.OpenFile(expandHome(conf.Audit), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("opening audit file failed: %v", err)
+		}
+		out = f
+	}
+	audit := log.New(out, "audit: ", log.LstdFlags)
+
+	pns.Paths = ImportPaths
+	pns.Policy = &gsvm.Policy{
+		Allow:         conf.Allow,
+		Deny:          conf.Deny,
+		DenyByDefault: conf.Default == "deny",
+		Audit: func(path, symbol string) {
+			audit.Printf("access denied: %s.%s", path, symbol)
+		},
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package shell
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/daviddengcn/go-shell/vm"
+)
+
+// scriptPrefix makes a script without a package clause parsable up to its
+// imports. It is on the same line to keep the line numbers.
+const scriptPrefix = "package main;"
+
+// splitHeader returns the imports of src, a Go source file, or a script of
+// statements and declarations which may start with imports, and src with the
+// shebang line, the package clause and the imports blanked out, keeping the
+// line numbers.
+func splitHeader(src string) (imports []Import, body string) {
+	if strings.HasPrefix(src, "#!") {
+		// e.g. #!/usr/bin/env go-shell
+		src = src[strings.IndexByte(src+"\n", '\n'):]
+	}
+
+	prefix := ""
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, "", src, parser.ImportsOnly)
+	if err != nil {
+		prefix = scriptPrefix
+		if f, err = parser.ParseFile(fs, "", prefix+src, parser.ImportsOnly); err != nil || len(f.Decls) == 0 {
+			return nil, src
+		}
+	}
+
+	end := f.Name.End()
+	if len(f.Decls) > 0 {
+		end = f.Decls[len(f.Decls)-1].End()
+	}
+	for _, spec := range f.Imports {
+		imp := Import{}
+		imp.Path, _ = strconv.Unquote(spec.Path.Value)
+		if spec.Name != nil {
+			imp.Alias = spec.Name.Name
+		}
+		imports = append(imports, imp)
+	}
+	offs := fs.Position(end).Offset - len(prefix)
+	return imports, strings.Repeat("\n", strings.Count(src[:offs], "\n")) + src[offs:]
+}
+
+// ScriptImports returns the packages imported by a script, which have to be
+// bound in the shell running it.
+func ScriptImports(src string) []Import {
+	imports, _ := splitHeader(src)
+	return imports
+}
+
+// runSource evaluates src of the file fn, a Go source file or a script,
+// running its main function if declared. Imported packages have to be bound
+// in the shell already.
+func runSource(vm gsvm.Machine, fn string, src string) error {
+	imports, body := splitHeader(src)
+	for _, imp := range imports {
+		name := imp.Path[strings.LastIndex(imp.Path, "/")+1:]
+		if imp.Alias != "" {
+			name = strings.TrimPrefix(imp.Alias, ".")
+		}
+		if _, ok := ImportPaths[name]; !ok && name != "_" {
+			fmt.Fprintf(os.Stderr, "Warning: package %s is not imported in the shell\n", imp.Path)
+		}
+	}
+
+	hasMain := false
+	if f, err := parser.ParseFile(token.NewFileSet(), fn, scriptPrefix+body, 0); err == nil {
+		for _, decl := range f.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil && fd.Name.Name == "main" {
+				hasMain = true
+			}
+		}
+	}
+
+	if err := runInterruptible(vm, body); err != nil {
+		if err == gsvm.FragmentErr {
+			return fmt.Errorf("%s: unexpected end of file", fn)
+		}
+		return atFile(err, fn)
+	}
+	if hasMain {
+		return atFile(runInterruptible(vm, "main()"), fn)
+	}
+	return nil
+}
+
+// atFile replaces the input name in the position of err, if any, with fn, or
+// prefixes err with fn if it has no position.
+func atFile(err error, fn string) error {
+	if err == nil {
+		return nil
+	}
+	var ge gsvm.Error
+	if errors.As(err, &ge) && ge.ErrorLocation().Pos.IsValid() {
+		ge.ErrorLocation().Pos.Filename = fn
+		return err
+	}
+	return fmt.Errorf("%s: %w", fn, err)
+}
+
+// RunScript runs src of the script fn non-interactively, and returns the exit
+// code: 0 on success, 1 on the first error, and 2 on a panic, like Go
+// programs.
+func RunScript(initNS gsvm.NameSpace, fn string, src string) int {
+	return runScript(initNS, fn, src, false)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// echoExpr evaluates expression src and prints its values with fmt.Println. A
+// call returning an error as the last result, e.g. fmt.Println, is made for
+// its effects, so its values are not printed, and the error, if not nil, is
+// returned.
+func echoExpr(vm gsvm.Machine, src string) error {
+	vls, err := vm.EvalExpr(src)
+	if err != nil {
+		return err
+	}
+	if n := len(vls); n > 0 && vls[n-1].Type() == errorType {
+		if err, _ := vls[n-1].Interface().(error); err != nil {
+			return err
+		}
+		return nil
+	}
+	for _, vl := range vls {
+		// printed as a Go program does, for the output to be used by others
+		if vl.CanInterface() {
+			fmt.Println(vl.Interface())
+		} else {
+			fmt.Println(gsvm.FormatValue(vl))
+		}
+	}
+	return nil
+}
+
+// runScript runs src as RunScript does. If echo is true and src is an
+// expression, e.g. of -e, its values are printed as echoExpr does.
+func runScript(initNS gsvm.NameSpace, fn string, src string, echo bool) int {
+	vm := gsvm.NewWithOptions(initNS, gsvm.Options{MaxSteps: MaxSteps, MaxDuration: Timeout, MaxAlloc: MaxAlloc})
+	var err error
+	if _, exprErr := parser.ParseExpr(src); echo && exprErr == nil {
+		err = atFile(echoExpr(vm, src), fn)
+	} else {
+		err = runSource(vm, fn, src)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n%s", err, sourceExcerpt(err, src))
+		if errors.As(err, new(*gsvm.PanicError)) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// Main runs the shell with the command line arguments:
+//
+//	go-shell                       interactive
+//	go-shell script.gosh args...   run a script, "-" for stdin
+//	go-shell -e 'src' args...      run src
+//
+// os.Args of a script is the script followed by its arguments.
+func Main(initNS gsvm.NameSpace) {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-e src | script] [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	src := flag.String("e", "", "run `src` instead of a script file")
+	flag.Parse()
+	if err := loadLimits(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := loadSandbox(initNS); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	isSrc := false
+	flag.Visit(func(f *flag.Flag) {
+		isSrc = isSrc || f.Name == "e"
+	})
+	switch {
+	case isSrc:
+		os.Args = append([]string{"-e"}, flag.Args()...)
+		os.Exit(runScript(initNS, "-e", *src, true))
+	case flag.NArg() > 0:
+		fn := flag.Arg(0)
+		var bs []byte
+		var err error
+		if fn == "-" {
+			bs, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			bs, err = ioutil.ReadFile(fn)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Args = flag.Args()
+		os.Exit(RunScript(initNS, fn, string(bs)))
+	}
+	Run(initNS)
+}
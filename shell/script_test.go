@@ -0,0 +1,135 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+	"github.com/daviddengcn/go-shell/vm"
+)
+
+func TestSplitHeader(t *testing.T) {
+	cases := []struct {
+		src     string
+		imports []Import
+		body    string
+	}{
+		{"#!/usr/bin/env go-shell\nfmt.Println(1)\n", nil, "\nfmt.Println(1)\n"},
+		{"#!/usr/bin/env go-shell\nimport \"fmt\"\nfmt.Println(1)", []Import{{Path: "fmt"}}, "\n\nfmt.Println(1)"},
+		{"import (\n\t\"fmt\"\n\tstr \"strings\"\n)\nx := str.Repeat(\"a\", 2)", []Import{{Path: "fmt"}, {Path: "strings", Alias: "str"}}, "\n\n\n\nx := str.Repeat(\"a\", 2)"},
+		{"package main\n\nimport . \"fmt\"\n\nfunc main() {\n\tPrintln(1)\n}\n", []Import{{Path: "fmt", Alias: "."}}, "\n\n\n\nfunc main() {\n\tPrintln(1)\n}\n"},
+		{"x := 1\n", nil, "x := 1\n"},
+	}
+	for _, c := range cases {
+		imports, body := splitHeader(c.src)
+		assert.StringEquals(t, c.src+" imports", imports, c.imports)
+		assert.Equals(t, c.src+" body", body, c.body)
+		// line numbers are kept
+		assert.Equals(t, c.src+" lines", strings.Count(body, "\n"), strings.Count(c.src, "\n"))
+	}
+}
+
+// capture returns what f writes to stdout and stderr.
+func capture(t *testing.T, f func()) (stdout, stderr string) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldOut, oldErr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outW, errW
+	f()
+	os.Stdout, os.Stderr = oldOut, oldErr
+	outW.Close()
+	errW.Close()
+	bsOut, _ := ioutil.ReadAll(outR)
+	bsErr, _ := ioutil.ReadAll(errR)
+	return string(bsOut), string(bsErr)
+}
+
+func scriptNameSpace() gsvm.NameSpace {
+	return &gsvm.PackageNameSpace{Packages: map[string]gsvm.Package{
+		"fmt": gsvm.Package{
+			"Println": reflect.ValueOf(fmt.Println),
+			"Errorf":  reflect.ValueOf(fmt.Errorf),
+		},
+		"strings": gsvm.Package{
+			"Repeat": reflect.ValueOf(strings.Repeat),
+		},
+	}}
+}
+
+func TestRunScript(t *testing.T) {
+	cases := []struct {
+		src          string
+		code         int
+		stdout, errs string
+	}{
+		{`#!/usr/bin/env go-shell
+import "fmt"
+
+func greet(s string) string {
+	return "hello " + s
+}
+
+fmt.Println(greet("bob"))
+`, 0, "hello bob\n", ""},
+		{`package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("main")
+}
+`, 0, "main\n", ""},
+		{`x := 1
+y := x + "a"
+`, 1, "", "s.gosh:2:6: invalid operation"},
+		{`for i := 0; i < 3; i++ {
+`, 1, "", "s.gosh: unexpected end of file\n"},
+		{`fmt.Println("before")
+var s []int
+s[1] = 2
+`, 2, "before\n", "s.gosh:3:1: panic"},
+	}
+	for _, c := range cases {
+		var code int
+		stdout, stderr := capture(t, func() {
+			code = RunScript(scriptNameSpace(), "s.gosh", c.src)
+		})
+		assert.Equals(t, c.src+" code", code, c.code)
+		assert.Equals(t, c.src+" stdout", stdout, c.stdout)
+		assert.True(t, c.src+" stderr: "+stderr, strings.HasPrefix(stderr, c.errs))
+	}
+}
+
+func TestRunScriptEcho(t *testing.T) {
+	cases := []struct {
+		src          string
+		code         int
+		stdout, errs string
+	}{
+		{`1 + 2`, 0, "3\n", ""},
+		{`strings.Repeat("ab", 2)`, 0, "abab\n", ""},
+		{`fmt.Println("x")`, 0, "x\n", ""},
+		{`fmt.Errorf("failed")`, 1, "", "-e: failed\n"},
+		{`x := 1; fmt.Println(x)`, 0, "1\n", ""},
+		{`undefinedName`, 1, "", "-e:1:1: undefined: undefinedName\n"},
+	}
+	for _, c := range cases {
+		var code int
+		stdout, stderr := capture(t, func() {
+			code = runScript(scriptNameSpace(), "-e", c.src, true)
+		})
+		assert.Equals(t, c.src+" code", code, c.code)
+		assert.Equals(t, c.src+" stdout", stdout, c.stdout)
+		assert.True(t, c.src+" stderr: "+stderr, strings.HasPrefix(stderr, c.errs))
+	}
+}
@@ -0,0 +1,185 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/daviddengcn/go-shell/vm"
+)
+
+const (
+	// The environment variable specifying the session file, set by the
+	// go-shell launcher. The shell can import packages only if it is set.
+	SessionEnv = "GO_SHELL_SESSION"
+	// The exit code of the shell requesting the launcher to rebuild it with
+	// the imports in the session file and start it again.
+	RestartExitCode = 3
+)
+
+// An imported package.
+type Import struct {
+	Path string
+	// "" for the package name, "." for a dot-import
+	Alias string
+}
+
+// Session is the state of a shell kept across restarts, which happen when
+// packages are imported in the session. Inputs are re-executed after
+// restarting to restore the variables and definitions.
+type Session struct {
+	// Packages imported in the session
+	Imports []Import
+	// Inputs changing the state, i.e. Go source and :load commands
+	Inputs []string
+}
+
+// LoadSession reads a session file written by a shell requesting a restart.
+func LoadSession(fn string) (*Session, error) {
+	bs, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{}
+	if err := json.Unmarshal(bs, sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (sess *Session) Save(fn string) error {
+	bs, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, bs, 0600)
+}
+
+// Record adds an input changing the state of the session.
+func (sess *Session) Record(input string) {
+	sess.Inputs = append(sess.Inputs, input)
+}
+
+// parseImports returns the imported packages if input consists of import
+// declarations only.
+func parseImports(input string) (imports []Import, ok bool) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package main\n"+input, 0)
+	if err != nil || len(f.Decls) == 0 {
+		return nil, false
+	}
+	for _, decl := range f.Decls {
+		if gd, isGen := decl.(*ast.GenDecl); !isGen || gd.Tok != token.IMPORT {
+			return nil, false
+		}
+	}
+	for _, spec := range f.Imports {
+		imp := Import{}
+		imp.Path, _ = strconv.Unquote(spec.Path.Value)
+		if spec.Name != nil {
+			imp.Alias = spec.Name.Name
+		}
+		imports = append(imports, imp)
+	}
+	return imports, true
+}
+
+// isImported returns true if the package of path is bound in the shell.
+func isImported(path string) bool {
+	for _, p := range ImportPaths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// importPackages saves the session with imports added and exits for the
+// launcher to restart the shell. Imports already bound are ignored.
+func importPackages(sess *Session, imports []Import, in lineReader) error {
+	sessionFile := os.Getenv(SessionEnv)
+	if sessionFile == "" {
+		return fmt.Errorf("import is not supported, the shell is not started by the go-shell launcher")
+	}
+
+	var added []Import
+	for _, imp := range imports {
+		if isImported(imp.Path) {
+			fmt.Printf("%s is already imported\n", imp.Path)
+			continue
+		}
+		added = append(added, imp)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	restarted := &Session{
+		Imports: append(append([]Import(nil), sess.Imports...), added...),
+		Inputs:  sess.Inputs,
+	}
+	if err := restarted.Save(sessionFile); err != nil {
+		return err
+	}
+	for _, imp := range added {
+		fmt.Printf("Importing %s ...\n", imp.Path)
+	}
+	in.Close()
+	os.Exit(RestartExitCode)
+	return nil
+}
+
+// restoreSession loads the session file of a restarted shell, if any, and
+// re-executes its inputs with the output discarded. Inputs run as at the
+// prompt, under the limits and interruptible, and the ones failing are
+// reported and dropped from the session.
+func restoreSession(vm gsvm.Machine) (sess *Session, restored bool) {
+	sessionFile := os.Getenv(SessionEnv)
+	if sessionFile == "" {
+		return &Session{}, false
+	}
+	sess, err := LoadSession(sessionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Loading session %s failed: %v\n", sessionFile, err)
+		}
+		return &Session{}, false
+	}
+
+	imports := sess.Imports[:0]
+	for _, imp := range sess.Imports {
+		if !isImported(imp.Path) {
+			fmt.Fprintf(os.Stderr, "Importing %s failed\n", imp.Path)
+			continue
+		}
+		imports = append(imports, imp)
+	}
+	sess.Imports = imports
+
+	stdout, stderr := os.Stdout, os.Stderr
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout, os.Stderr = devNull, devNull
+		defer devNull.Close()
+	}
+	inputs := sess.Inputs[:0]
+	for _, input := range sess.Inputs {
+		var err error
+		if isCommand(input) {
+			err = runCommand(vm, input)
+		} else {
+			err = runInterruptible(vm, input)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Restoring %q failed: %v\n", input, err)
+			continue
+		}
+		inputs = append(inputs, input)
+	}
+	sess.Inputs = inputs
+	os.Stdout, os.Stderr = stdout, stderr
+	return sess, true
+}
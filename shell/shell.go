@@ -1,32 +1,127 @@
 package shell
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/daviddengcn/go-shell/vm"
 )
 
 var (
 	PS = "$ "
+	// Prompt of continued lines of an incomplete input
+	PS2 = "  "
+	// File keeping the history of inputs across sessions. Empty to disable.
+	HistoryFile = ""
+	// Maximum number of history entries kept
+	HistorySize = 1000
+	// Package names bound in the shell to their import paths, "" for
+	// dot-imports
+	ImportPaths = map[string]string{}
+	// The maximum number of steps, loop iterations and function calls, the
+	// maximum time, and the maximum bytes allocated, each input runs. 0 for
+	// no limit. Set from MaxStepsEnv, TimeoutEnv and MaxAllocEnv by Main.
+	MaxSteps int64
+	Timeout  time.Duration
+	MaxAlloc int64
 )
 
+const (
+	// The environment variables of the limits of each input, set by the
+	// go-shell launcher, e.g. 1000000, 30s and 1073741824.
+	MaxStepsEnv = "GO_SHELL_MAX_STEPS"
+	TimeoutEnv  = "GO_SHELL_TIMEOUT"
+	MaxAllocEnv = "GO_SHELL_MAX_ALLOC"
+)
+
+// loadLimits sets MaxSteps, Timeout and MaxAlloc from the environment
+// variables.
+func loadLimits() error {
+	for env, n := range map[string]*int64{MaxStepsEnv: &MaxSteps, MaxAllocEnv: &MaxAlloc} {
+		if s := os.Getenv(env); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", env, err)
+			}
+			*n = v
+		}
+	}
+	if s := os.Getenv(TimeoutEnv); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", TimeoutEnv, err)
+		}
+		Timeout = d
+	}
+	return nil
+}
+
+// runInterruptible runs input and cancels it on SIGINT, e.g. Ctrl-C, instead
+// of the process being killed.
+func runInterruptible(vm gsvm.Machine, input string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return vm.RunContext(ctx, input)
+}
+
 func Run(initNS gsvm.NameSpace) {
-	fmt.Println("go-shell 1.0")
-	vm := gsvm.New(initNS)
+	vm := gsvm.NewWithOptions(initNS, gsvm.Options{
+		Echo: func(name string, vl reflect.Value) {
+			fmt.Printf("%s = %s\n", name, gsvm.FormatValue(vl))
+		},
+		MaxSteps:    MaxSteps,
+		MaxDuration: Timeout,
+		MaxAlloc:    MaxAlloc,
+	})
+	sess, restored := restoreSession(vm)
+	if !restored {
+		fmt.Println("go-shell 1.0")
+	}
 
-	in := bufio.NewReader(os.Stdin)
+	incomplete := func(text string) bool {
+		return !isCommand(text) && gsvm.IsFragment(text)
+	}
+	complete := func(text string) (string, []string) {
+		if isCommand(text) {
+			return completeCommand(vm, text)
+		}
+		return vm.Complete(text)
+	}
+	in := newLineReader(HistoryFile, incomplete, complete)
+	defer in.Close()
 
 	buffered := ""
 
 	for {
-		if buffered == "" {
-			fmt.Print(PS)
+		prompt := PS
+		if buffered != "" {
+			prompt = PS2
+		}
+		line, err := in.ReadLine(prompt)
+		if err == errInterrupted {
+			buffered = ""
+			continue
 		}
-		line, err := in.ReadString('\n')
 		if err != nil {
 			fmt.Println()
 			if err == io.EOF {
@@ -34,14 +129,75 @@ func Run(initNS gsvm.NameSpace) {
 			}
 			log.Fatalf("Read error: %v", err)
 		}
-		err = vm.Run(buffered + line)
+		if buffered == "" && isCommand(line) {
+			if hErr := in.AddHistory(line); hErr != nil {
+				log.Printf("Saving history failed: %v", hErr)
+			}
+			err := runCommand(vm, line)
+			if err == errQuit {
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			name, _ := splitCommand(line)
+			if cmd, _ := findCommand(name); cmd != nil && cmd.stateful {
+				sess.Record(line)
+			}
+			continue
+		}
+		if imports, ok := parseImports(buffered + line); ok {
+			if err := importPackages(sess, imports, in); err != nil {
+				log.Println(err)
+			}
+			buffered = ""
+			continue
+		}
+
+		input := buffered + line
+		err = runInterruptible(vm, input)
 		if err == gsvm.FragmentErr {
-			buffered += "\n" + line
+			buffered = input + "\n"
 		} else {
+			if hErr := in.AddHistory(input); hErr != nil {
+				log.Printf("Saving history failed: %v", hErr)
+			}
 			if err != nil {
 				log.Println(err)
+				fmt.Fprint(os.Stderr, sourceExcerpt(err, input))
+			} else {
+				// inputs failed or canceled are not replayed after restarting
+				sess.Record(input)
 			}
 			buffered = ""
 		}
 	}
 }
+
+// sourceExcerpt returns the line of src err is at, with a caret under the
+// column, or "" if err has no position in src.
+func sourceExcerpt(err error, src string) string {
+	var ge gsvm.Error
+	if !errors.As(err, &ge) {
+		return ""
+	}
+	pos := ge.ErrorLocation().Pos
+	lines := strings.Split(src, "\n")
+	if pos.Line < 1 || pos.Line > len(lines) || pos.Column < 1 {
+		return ""
+	}
+	line := lines[pos.Line-1]
+	col := pos.Column - 1
+	if col > len(line) {
+		col = len(line)
+	}
+	// keep tabs for aligning the caret
+	indent := []rune(line[:col])
+	for i, r := range indent {
+		if r != '\t' {
+			indent[i] = ' '
+		}
+	}
+	return "    " + line + "\n    " + string(indent) + "^\n"
+}
@@ -0,0 +1,24 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package shell
+
+import "errors"
+
+type termState struct{}
+
+// Line editing is not supported on this platform, input is read plainly.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*termState, error) {
+	return nil, errors.New("raw mode not supported")
+}
+
+func restoreTerm(fd int, st *termState) error {
+	return nil
+}
+
+func termWidth(fd int) int {
+	return 80
+}
@@ -0,0 +1,73 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shell
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getTermios(fd int) (*syscall.Termios, error) {
+	var t syscall.Termios
+	if err := ioctl(fd, ioctlReadTermios, unsafe.Pointer(&t)); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// isTerminal returns true if fd refers to a terminal.
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// termState is the state of a terminal before entering raw mode.
+type termState struct {
+	termios syscall.Termios
+}
+
+// makeRaw puts the terminal fd into raw mode, in which input is available
+// byte by byte without echoing, and returns the previous state. Output
+// processing is kept so that "\n" is still written as "\r\n".
+func makeRaw(fd int) (*termState, error) {
+	t, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+	st := &termState{termios: *t}
+
+	t.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	t.Cflag |= syscall.CS8
+	t.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, ioctlWriteTermios, unsafe.Pointer(t)); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// restoreTerm restores the terminal fd to a state returned by makeRaw.
+func restoreTerm(fd int, st *termState) error {
+	return ioctl(fd, ioctlWriteTermios, unsafe.Pointer(&st.termios))
+}
+
+// termWidth returns the number of columns of the terminal fd, or 80 if
+// unknown.
+func termWidth(fd int) int {
+	var ws struct {
+		Row, Col       uint16
+		Xpixel, Ypixel uint16
+	}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil || ws.Col == 0 {
+		return 80
+	}
+	return int(ws.Col)
+}
@@ -0,0 +1,458 @@
+package gsvm
+
+import (
+	"errors"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
+)
+
+// check type-checks the input, stmts or decls, with go/types before it runs,
+// so that an ill-typed input is rejected before any of its statements has
+// side effects. The names the input refers to are mirrored from the global
+// namespace into the scope of the check. A name which can not be mirrored,
+// e.g. a generic function declared in the interpreter, is mirrored as an
+// opaque object, whose uses are left to the checks when it runs.
+func (mch *machine) check(stmts []ast.Stmt, decls []ast.Decl) error {
+	for _, decl := range decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv != nil {
+			// go/types may also panic on a method of a receiver type it
+			// doesn't see declared.
+			return mch.atPos(fd, methodsNotSupportedErr(fd.Name.Name))
+		}
+	}
+	file := &ast.File{Name: ast.NewIdent("main"), Decls: append([]ast.Decl(nil), decls...)}
+	if len(stmts) > 0 {
+		start, end := stmts[0].Pos(), stmts[len(stmts)-1].End()
+		file.Decls = append(file.Decls, &ast.FuncDecl{
+			Name: &ast.Ident{NamePos: start, Name: "_"},
+			Type: &ast.FuncType{Func: start, Params: &ast.FieldList{}},
+			Body: &ast.BlockStmt{Lbrace: start, List: stmts, Rbrace: end},
+		})
+	}
+
+	declared := make(map[string]bool)
+	for _, decl := range decls {
+		for _, name := range declNames(decl) {
+			declared[name] = true
+		}
+	}
+	used := make(map[string]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			used[ident.Name] = true
+		}
+		return true
+	})
+
+	pkg := types.NewPackage("main", "main")
+	m := &mirror{pkg: pkg, exposeUnexported: mch.Options.Unexported == ReadUnexported}
+	for name := range used {
+		if declared[name] {
+			continue
+		}
+		vl := mch.GlobalNameSpace.Find(name)
+		if vl == NoValue {
+			continue
+		}
+		pkg.Scope().Insert(m.object(name, vl, used))
+	}
+
+	var errs []types.Error
+	conf := types.Config{Error: func(err error) {
+		if te, ok := err.(types.Error); ok && !isREPLSoftError(te) {
+			errs = append(errs, te)
+		}
+	}}
+	if !checkFiles(&conf, mch.fset, pkg, file) || len(errs) == 0 {
+		return nil
+	}
+	pos := mch.fset.Position(errs[0].Pos)
+	err := &TypeError{
+		Location: nodeLocation(pos, nodeAt(file, errs[0].Pos)),
+		Code:     typesErrorCode(errs[0].Msg),
+		Msg:      errs[0].Msg,
+	}
+	if err.Code == UndefinedName {
+		err.Err = UndefinedError{errors.New(err.Msg)}
+	}
+	return err
+}
+
+// checkFiles checks file in pkg, returning false if go/types panics, e.g. on
+// an input it doesn't expect out of a complete package.
+func checkFiles(conf *types.Config, fset *token.FileSet, pkg *types.Package, file *ast.File) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	types.NewChecker(conf, fset, pkg, nil).Files([]*ast.File{file})
+	return true
+}
+
+// isREPLSoftError returns true if err is not an error in the shell, where
+// variables may be used in later inputs and values of bare expressions are
+// echoed, or it is an error of an opaque object, see mirror.opaque.
+func isREPLSoftError(err types.Error) bool {
+	return strings.Contains(err.Msg, "declared and not used") || strings.HasSuffix(err.Msg, " is not used") ||
+		strings.Contains(err.Msg, "with invalid type")
+}
+
+// declNames returns the names declared by decl at the top level.
+func declNames(decl ast.Decl) []string {
+	var names []string
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv == nil {
+			names = append(names, decl.Name.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				for _, name := range spec.Names {
+					names = append(names, name.Name)
+				}
+			case *ast.TypeSpec:
+				names = append(names, spec.Name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// nodeAt returns the outermost expression starting at pos in file, or the
+// innermost statement containing pos if none.
+func nodeAt(file *ast.File, pos token.Pos) ast.Node {
+	var found ast.Node
+	ast.Inspect(file, func(node ast.Node) bool {
+		if node == nil || pos < node.Pos() || pos >= node.End() {
+			return false
+		}
+		if _, ok := node.(ast.Expr); ok && node.Pos() == pos {
+			found = node
+			return false
+		}
+		if _, ok := node.(ast.Stmt); ok {
+			found = node
+		}
+		return true
+	})
+	if found == nil {
+		return file
+	}
+	return found
+}
+
+// typesErrorCode classifies an error message of go/types.
+func typesErrorCode(msg string) ErrorCode {
+	switch {
+	case strings.HasPrefix(msg, "undefined:"), strings.Contains(msg, " undefined ("):
+		return UndefinedName
+	case strings.Contains(msg, "redeclared"), strings.HasPrefix(msg, "no new variables"):
+		return Redeclared
+	case strings.Contains(msg, "mismatched types"), strings.HasPrefix(msg, "cannot use "):
+		return MismatchedTypes
+	case strings.HasPrefix(msg, "cannot convert "):
+		return InvalidConversion
+	case strings.HasPrefix(msg, "not enough "), strings.HasPrefix(msg, "too many "),
+		strings.HasPrefix(msg, "assignment mismatch"):
+		return WrongArgumentCount
+	case strings.HasPrefix(msg, "invalid operation"):
+		return InvalidOperation
+	case strings.Contains(msg, "type argument"), strings.Contains(msg, "does not satisfy"),
+		strings.HasPrefix(msg, "cannot infer"):
+		return InvalidGeneric
+	}
+	return UnknownError
+}
+
+// mirror converts the values and types of the machine into objects and types
+// of go/types.
+type mirror struct {
+	// The package checked, which also holds the unexported fields of struct
+	// types declared in the interpreter.
+	pkg *types.Package
+	// Unexported fields of compiled structs are accessible, see
+	// ReadUnexported.
+	exposeUnexported bool
+
+	pkgs  map[string]*types.Package
+	types map[reflect.Type]types.Type
+}
+
+var untypedLiteralTypes = map[reflect.Type]types.Type{
+	intLiteralType:     types.Typ[types.UntypedInt],
+	bigIntLiteralType:  types.Typ[types.UntypedInt],
+	runeLiteralType:    types.Typ[types.UntypedRune],
+	floatLiteralType:   types.Typ[types.UntypedFloat],
+	complexLiteralType: types.Typ[types.UntypedComplex],
+	stringLiteralType:  types.Typ[types.UntypedString],
+}
+
+// object returns the object of name bound to vl in the namespace. Of a
+// package, only the members in used are mirrored.
+func (m *mirror) object(name string, vl reflect.Value, used map[string]bool) types.Object {
+	if vl.Type() == PackageType {
+		imported := types.NewPackage(name, name)
+		for member, mVl := range vl.Interface().(Package) {
+			if used[member] {
+				imported.Scope().Insert(m.member(imported, member, mVl))
+			}
+		}
+		imported.MarkComplete()
+		return types.NewPkgName(token.NoPos, m.pkg, name, imported)
+	}
+	return m.member(m.pkg, name, vl)
+}
+
+// member returns the object of name bound to vl in pkg. Typed constants of
+// compiled packages are bound to values which are not addressable, unlike
+// variables.
+func (m *mirror) member(pkg *types.Package, name string, vl reflect.Value) types.Object {
+	switch vl.Type() {
+	case TypeValueType:
+		return types.NewTypeName(token.NoPos, pkg, name, m.typ(vl.Interface().(TypeValue).Type))
+	case ConstValueType:
+		if obj, ok := m.constant(pkg, name, vl.Field(0).Interface().(reflect.Value)); ok {
+			return obj
+		}
+		return m.opaque(pkg, name, false)
+	case GenericTypeType, ConstraintType:
+		return m.opaque(pkg, name, true)
+	case GenericFuncType, InstancesType, partialGenericFuncType, MapIndexValueType, deniedSymbolType:
+		// a denied symbol is reported when run
+		return m.opaque(pkg, name, false)
+	}
+	if pkg != m.pkg && !vl.CanAddr() && vl.Kind() != reflect.Func {
+		if obj, ok := m.constant(pkg, name, vl); ok {
+			return obj
+		}
+	}
+	return types.NewVar(token.NoPos, pkg, name, m.typ(vl.Type()))
+}
+
+// opaque returns a type, or a variable, of name which can not be represented
+// in go/types, e.g. a generic function declared in the interpreter or the
+// instances of one of a compiled package. It is of the invalid type, so that
+// go/types reports no errors of its uses, or ones isREPLSoftError skips, and
+// only its uses are left to the checks when it runs.
+func (m *mirror) opaque(pkg *types.Package, name string, isType bool) types.Object {
+	if isType {
+		return types.NewTypeName(token.NoPos, pkg, name, types.Typ[types.Invalid])
+	}
+	return types.NewVar(token.NoPos, pkg, name, types.Typ[types.Invalid])
+}
+
+// constant returns a constant of the value of vl, which is untyped if vl is
+// an untyped literal.
+func (m *mirror) constant(pkg *types.Package, name string, vl reflect.Value) (types.Object, bool) {
+	var val constant.Value
+	if vl.Type() == bigIntLiteralType {
+		val = constant.Make(vl.Interface().(bigIntLiteral).Int)
+	} else {
+		switch vl.Kind() {
+		case reflect.Bool:
+			val = constant.MakeBool(vl.Bool())
+		case reflect.String:
+			val = constant.MakeString(vl.String())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			val = constant.MakeInt64(vl.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			val = constant.MakeUint64(vl.Uint())
+		case reflect.Float32, reflect.Float64:
+			val = constant.MakeFloat64(vl.Float())
+		case reflect.Complex64, reflect.Complex128:
+			c := vl.Complex()
+			val = constant.BinaryOp(constant.MakeFloat64(real(c)), token.ADD, constant.MakeImag(constant.MakeFloat64(imag(c))))
+		default:
+			return nil, false
+		}
+	}
+	if val.Kind() == constant.Unknown {
+		// e.g. a NaN
+		return nil, false
+	}
+	return types.NewConst(token.NoPos, pkg, name, m.typ(vl.Type()), val), true
+}
+
+// typ returns the type of go/types of tp. Named types of compiled packages
+// have their exported methods, and interfaces their exported methods only,
+// since the unexported methods of concrete types are not visible to
+// reflection.
+func (m *mirror) typ(tp reflect.Type) types.Type {
+	if t, ok := untypedLiteralTypes[tp]; ok {
+		return t
+	}
+	if t, ok := m.types[tp]; ok {
+		return t
+	}
+	if m.types == nil {
+		m.types = make(map[reflect.Type]types.Type)
+	}
+
+	if tp.Name() != "" {
+		if tp.PkgPath() == "" {
+			if obj := types.Universe.Lookup(tp.Name()); obj != nil {
+				return obj.Type()
+			}
+		}
+		if tp.PkgPath() == "unsafe" && tp.Name() == "Pointer" {
+			return types.Typ[types.UnsafePointer]
+		}
+
+		pkg := m.typesPkg(tp.PkgPath())
+		named := types.NewNamed(types.NewTypeName(token.NoPos, pkg, tp.Name(), nil), nil, nil)
+		m.types[tp] = named
+		named.SetUnderlying(m.literal(tp))
+		if tp.Kind() != reflect.Interface {
+			m.addMethods(named, tp)
+		}
+		return named
+	}
+
+	t := m.literal(tp)
+	m.types[tp] = t
+	return t
+}
+
+func (m *mirror) typesPkg(path string) *types.Package {
+	if path == "" || path == localPkgPath {
+		return m.pkg
+	}
+	if pkg, ok := m.pkgs[path]; ok {
+		return pkg
+	}
+	if m.pkgs == nil {
+		m.pkgs = make(map[string]*types.Package)
+	}
+	pkg := types.NewPackage(path, path[strings.LastIndex(path, "/")+1:])
+	m.pkgs[path] = pkg
+	return pkg
+}
+
+// literal returns the type literal of tp, i.e. the underlying type if tp is
+// named.
+func (m *mirror) literal(tp reflect.Type) types.Type {
+	switch tp.Kind() {
+	case reflect.Bool:
+		return types.Typ[types.Bool]
+	case reflect.Int:
+		return types.Typ[types.Int]
+	case reflect.Int8:
+		return types.Typ[types.Int8]
+	case reflect.Int16:
+		return types.Typ[types.Int16]
+	case reflect.Int32:
+		return types.Typ[types.Int32]
+	case reflect.Int64:
+		return types.Typ[types.Int64]
+	case reflect.Uint:
+		return types.Typ[types.Uint]
+	case reflect.Uint8:
+		return types.Typ[types.Uint8]
+	case reflect.Uint16:
+		return types.Typ[types.Uint16]
+	case reflect.Uint32:
+		return types.Typ[types.Uint32]
+	case reflect.Uint64:
+		return types.Typ[types.Uint64]
+	case reflect.Uintptr:
+		return types.Typ[types.Uintptr]
+	case reflect.Float32:
+		return types.Typ[types.Float32]
+	case reflect.Float64:
+		return types.Typ[types.Float64]
+	case reflect.Complex64:
+		return types.Typ[types.Complex64]
+	case reflect.Complex128:
+		return types.Typ[types.Complex128]
+	case reflect.String:
+		return types.Typ[types.String]
+	case reflect.UnsafePointer:
+		return types.Typ[types.UnsafePointer]
+	case reflect.Array:
+		return types.NewArray(m.typ(tp.Elem()), int64(tp.Len()))
+	case reflect.Slice:
+		return types.NewSlice(m.typ(tp.Elem()))
+	case reflect.Ptr:
+		return types.NewPointer(m.typ(tp.Elem()))
+	case reflect.Map:
+		return types.NewMap(m.typ(tp.Key()), m.typ(tp.Elem()))
+	case reflect.Chan:
+		dir := types.SendRecv
+		switch tp.ChanDir() {
+		case reflect.SendDir:
+			dir = types.SendOnly
+		case reflect.RecvDir:
+			dir = types.RecvOnly
+		}
+		return types.NewChan(dir, m.typ(tp.Elem()))
+	case reflect.Func:
+		return m.signature(nil, tp, 0)
+	case reflect.Struct:
+		fields := make([]*types.Var, tp.NumField())
+		tags := make([]string, tp.NumField())
+		for i := range fields {
+			fld := tp.Field(i)
+			pkg := m.pkg
+			if fld.PkgPath != "" && !m.exposeUnexported {
+				pkg = m.typesPkg(fld.PkgPath)
+			}
+			fields[i] = types.NewField(token.NoPos, pkg, fld.Name, m.typ(fld.Type), fld.Anonymous)
+			tags[i] = string(fld.Tag)
+		}
+		return types.NewStruct(fields, tags)
+	case reflect.Interface:
+		var methods []*types.Func
+		for i := 0; i < tp.NumMethod(); i++ {
+			mt := tp.Method(i)
+			if mt.PkgPath != "" {
+				continue
+			}
+			methods = append(methods, types.NewFunc(token.NoPos, m.pkg, mt.Name, m.signature(nil, mt.Type, 0)))
+		}
+		return types.NewInterfaceType(methods, nil).Complete()
+	}
+	return types.NewInterfaceType(nil, nil).Complete()
+}
+
+// signature returns the signature of a function type tp, with the first skip
+// parameters, e.g. the receiver of a method, skipped.
+func (m *mirror) signature(recv *types.Var, tp reflect.Type, skip int) *types.Signature {
+	params := make([]*types.Var, tp.NumIn()-skip)
+	for i := range params {
+		params[i] = types.NewParam(token.NoPos, m.pkg, "", m.typ(tp.In(i+skip)))
+	}
+	results := make([]*types.Var, tp.NumOut())
+	for i := range results {
+		results[i] = types.NewParam(token.NoPos, m.pkg, "", m.typ(tp.Out(i)))
+	}
+	return types.NewSignatureType(recv, nil, nil, types.NewTuple(params...), types.NewTuple(results...), tp.IsVariadic())
+}
+
+// addMethods adds the exported methods of tp, with value or pointer
+// receivers, to named.
+func (m *mirror) addMethods(named *types.Named, tp reflect.Type) {
+	pkg := named.Obj().Pkg()
+	for _, rTp := range []reflect.Type{tp, reflect.PtrTo(tp)} {
+		for i := 0; i < rTp.NumMethod(); i++ {
+			mt := rTp.Method(i)
+			if rTp != tp {
+				if _, ok := tp.MethodByName(mt.Name); ok {
+					continue
+				}
+			}
+			var recvTp types.Type = named
+			if rTp != tp {
+				recvTp = types.NewPointer(named)
+			}
+			recv := types.NewVar(token.NoPos, pkg, "", recvTp)
+			named.AddMethod(types.NewFunc(token.NoPos, pkg, mt.Name, m.signature(recv, mt.Type, 1)))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package gsvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestCheckBeforeRun(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`n := 1`))
+	err := mch.Run(`n = 2; s := "a" + 1`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "error", te.Error(), `input:1:13: invalid operation: "a" + 1 (mismatched types untyped string and untyped int)`)
+		assert.Equals(t, "node", te.Node, `"a" + 1`)
+	}
+	// nothing of the input runs
+	assert.NoError(t, mch.Run(`if n != 1 { panic(n) }`))
+
+	cases := []struct {
+		src, msg string
+		code     ErrorCode
+	}{
+		{`x := fmt.Sprint(1) + 2`, `invalid operation: fmt.Sprint(1) + 2 (mismatched types string and untyped int)`, MismatchedTypes},
+		{`var f float64 = math.Sin("a")`, `cannot use "a" (untyped string constant) as float64 value in argument to math.Sin`, MismatchedTypes},
+		{`a, b := math.Sincos(1, 2)`, `too many arguments in call to math.Sincos
+	have (number, number)
+	want (float64)`, WrongArgumentCount},
+		{`var u uint8 = math.MaxUint64`, `cannot use math.MaxUint64 (untyped int constant 18446744073709551615) as uint8 value in variable declaration (overflows)`, MismatchedTypes},
+		{`n.Foo()`, `n.Foo undefined (type int has no field or method Foo)`, UndefinedName},
+		{`func g() int { return "a" }`, `cannot use "a" (untyped string constant) as int value in return statement`, MismatchedTypes},
+		{`var st fmt.Stringer = 1`, `cannot use 1 (constant of type int) as fmt.Stringer value in variable declaration: int does not implement fmt.Stringer (missing method String)`, MismatchedTypes},
+	}
+	for _, c := range cases {
+		err := mch.Run(c.src)
+		var te *TypeError
+		if assert.True(t, c.src, errors.As(err, &te)) {
+			assert.Equals(t, c.src, te.Msg, c.msg)
+			assert.Equals(t, c.src, te.Code, c.code)
+		}
+	}
+
+	// not errors in the shell
+	assert.NoError(t, mch.Run(`unused := 1`))
+	assert.NoError(t, mch.Run(`n + 1`))
+	assert.NoError(t, mch.Run(`func h() int { return n }`))
+	assert.NoError(t, mch.Run(`func h() string { return "redeclared" }`))
+	assert.NoError(t, mch.Run(`var hs string = h()`))
+}
+
+func TestCheckMethodDecl(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`type T struct{ n int }`))
+	err := mch.Run(`func (t T) Get() int { return t.n }`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "code", te.Code, NotSupported)
+	}
+	err = mch.Run(`type U struct{}
+func (u U) Get() int { return 1 }`)
+	assert.True(t, "TypeError", errors.As(err, &te))
+	// rejected before any declaration of the input
+	assert.Equals(t, "U", mch.GlobalNameSpace.Find("U"), NoValue)
+}
+
+// Names which can not be mirrored leave only their uses unchecked.
+func TestCheckOpaqueNames(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func Map[T, U any](xs []T, f func(T) U) []U {
+	ys := []U{}
+	for _, x := range xs {
+		ys = append(ys, f(x))
+	}
+	return ys
+}
+type List[T any] []T`))
+	assert.NoError(t, mch.Run(`ok := slices.Contains([]int{1}, 1)
+var l List[string] = Map([]int{1}, func(i int) string { return "x" })`))
+	assert.Equals(t, "ok", mch.GlobalNameSpace.FindLocal("ok").Interface(), true)
+
+	for _, src := range []string{
+		`b := slices.Contains([]string{"a"}, "a"); n := 1 + "a"`,
+		`ys := Map([]int{1}, func(i int) string { return "x" }); var s string = 1`,
+		`var l List[int]; l = append(l, 1); var f float64 = "a"`,
+	} {
+		err := mch.Run(src)
+		var te *TypeError
+		if assert.True(t, src, errors.As(err, &te)) {
+			assert.Equals(t, src, te.Code, MismatchedTypes)
+		}
+	}
+	// nothing of the inputs runs
+	assert.Equals(t, "b", mch.GlobalNameSpace.Find("b"), NoValue)
+	assert.Equals(t, "ys", mch.GlobalNameSpace.Find("ys"), NoValue)
+}
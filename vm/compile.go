@@ -0,0 +1,1239 @@
+package gsvm
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+	"sync/atomic"
+)
+
+// For and range statements are compiled to closures at their first run, instead of
+// walking the AST, dispatching on the nodes and looking up names through the
+// namespaces on every iteration. Variables declared in the loop are resolved
+// to slots of a frame, and names declared outside of it are bound to slots
+// once each time the loop starts. Operators have fast paths selected by the
+// operator and the kind of the operands. Nodes not compiled, e.g. builtin
+// calls and function literals, are run by the walker on a namespace of the
+// variables in scope, and the compiled code shares the helpers of the walker
+// otherwise, so that both behave the same.
+
+// slotKind is the kind of the slots of a frame a variable is stored in.
+// Variables of types int, float64, bool and string declared in a loop are
+// stored unboxed, and converted to reflect.Value only where the walker or a
+// function called needs one.
+type slotKind int
+
+const (
+	valueSlot slotKind = iota
+	intSlot
+	floatSlot
+	boolSlot
+	stringSlot
+
+	nSlotKinds
+)
+
+// slotKindOf returns the kind of slots a variable of type tp is stored in.
+func slotKindOf(tp reflect.Type) slotKind {
+	switch tp {
+	case intType:
+		return intSlot
+	case float64Type:
+		return floatSlot
+	case boolType:
+		return boolSlot
+	case stringType:
+		return stringSlot
+	}
+	return valueSlot
+}
+
+// varSlot is where a variable is stored in a frame.
+type varSlot struct {
+	kind slotKind
+	idx  int
+}
+
+// frame holds the variables of a running compiled loop.
+type frame struct {
+	slots  []reflect.Value
+	ints   []int
+	floats []float64
+	bools  []bool
+	strs   []string
+	// The namespace the loop runs in
+	ns NameSpace
+	// The statement running, where a panic is reported
+	cur ast.Stmt
+}
+
+func newFrame(code *loopCode, ns NameSpace, st ast.Stmt) *frame {
+	return &frame{
+		slots:  make([]reflect.Value, code.nSlots[valueSlot]),
+		ints:   make([]int, code.nSlots[intSlot]),
+		floats: make([]float64, code.nSlots[floatSlot]),
+		bools:  make([]bool, code.nSlots[boolSlot]),
+		strs:   make([]string, code.nSlots[stringSlot]),
+		ns:     ns,
+		cur:    st,
+	}
+}
+
+// value returns the variable in slot as a reflect.Value. A variable stored
+// unboxed is returned as an addressable value referring to its slot, so that
+// it can be set by the walker.
+func (fr *frame) value(slot varSlot) reflect.Value {
+	switch slot.kind {
+	case intSlot:
+		return reflect.ValueOf(&fr.ints[slot.idx]).Elem()
+	case floatSlot:
+		return reflect.ValueOf(&fr.floats[slot.idx]).Elem()
+	case boolSlot:
+		return reflect.ValueOf(&fr.bools[slot.idx]).Elem()
+	case stringSlot:
+		return reflect.ValueOf(&fr.strs[slot.idx]).Elem()
+	}
+	return fr.slots[slot.idx]
+}
+
+// namespace returns a namespace with the variables in slots, by name, on top
+// of the one the loop runs in, for running nodes with the walker.
+func (fr *frame) namespace(slots map[string]varSlot) NameSpace {
+	ns := fr.ns.NewBlock()
+	for name, slot := range slots {
+		if vl := fr.value(slot); vl.IsValid() {
+			ns.AddLocal(name, vl)
+		}
+	}
+	return ns
+}
+
+type (
+	exprCode func(fr *frame) (reflect.Value, error)
+	// Returns the values of a call, which may be multiple
+	callCode func(fr *frame) ([]reflect.Value, error)
+	stmtCode func(fr *frame) error
+	condCode func(fr *frame) (bool, error)
+)
+
+// loopCode is a compiled for or range statement.
+type loopCode struct {
+	// Number of slots of each kind
+	nSlots [nSlotKinds]int
+	// The names declared outside of the loop, their slots, and the types of
+	// their values when compiled.
+	free      []string
+	freeSlots []int
+	freeTps   []reflect.Type
+
+	run stmtCode
+}
+
+// compiler compiles a for or range statement.
+type compiler struct {
+	mch *machine
+	// The statement compiled
+	root ast.Stmt
+	// The namespace the loop is compiled in, where names declared outside of
+	// it are looked up.
+	ns NameSpace
+	// The blocks, innermost last, mapping variables declared to slots
+	scopes []map[string]varSlot
+	// Indexes of the names declared outside of the loop in code.free
+	free map[string]int
+	code *loopCode
+	// Variables may be captured by function literals or their addresses, in
+	// which case they are not reused by later declarations and iterations,
+	// and not stored unboxed.
+	captures bool
+	// Set if the loop can not be compiled, e.g. it has labels.
+	failed bool
+}
+
+// runCompiled runs st, a for or range statement, compiled, which is compiled
+// at its first run. ok is false if st can not be compiled, or a name it refers
+// to is bound to a value of a different type from when it was compiled, in
+// which case it is left to the walker.
+func (mch *machine) runCompiled(ns NameSpace, st ast.Stmt) (ok bool, err error) {
+	if mch.walkOnly {
+		return false, nil
+	}
+	code := mch.loopCode(ns, st)
+	if code == nil {
+		return false, nil
+	}
+
+	fr := newFrame(code, ns, st)
+	for i, name := range code.free {
+		vl := ns.Find(name)
+		if vl == NoValue || vl.Type() != code.freeTps[i] {
+			return false, nil
+		}
+		fr.slots[code.freeSlots[i]] = vl
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = mch.atPos(fr.innermost(st), recoveredErr(r))
+		}
+	}()
+	return true, code.run(fr)
+}
+
+// innermost returns the innermost statement running in the loop st, where a
+// panic is reported.
+func (fr *frame) innermost(st ast.Stmt) ast.Stmt {
+	if wf := frameOf(fr.ns); wf != nil && wf.cur != nil && wf.cur != st {
+		// in a statement run by the walker
+		return wf.cur
+	}
+	return fr.cur
+}
+
+// loopCode returns st compiled, compiling it at its first run. Goroutines
+// started by earlier inputs may run loops at the same time, so the loops are
+// guarded by loopsMu.
+func (mch *machine) loopCode(ns NameSpace, st ast.Stmt) *loopCode {
+	mch.loopsMu.Lock()
+	code, found := mch.loops[st]
+	mch.loopsMu.Unlock()
+	if found {
+		return code
+	}
+
+	code = mch.compileLoop(ns, st)
+	mch.loopsMu.Lock()
+	if mch.loops == nil {
+		mch.loops = make(map[ast.Stmt]*loopCode)
+	}
+	mch.loops[st] = code
+	mch.loopsMu.Unlock()
+	return code
+}
+
+// forgetLoops drops the loops compiled of the statements of an input, which
+// are not run again, except the ones of function literals, which may be
+// called later.
+func (mch *machine) forgetLoops(stmts []ast.Stmt) {
+	mch.loopsMu.Lock()
+	defer mch.loopsMu.Unlock()
+	if len(mch.loops) == 0 {
+		return
+	}
+	for _, st := range stmts {
+		ast.Inspect(st, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ForStmt, *ast.RangeStmt:
+				delete(mch.loops, node.(ast.Stmt))
+			}
+			return true
+		})
+	}
+}
+
+func (mch *machine) compileLoop(ns NameSpace, st ast.Stmt) *loopCode {
+	c := &compiler{mch: mch, root: st, ns: ns, free: make(map[string]int), code: &loopCode{}}
+	ast.Inspect(st, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			c.captures = true
+		case *ast.UnaryExpr:
+			c.captures = c.captures || node.Op == token.AND
+		case *ast.ParenExpr:
+			// Not supported by the walker, which fails where it evaluates
+			// one, possibly after some iterations, so the loop is left to it
+			// instead of failing elsewhere.
+			c.failed = true
+		}
+		return true
+	})
+	if c.failed {
+		return nil
+	}
+
+	c.code.run = c.stmt(st)
+	if c.failed {
+		return nil
+	}
+	return c.code
+}
+
+func (c *compiler) newSlot(kind slotKind) varSlot {
+	c.code.nSlots[kind]++
+	return varSlot{kind: kind, idx: c.code.nSlots[kind] - 1}
+}
+
+func (c *compiler) push() {
+	c.scopes = append(c.scopes, make(map[string]varSlot))
+}
+
+func (c *compiler) pop() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// declare returns the slot of a new variable name in the innermost block.
+func (c *compiler) declare(name string, kind slotKind) varSlot {
+	slot := c.newSlot(kind)
+	c.scopes[len(c.scopes)-1][name] = slot
+	return slot
+}
+
+// lookup returns the slot of the variable, or the package, name. ok is false
+// if it is something else, e.g. a type or a builtin function.
+func (c *compiler) lookup(name string) (slot varSlot, ok bool) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if slot, ok := c.scopes[i][name]; ok {
+			return slot, true
+		}
+	}
+	if i, ok := c.free[name]; ok {
+		return varSlot{kind: valueSlot, idx: c.code.freeSlots[i]}, true
+	}
+
+	vl := c.ns.Find(name)
+	if vl == NoValue {
+		return varSlot{}, false
+	}
+	switch vl.Type() {
+	case TypeValueType, GenericFuncType, GenericTypeType, ConstraintType, partialGenericFuncType, InstancesType, deniedSymbolType:
+		return varSlot{}, false
+	}
+	slot = c.newSlot(valueSlot)
+	c.free[name] = len(c.code.free)
+	c.code.free = append(c.code.free, name)
+	c.code.freeSlots = append(c.code.freeSlots, slot.idx)
+	c.code.freeTps = append(c.code.freeTps, vl.Type())
+	return slot, true
+}
+
+// isVar returns true if name is a variable or a package.
+func (c *compiler) isVar(name string) bool {
+	_, ok := c.lookup(name)
+	return ok
+}
+
+// visible returns the slots of the variables in scope by name.
+func (c *compiler) visible() map[string]varSlot {
+	slots := make(map[string]varSlot)
+	for _, scope := range c.scopes {
+		for name, slot := range scope {
+			slots[name] = slot
+		}
+	}
+	return slots
+}
+
+// isName returns true if expr is an identifier or a selector of one, e.g.
+// fmt.Println, evaluating which has no side effects.
+func isName(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.SelectorExpr:
+		return isName(expr.X)
+	}
+	return false
+}
+
+func (c *compiler) single(expr ast.Expr, vls []reflect.Value, err error) (reflect.Value, error) {
+	vl, err := checkSingleValue(vls, err)
+	return vl, c.mch.atPos(expr, err)
+}
+
+// fallback returns expr evaluated by the walker.
+func (c *compiler) fallback(expr ast.Expr) exprCode {
+	slots := c.visible()
+	return func(fr *frame) (reflect.Value, error) {
+		vls, err := c.mch.evalExpr(fr.namespace(slots), expr)
+		return c.single(expr, vls, err)
+	}
+}
+
+func (c *compiler) fallbackCall(expr *ast.CallExpr) callCode {
+	slots := c.visible()
+	return func(fr *frame) ([]reflect.Value, error) {
+		return c.mch.evalExpr(fr.namespace(slots), expr)
+	}
+}
+
+func (c *compiler) fallbackStmt(st ast.Stmt) stmtCode {
+	slots := c.visible()
+	return func(fr *frame) error {
+		return c.mch.runStatement(fr.namespace(slots), st)
+	}
+}
+
+func (c *compiler) expr(expr ast.Expr) exprCode {
+	if code := c.typed(expr); code != nil {
+		return code
+	}
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		vl, err := checkSingleValue(c.mch.evalExprNode(nil, expr))
+		if err != nil {
+			break
+		}
+		return func(*frame) (reflect.Value, error) {
+			return vl, nil
+		}
+
+	case *ast.Ident:
+		if vl := keywordValue(expr.Name); vl != NoValue {
+			return func(*frame) (reflect.Value, error) {
+				return vl, nil
+			}
+		}
+		if slot, ok := c.lookup(expr.Name); ok {
+			return func(fr *frame) (reflect.Value, error) {
+				return fr.value(slot), nil
+			}
+		}
+
+	case *ast.BinaryExpr:
+		return c.binary(expr)
+
+	case *ast.UnaryExpr:
+		x := c.expr(expr.X)
+		return func(fr *frame) (reflect.Value, error) {
+			xv, err := x(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			vls, err := unaryOp(expr, xv)
+			return c.single(expr, vls, err)
+		}
+
+	case *ast.StarExpr:
+		x := c.expr(expr.X)
+		return func(fr *frame) (reflect.Value, error) {
+			xv, err := x(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			if xv.Kind() == reflect.Ptr {
+				return xv.Elem(), nil
+			}
+			return NoValue, c.mch.atPos(expr, invalidIndirectOfErr(xv))
+		}
+
+	case *ast.IndexExpr:
+		if ident, ok := expr.X.(*ast.Ident); ok && !c.isVar(ident.Name) {
+			// e.g. an instantiation of a generic function
+			break
+		}
+		x, index := c.expr(expr.X), c.expr(expr.Index)
+		return func(fr *frame) (reflect.Value, error) {
+			xv, err := x(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			iv, err := index(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			if xv.Kind() == reflect.Slice {
+				i, err := asInteger(iv)
+				if err != nil {
+					return NoValue, c.mch.atPos(expr, err)
+				}
+				return xv.Index(i), nil
+			}
+			vls, err := indexValue(expr, xv, iv)
+			return c.single(expr, vls, err)
+		}
+
+	case *ast.SelectorExpr:
+		if ident, ok := expr.X.(*ast.Ident); ok && !c.isVar(ident.Name) {
+			// e.g. a method expression of a type
+			break
+		}
+		x := c.expr(expr.X)
+		return func(fr *frame) (reflect.Value, error) {
+			xv, err := x(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			if xv.Type() == PackageType {
+				if vl, ok := xv.Interface().(Package)[expr.Sel.Name]; ok && vl.Type() != deniedSymbolType {
+					return vl, nil
+				}
+			}
+			vls, err := c.mch.selectExpr(expr, xv)
+			return c.single(expr, vls, err)
+		}
+
+	case *ast.CallExpr:
+		call := c.call(expr)
+		return func(fr *frame) (reflect.Value, error) {
+			vls, err := call(fr)
+			return c.single(expr, vls, err)
+		}
+	}
+	return c.fallback(expr)
+}
+
+// call compiles a call of a function. Builtin functions, generic functions
+// and functions of values computed, e.g. f()(), are called by the walker.
+func (c *compiler) call(expr *ast.CallExpr) callCode {
+	if !isName(expr.Fun) || expr.Ellipsis.IsValid() {
+		return c.fallbackCall(expr)
+	}
+	if len(expr.Args) == 1 {
+		if _, ok := expr.Args[0].(*ast.CallExpr); ok {
+			// e.g. f(g()) where g returns multiple values
+			return c.fallbackCall(expr)
+		}
+	}
+
+	if ident, ok := expr.Fun.(*ast.Ident); ok && !c.isVar(ident.Name) {
+		tp, ok := basicTypes[ident.Name]
+		if !ok || len(expr.Args) != 1 {
+			return c.fallbackCall(expr)
+		}
+		// a conversion, e.g. float64(i)
+		arg := c.expr(expr.Args[0])
+		return func(fr *frame) ([]reflect.Value, error) {
+			v, err := arg(fr)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = convertTo(v, tp); err != nil {
+				return nil, c.mch.atPos(expr, err)
+			}
+			return []reflect.Value{v}, nil
+		}
+	}
+
+	fun := c.expr(expr.Fun)
+	args := make([]exprCode, len(expr.Args))
+	for i, arg := range expr.Args {
+		args[i] = c.expr(arg)
+	}
+	walk := c.fallbackCall(expr)
+	return func(fr *frame) ([]reflect.Value, error) {
+		fn, err := fun(fr)
+		if err != nil {
+			return nil, err
+		}
+		if fn.Kind() != reflect.Func {
+			// e.g. a conversion to a named type, or a generic function
+			return walk(fr)
+		}
+		vls := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			if vls[i], err = arg(fr); err != nil {
+				return nil, err
+			}
+		}
+		vls, err = callFunc(fn, vls)
+		return vls, c.mch.atPos(expr, err)
+	}
+}
+
+// compare returns the result of a op b, where op is a comparison operator.
+func compare[T int64 | uint64 | float64 | string](op token.Token, a, b T) bool {
+	switch op {
+	case token.LSS:
+		return a < b
+	case token.LEQ:
+		return a <= b
+	case token.GTR:
+		return a > b
+	case token.GEQ:
+		return a >= b
+	case token.EQL:
+		return a == b
+	}
+	return a != b
+}
+
+// fastBinaryOp returns a fast path of op for operands of the same type, or
+// nil if none. The path reports false for the kinds it does not handle, which
+// are left to binaryOp.
+func fastBinaryOp(op token.Token) func(x, y reflect.Value) (reflect.Value, bool) {
+	switch op {
+	case token.LSS, token.LEQ, token.GTR, token.GEQ, token.EQL, token.NEQ:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			switch x.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				return reflect.ValueOf(compare(op, x.Int(), y.Int())), true
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				return reflect.ValueOf(compare(op, x.Uint(), y.Uint())), true
+			case reflect.Float32, reflect.Float64:
+				return reflect.ValueOf(compare(op, x.Float(), y.Float())), true
+			case reflect.String:
+				return reflect.ValueOf(compare(op, x.String(), y.String())), true
+			}
+			return NoValue, false
+		}
+
+	case token.ADD:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			switch x.Type() {
+			case intType:
+				return reflect.ValueOf(int(x.Int() + y.Int())), true
+			case float64Type:
+				return reflect.ValueOf(x.Float() + y.Float()), true
+			case stringType:
+				return reflect.ValueOf(x.String() + y.String()), true
+			}
+			return NoValue, false
+		}
+
+	case token.SUB:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			switch x.Type() {
+			case intType:
+				return reflect.ValueOf(int(x.Int() - y.Int())), true
+			case float64Type:
+				return reflect.ValueOf(x.Float() - y.Float()), true
+			}
+			return NoValue, false
+		}
+
+	case token.MUL:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			switch x.Type() {
+			case intType:
+				return reflect.ValueOf(int(x.Int() * y.Int())), true
+			case float64Type:
+				return reflect.ValueOf(x.Float() * y.Float()), true
+			}
+			return NoValue, false
+		}
+
+	case token.QUO:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			switch x.Type() {
+			case intType:
+				return reflect.ValueOf(int(x.Int() / y.Int())), true
+			case float64Type:
+				return reflect.ValueOf(x.Float() / y.Float()), true
+			}
+			return NoValue, false
+		}
+
+	case token.REM:
+		return func(x, y reflect.Value) (reflect.Value, bool) {
+			if x.Type() == intType {
+				return reflect.ValueOf(int(x.Int() % y.Int())), true
+			}
+			return NoValue, false
+		}
+	}
+	return nil
+}
+
+func (c *compiler) binary(expr *ast.BinaryExpr) exprCode {
+	x, y := c.expr(expr.X), c.expr(expr.Y)
+
+	if expr.Op == token.LAND || expr.Op == token.LOR {
+		return func(fr *frame) (reflect.Value, error) {
+			xv, err := x(fr)
+			if err != nil {
+				return NoValue, err
+			}
+			if xv.Kind() != reflect.Bool {
+				return NoValue, c.mch.atPos(expr, invalidOperationErr(expr.Op.String(), xv.Type()))
+			}
+			bX := xv.Bool()
+			if expr.Op == token.LAND && !bX || expr.Op == token.LOR && bX {
+				return reflect.ValueOf(bX), nil
+			}
+			return y(fr)
+		}
+	}
+
+	fast := fastBinaryOp(expr.Op)
+	// A literal operand is converted to the type of the other one, as
+	// matchType does, once for each type. The loop may be run by several
+	// goroutines, so the conversion is replaced atomically.
+	_, xLit := expr.X.(*ast.BasicLit)
+	_, yLit := expr.Y.(*ast.BasicLit)
+	type converted struct {
+		tp reflect.Type
+		vl reflect.Value
+	}
+	var lastLit atomic.Pointer[converted]
+	convertLit := func(lit reflect.Value, tp reflect.Type) reflect.Value {
+		if last := lastLit.Load(); last != nil && last.tp == tp {
+			return last.vl
+		}
+		vl := matchDestType(lit, tp)
+		lastLit.Store(&converted{tp: tp, vl: vl})
+		return vl
+	}
+	return func(fr *frame) (reflect.Value, error) {
+		xv, err := x(fr)
+		if err != nil {
+			return NoValue, err
+		}
+		yv, err := y(fr)
+		if err != nil {
+			return NoValue, err
+		}
+		if xv.Type() != yv.Type() {
+			if yLit && !xLit && !isUntyped(xv.Type()) {
+				yv = convertLit(yv, xv.Type())
+			} else if xLit && !yLit && !isUntyped(yv.Type()) {
+				xv = convertLit(xv, yv.Type())
+			}
+		}
+		if err := c.mch.allocConcat(expr.Op, xv, yv); err != nil {
+			return NoValue, c.mch.atPos(expr, err)
+		}
+		if fast != nil && xv.Type() == yv.Type() {
+			if vl, ok := fast(xv, yv); ok {
+				return vl, nil
+			}
+		}
+		vls, err := binaryOp(expr.Op, xv, yv)
+		return c.single(expr, vls, err)
+	}
+}
+
+// stmt compiles st. Errors are reported at the position of st unless they
+// have one, as runStatement does.
+func (c *compiler) stmt(st ast.Stmt) stmtCode {
+	code := c.stmtNode(st)
+	return func(fr *frame) error {
+		fr.cur = st
+		if err := code(fr); err != nil {
+			return c.mch.atPos(st, err)
+		}
+		return nil
+	}
+}
+
+func (c *compiler) stmtNode(st ast.Stmt) stmtCode {
+	switch st := st.(type) {
+	case *ast.ExprStmt:
+		if call, ok := st.X.(*ast.CallExpr); ok {
+			code := c.call(call)
+			return func(fr *frame) error {
+				_, err := code(fr)
+				return err
+			}
+		}
+		x := c.expr(st.X)
+		return func(fr *frame) error {
+			_, err := x(fr)
+			return err
+		}
+
+	case *ast.AssignStmt:
+		switch st.Tok {
+		case token.DEFINE:
+			return c.define(st)
+		case token.ASSIGN:
+			return c.assign(st)
+		case token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN:
+			// x op= y is x = x op y for a variable x
+			if code := c.typedAssign(st.Lhs[0], &ast.BinaryExpr{X: st.Lhs[0], OpPos: st.TokPos, Op: assignOps[st.Tok], Y: st.Rhs[0]}); code != nil {
+				return code
+			}
+			l, r := c.expr(st.Lhs[0]), c.expr(st.Rhs[0])
+			return func(fr *frame) error {
+				v, err := l(fr)
+				if err != nil {
+					return err
+				}
+				if !v.CanSet() {
+					return cannotAssignToErr(st.Lhs[0])
+				}
+				delta, err := r(fr)
+				if err != nil {
+					return err
+				}
+				if err := c.mch.allocConcat(st.Tok, v, delta); err != nil {
+					return err
+				}
+				return opAssign(st.Tok, v, delta)
+			}
+		}
+
+	case *ast.IncDecStmt:
+		op := token.ADD
+		if st.Tok == token.DEC {
+			op = token.SUB
+		}
+		one := &ast.BasicLit{ValuePos: st.TokPos, Kind: token.INT, Value: "1"}
+		if code := c.typedAssign(st.X, &ast.BinaryExpr{X: st.X, OpPos: st.TokPos, Op: op, Y: one}); code != nil {
+			return code
+		}
+		x := c.expr(st.X)
+		return func(fr *frame) error {
+			xv, err := x(fr)
+			if err != nil {
+				return err
+			}
+			if !xv.CanSet() {
+				return cannotAssignToErr(st.X)
+			}
+			return incDec(st.Tok, xv)
+		}
+
+	case *ast.BlockStmt:
+		c.push()
+		codes := make([]stmtCode, len(st.List))
+		for i, st := range st.List {
+			codes[i] = c.stmt(st)
+		}
+		c.pop()
+		return func(fr *frame) error {
+			for _, code := range codes {
+				if err := code(fr); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+	case *ast.IfStmt:
+		return c.ifStmt(st)
+
+	case *ast.ForStmt:
+		return c.forStmt(st)
+
+	case *ast.RangeStmt:
+		return c.rangeStmt(st)
+
+	case *ast.BranchStmt:
+		if st.Label != nil {
+			break
+		}
+		switch st.Tok {
+		case token.BREAK:
+			return func(*frame) error { return beBreak }
+		case token.CONTINUE:
+			return func(*frame) error { return beContinue }
+		}
+
+	case *ast.DeclStmt, *ast.LabeledStmt:
+		// declarations in the blocks compiled
+
+	default:
+		// e.g. return and switch statements
+		return c.fallbackStmt(st)
+	}
+
+	c.failed = true
+	return nil
+}
+
+// cond compiles the condition of an if or for statement, named by stmt.
+func (c *compiler) cond(expr ast.Expr, stmt string) condCode {
+	if c.staticType(expr) == boolType {
+		cond := c.boolExpr(expr)
+		return func(fr *frame) (bool, error) {
+			return cond(fr), nil
+		}
+	}
+	cond := c.expr(expr)
+	return func(fr *frame) (bool, error) {
+		cnd, err := cond(fr)
+		if err != nil {
+			return false, err
+		}
+		if cnd.Kind() != reflect.Bool {
+			return false, nonBoolAsConditionErr(cnd, stmt)
+		}
+		return cnd.Bool(), nil
+	}
+}
+
+func (c *compiler) ifStmt(st *ast.IfStmt) stmtCode {
+	c.push()
+	defer c.pop()
+
+	var init, els stmtCode
+	if st.Init != nil {
+		init = c.stmt(st.Init)
+	}
+	cond := c.cond(st.Cond, "if")
+	body := c.stmt(st.Body)
+	if st.Else != nil {
+		els = c.stmt(st.Else)
+	}
+	return func(fr *frame) error {
+		if init != nil {
+			if err := init(fr); err != nil {
+				return err
+			}
+		}
+		cnd, err := cond(fr)
+		if err != nil {
+			return err
+		}
+		if cnd {
+			return body(fr)
+		}
+		if els != nil {
+			return els(fr)
+		}
+		return nil
+	}
+}
+
+func (c *compiler) forStmt(st *ast.ForStmt) stmtCode {
+	c.push()
+	defer c.pop()
+
+	var init, post stmtCode
+	var cond condCode
+	if st.Init != nil {
+		init = c.stmt(st.Init)
+	}
+	var loopSlots []int
+	if c.captures {
+		// Each iteration has its own copy of the variables declared by the
+		// init statement, as in the walker.
+		for _, slot := range c.scopes[len(c.scopes)-1] {
+			if slot.kind == valueSlot {
+				loopSlots = append(loopSlots, slot.idx)
+			}
+		}
+	}
+	if st.Cond != nil {
+		cond = c.cond(st.Cond, "for")
+	}
+	body := c.stmt(st.Body)
+	if st.Post != nil {
+		post = c.stmt(st.Post)
+	}
+
+	return func(fr *frame) error {
+		if init != nil {
+			if err := init(fr); err != nil {
+				return err
+			}
+		}
+		for {
+			fr.cur = st
+			if err := c.mch.tick(); err != nil {
+				return err
+			}
+			if cond != nil {
+				cnd, err := cond(fr)
+				if err != nil {
+					return err
+				}
+				if !cnd {
+					return nil
+				}
+			}
+
+			switch err := body(fr); err {
+			case nil, beContinue:
+			case beBreak:
+				return nil
+			default:
+				return err
+			}
+
+			for _, slot := range loopSlots {
+				old := fr.slots[slot]
+				v := reflect.New(old.Type()).Elem()
+				v.Set(old)
+				fr.slots[slot] = v
+			}
+			if post != nil {
+				if err := post(fr); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (c *compiler) rangeStmt(st *ast.RangeStmt) stmtCode {
+	if st.Tok == token.ASSIGN {
+		// e.g. for k, v = range m, assigning to expressions
+		if st == c.root {
+			c.failed = true
+			return nil
+		}
+		return c.fallbackStmt(st)
+	}
+	x := c.expr(st.X)
+
+	c.push()
+	defer c.pop()
+
+	var key, value varSlot
+	hasKey := st.Key != nil && !isBlankIdent(st.Key)
+	hasValue := st.Value != nil && !isBlankIdent(st.Value)
+	if hasKey {
+		key = c.declare(st.Key.(*ast.Ident).Name, valueSlot)
+	}
+	if hasValue {
+		value = c.declare(st.Value.(*ast.Ident).Name, valueSlot)
+	}
+	body := c.stmt(st.Body)
+
+	return func(fr *frame) error {
+		xv, err := x(fr)
+		if err != nil {
+			return err
+		}
+		xv, keyTp, valueTp, err := rangeClause(st, xv)
+		if err != nil {
+			return err
+		}
+		err = c.mch.rangeOver(xv, func(k, v reflect.Value) (bool, error) {
+			// Each iteration has its own iteration variables.
+			if hasKey {
+				c.newVar(fr, key.idx, keyTp, matchDestType(k, keyTp))
+			}
+			if hasValue {
+				c.newVar(fr, value.idx, valueTp, v)
+			}
+			fr.cur = st
+			if err := c.mch.tick(); err != nil {
+				return false, err
+			}
+			switch err := body(fr); err {
+			case nil, beContinue:
+				return true, nil
+			case beBreak:
+				return false, nil
+			default:
+				return false, err
+			}
+		})
+		// A panic of the body of a range function is recovered by callValue,
+		// without the position of the statement panicked.
+		return c.mch.atPos(fr.innermost(c.root), err)
+	}
+}
+
+// newVar sets the variable in slot idx of the frame, declared of type tp, to
+// vl. The variable of the last iteration is reused if it can not be referred
+// to, e.g. by a method value or a function literal.
+func (c *compiler) newVar(fr *frame, idx int, tp reflect.Type, vl reflect.Value) {
+	if v := fr.slots[idx]; !c.captures && v.IsValid() && v.Type() == tp && isBasicKind(v.Kind()) {
+		v.Set(vl)
+		return
+	}
+	v := reflect.New(tp).Elem()
+	v.Set(vl)
+	fr.slots[idx] = v
+}
+
+// values compiles the right hand side of an assignment to the values
+// assigned, in the way the walker evaluates it.
+func (c *compiler) values(st *ast.AssignStmt) callCode {
+	nL := len(st.Lhs)
+	if len(st.Rhs) == 1 {
+		var rhs callCode
+		if call, ok := st.Rhs[0].(*ast.CallExpr); ok {
+			rhs = c.call(call)
+		} else {
+			r := c.expr(st.Rhs[0])
+			rhs = func(fr *frame) ([]reflect.Value, error) {
+				vl, err := r(fr)
+				if err != nil {
+					return nil, err
+				}
+				return []reflect.Value{vl}, nil
+			}
+		}
+		return func(fr *frame) ([]reflect.Value, error) {
+			rVs, err := rhs(fr)
+			if err != nil {
+				return nil, err
+			}
+			if len(rVs) != 1 {
+				if nL != len(rVs) {
+					return nil, assignmentCountMismatchErr(nL, st.Tok, len(rVs))
+				}
+				return rVs, nil
+			}
+			if nL != 1 && (nL != 2 || rVs[0].Type() != MapIndexValueType) {
+				return nil, assignmentCountMismatchErr(nL, st.Tok, 1)
+			}
+			values := make([]reflect.Value, nL)
+			fillSingleValues(values, rVs[0])
+			return values, nil
+		}
+	}
+
+	if nL != len(st.Rhs) {
+		c.failed = true
+		return nil
+	}
+	rhs := make([]exprCode, len(st.Rhs))
+	for i, r := range st.Rhs {
+		rhs[i] = c.expr(r)
+	}
+	return func(fr *frame) ([]reflect.Value, error) {
+		values := make([]reflect.Value, len(rhs))
+		for i, r := range rhs {
+			rV, err := r(fr)
+			if err != nil {
+				return nil, err
+			}
+			if rV.CanAddr() {
+				// Make a copy of lvalue for parallel assignments
+				tmp := reflect.New(rV.Type()).Elem()
+				tmp.Set(rV)
+				rV = tmp
+			}
+			values[i] = rV
+		}
+		return values, nil
+	}
+}
+
+// singleValue returns the code of the value of expr assigned to a single
+// variable.
+func (c *compiler) singleValue(expr ast.Expr) exprCode {
+	r := c.expr(expr)
+	return func(fr *frame) (reflect.Value, error) {
+		vl, err := r(fr)
+		if err != nil || vl.Type() != MapIndexValueType {
+			return vl, err
+		}
+		values := make([]reflect.Value, 1)
+		fillSingleValues(values, vl)
+		return values[0], nil
+	}
+}
+
+func (c *compiler) define(st *ast.AssignStmt) stmtCode {
+	if code := c.typedDefine(st); code != nil {
+		return code
+	}
+	// The right hand side is compiled before the variables are declared.
+	var single exprCode
+	var values callCode
+	if len(st.Lhs) == 1 && len(st.Rhs) == 1 {
+		single = c.singleValue(st.Rhs[0])
+	} else {
+		values = c.values(st)
+	}
+
+	slots := make([]varSlot, len(st.Lhs))
+	isNew := make([]bool, len(st.Lhs))
+	hasNew := false
+	scope := c.scopes[len(c.scopes)-1]
+	for i, l := range st.Lhs {
+		ident, ok := l.(*ast.Ident)
+		if !ok {
+			c.failed = true
+			return nil
+		}
+		if slot, ok := scope[ident.Name]; ok {
+			slots[i] = slot
+		} else {
+			slots[i], isNew[i], hasNew = c.declare(ident.Name, valueSlot), true, true
+		}
+	}
+	if !hasNew {
+		c.failed = true
+		return nil
+	}
+
+	define := func(fr *frame, i int, vl reflect.Value) error {
+		slot := slots[i]
+		if !isNew[i] {
+			v := fr.value(slot)
+			return assignTo(v, matchDestType(vl, v.Type()))
+		}
+		vl = removeBasicLit(vl)
+		c.newVar(fr, slot.idx, vl.Type(), vl)
+		return nil
+	}
+
+	if single != nil {
+		return func(fr *frame) error {
+			vl, err := single(fr)
+			if err != nil {
+				return err
+			}
+			return define(fr, 0, vl)
+		}
+	}
+	return func(fr *frame) error {
+		vls, err := values(fr)
+		if err != nil {
+			return err
+		}
+		for i, vl := range vls {
+			if err := define(fr, i, vl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (c *compiler) assign(st *ast.AssignStmt) stmtCode {
+	if len(st.Lhs) == 1 && len(st.Rhs) == 1 {
+		if code := c.typedAssign(st.Lhs[0], st.Rhs[0]); code != nil {
+			return code
+		}
+	}
+	var single exprCode
+	var values callCode
+	if len(st.Lhs) == 1 && len(st.Rhs) == 1 {
+		single = c.singleValue(st.Rhs[0])
+	} else {
+		values = c.values(st)
+	}
+	lhs := make([]exprCode, len(st.Lhs))
+	for i, l := range st.Lhs {
+		lhs[i] = c.expr(l)
+	}
+
+	assign := func(fr *frame, i int, vl reflect.Value) error {
+		v, err := lhs[i](fr)
+		if err != nil {
+			return err
+		}
+		if v.Type() == MapIndexValueType {
+			v := v.Interface().(MapIndexValue)
+			vl = matchDestType(vl, v.X.Type().Elem())
+			if !vl.Type().AssignableTo(v.X.Type().Elem()) {
+				return cannotUseAsInAssignmentErr(vl, v.X.Type().Elem())
+			}
+			return c.mch.setMapIndex(v.X, v.Key, vl)
+		}
+		if !v.CanSet() {
+			return cannotAssignToErr(st.Lhs[i])
+		}
+		vl = matchDestType(vl, v.Type())
+		if !vl.Type().AssignableTo(v.Type()) {
+			if len(st.Rhs) == len(st.Lhs) {
+				return cannotUseAsTypeInErr(st.Rhs[i], vl.Type(), v.Type(), "assignment")
+			}
+			return cannotUseAsInAssignmentErr(vl, v.Type())
+		}
+		v.Set(vl)
+		return nil
+	}
+
+	if single != nil {
+		return func(fr *frame) error {
+			vl, err := single(fr)
+			if err != nil {
+				return err
+			}
+			return assign(fr, 0, vl)
+		}
+	}
+	return func(fr *frame) error {
+		vls, err := values(fr)
+		if err != nil {
+			return err
+		}
+		for i, vl := range vls {
+			if err := assign(fr, i, vl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
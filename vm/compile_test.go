@@ -0,0 +1,260 @@
+package gsvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+// runBoth runs src with the loops compiled and walked, and returns the value
+// of the variable res of both.
+func runBoth(t *testing.T, src string) (compiled, walked interface{}) {
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachine()
+		mch.walkOnly = walkOnly
+		if !assert.NoError(t, mch.Run(src)) {
+			return nil, nil
+		}
+		res := mch.GlobalNameSpace.FindLocal("res")
+		if !assert.NotEquals(t, "res", res, NoValue) {
+			return nil, nil
+		}
+		if walkOnly {
+			walked = res.Interface()
+		} else {
+			compiled = res.Interface()
+		}
+	}
+	return compiled, walked
+}
+
+func TestCompiledLoops(t *testing.T) {
+	cases := []struct {
+		src string
+		res interface{}
+	}{
+		{`res := 0
+for i := 0; i < 10; i++ { res += i * 2 }`, 90},
+		{`res := 0.0
+for i := 0; i < 4; i++ { res = res + float64(i) / 2 }`, 3.0},
+		{`res := ""
+for i := 0; i < 3; i++ { res += fmt.Sprint(i) + "," }`, "0,1,2,"},
+		{`res := 0
+for i := 0; i < 5; i++ {
+	for j := i; j < 5; j++ {
+		if j == 3 { break }
+		res++
+	}
+	if i%2 == 0 { continue }
+	res += 100
+}`, 207},
+		{`res := []int{}
+for i := 0; i < 4; i++ { res = append(res, i*i) }`, []int{0, 1, 4, 9}},
+		{`m := map[string]int{}
+for i := 0; i < 3; i++ { m[fmt.Sprint(i)] = m[fmt.Sprint(i)] + i }
+res := m["2"]`, 2},
+		{`s := []int{3, 1, 2}
+for i := 0; i < len(s); i++ { s[i] *= 10 }
+res := s[0] + s[1] + s[2]`, 60},
+		{`var fs []func() int
+for i := 0; i < 3; i++ { fs = append(fs, func() int { return i }) }
+res := fs[0]() + fs[1]() * 10 + fs[2]() * 100`, 210},
+		{`var r <-chan int
+ch := make(chan int, 1)
+for i := 0; i < 3; i++ { r = ch }
+res := fmt.Sprint(r) == fmt.Sprint(ch)`, true},
+		{`var rs = map[int]<-chan int{}
+ch := make(chan int, 1)
+for i := 0; i < 3; i++ { rs[i] = ch }
+res := len(rs)`, 3},
+		{`res := 0
+ch := make(chan int, 1)
+for i := 0; i < 3; i++ {
+	var r <-chan int
+	r, n := ch, i
+	res += n + len(r)
+}`, 3},
+		{`var fs []func() string
+for i, s := 0, "a"; i < 3; i, s = i+1, s+"b" { fs = append(fs, func() string { return fmt.Sprint(i, s) }) }
+res := fs[0]() + fs[1]() + fs[2]()`, "0a1ab2abb"},
+		{`res := 0
+for i := 0; i < 3; i++ { x := i; p := &x; res += *p }`, 3},
+		{`var u uint8 = 250
+for i := 0; i < 10; i++ { u++ }
+res := u`, uint8(4)},
+		{`res := 0
+for i := 0; i < 10; i++ { if v, ok := map[int]bool{3: true}[i]; ok && v { res = i } }`, 3},
+		{`res := 0
+for i := 0; ; i++ { if i > 4 { break }; res = len(fmt.Sprint(1234)) + i }`, 8},
+		// variables stored unboxed
+		{`res := 0.0
+for i := 0; i < 4; i++ { f := float64(i) * 1.5; f -= 0.5; res += f }`, 7.0},
+		{`res := ""
+for i := 0; i < 3; i++ { s := "a"; if i%2 == 1 { s += "b" }; res = res + s }`, "aaba"},
+		{`res := 0
+for i := 0; i < 6; i++ { even := i%2 == 0; if even && i > 0 || i == 5 { res += i } }`, 11},
+		{`res := 0
+for i := 0; i < 5; i++ { n := i; switch { case n > 2: n = n * 10 }; res += n }`, 73},
+		{`type myInt int
+var res myInt
+for i := 0; i < 4; i++ { res += myInt(i) }`, nil},
+		{`res := 1
+for i := 10; i > 0; i /= 2 { x := -i; res = res*2 + x }`, -89},
+		{`res := 0
+for i := 0; i < 3; i++ { i := i * 2; res += i }`, 6},
+		// range statements
+		{`res := 0
+for i, v := range []int{5, 6, 7} { res += i * v }`, 20},
+		{`res := 0
+for k, v := range map[string]int{"a": 1, "bb": 2, "ccc": 3} { res += len(k) * v }`, 14},
+		{`res := 0
+for i := range 5 { if i == 1 { continue }; if i == 4 { break }; res += i }`, 5},
+		{`var n int8 = 3
+res := 0
+for i := range n { res += int(i) }`, 3},
+		{`res := ""
+for _, r := range "héllo" { res += string(r) + "," }`, "h,é,l,l,o,"},
+		{`res := 0
+for range 4 { res++ }`, 4},
+		{`res := 0
+for i := 0; i < 3; i++ { for _, v := range []int{1, 2} { res += i * v } }`, 9},
+		{`var fs []func() int
+for i, v := range []int{3, 4} { fs = append(fs, func() int { return i*10 + v }) }
+res := fs[0]() + fs[1]()`, 17},
+		{`res, k := 0, 0
+for k = range 3 { res += k }
+res += k`, 5},
+		{`res := ""
+for i, p := range sample.Pairs("a", "b", "c") { if i == 2 { break }; res += fmt.Sprint(i) + p }`, "0a1b"},
+	}
+	for _, c := range cases {
+		compiled, walked := runBoth(t, c.src)
+		if c.res == nil {
+			// compared with the walker only
+			assert.Equals(t, c.src, compiled, walked)
+			continue
+		}
+		assert.Equals(t, c.src, compiled, c.res)
+		assert.Equals(t, c.src, walked, c.res)
+	}
+}
+
+func TestCompiledLoopsErrors(t *testing.T) {
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachine()
+		mch.walkOnly = walkOnly
+
+		err := mch.Run(`s := []int{1, 2}
+for i := 0; i < 3; i++ {
+	s[i] = i
+}`)
+		var pe *PanicError
+		if assert.True(t, "PanicError", errors.As(err, &pe)) {
+			assert.Equals(t, "pos", pe.Pos.String(), "input:3:2")
+		}
+
+		err = mch.Run(`n := 0
+for i := 0; i < 3; i++ {
+	n += i
+	if i == 1 {
+		n.Foo()
+	}
+}`)
+		assert.Error(t, err)
+	}
+}
+
+// A loop with a node the walker does not support fails as walked, after the
+// same iterations.
+func TestCompiledLoopsUnsupported(t *testing.T) {
+	var errs [2]string
+	var res [2]interface{}
+	for i, walkOnly := range []bool{false, true} {
+		mch := newMachine()
+		mch.walkOnly = walkOnly
+		err := mch.Run(`res := 0
+for i := 0; i < 5; i++ {
+	res += i
+	if i > 1 { res += (i) }
+}`)
+		if assert.Error(t, err) {
+			errs[i] = err.Error()
+		}
+		res[i] = mch.GlobalNameSpace.FindLocal("res").Interface()
+	}
+	assert.Equals(t, "errors", errs[0], errs[1])
+	assert.Equals(t, "res", res[0], 3)
+	assert.Equals(t, "res", res[1], 3)
+}
+
+// The loops of the statements of an input are dropped at its end, and the
+// ones of functions declared kept.
+func TestCompiledLoopsForgotten(t *testing.T) {
+	mch := newMachine()
+	assert.NoError(t, mch.Run(`res := 0
+for i := 0; i < 3; i++ { for range i { res++ } }
+for _, v := range []int{1, 2} { res += v }`))
+	assert.Equals(t, "res", mch.GlobalNameSpace.FindLocal("res").Interface(), 6)
+	assert.Equals(t, "len(loops)", len(mch.loops), 0)
+
+	assert.NoError(t, mch.Run(`func sum(n int) int {
+	s := 0
+	for i := range n { s += i }
+	return s
+}
+a := sum(4)`))
+	assert.Equals(t, "a", mch.GlobalNameSpace.FindLocal("a").Interface(), 6)
+	assert.Equals(t, "len(loops)", len(mch.loops), 1)
+	for _, code := range mch.loops {
+		assert.NotEquals(t, "code", code, (*loopCode)(nil))
+	}
+
+	mch.Reset()
+	assert.Equals(t, "len(loops)", len(mch.loops), 0)
+}
+
+// A loop compiled runs again when a name it refers to is bound to a value
+// of another type.
+func TestCompiledLoopRebound(t *testing.T) {
+	mch := newMachine()
+	assert.NoError(t, mch.Run(`func sum(n int) int {
+	s := 0
+	for i := 0; i < n; i++ { s += i }
+	return s
+}`))
+	assert.NoError(t, mch.Run(`a := sum(4)`))
+	assert.NoError(t, mch.Run(`b := sum(5)`))
+	assert.Equals(t, "a", mch.GlobalNameSpace.FindLocal("a").Interface(), 6)
+	assert.Equals(t, "b", mch.GlobalNameSpace.FindLocal("b").Interface(), 10)
+}
+
+const benchLoop = `sum = 0
+for i := 0; i < 100000; i++ {
+	if i%3 == 0 {
+		continue
+	}
+	sum += i * 2
+}`
+
+func benchmarkLoop(b *testing.B, walkOnly bool) {
+	mch := newMachine()
+	mch.walkOnly = walkOnly
+	if err := mch.Run(`sum := 0`); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mch.Run(benchLoop); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoopCompiled(b *testing.B) {
+	benchmarkLoop(b, false)
+}
+
+func BenchmarkLoopWalked(b *testing.B) {
+	benchmarkLoop(b, true)
+}
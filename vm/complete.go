@@ -0,0 +1,175 @@
+package gsvm
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// selectorBase returns the start of the operand of the selector ending at
+// end, e.g. "m[k].f" in "x := m[k].f.". Brackets are skipped as a whole.
+func selectorBase(src []rune, end int) int {
+	start := end
+	for start > 0 {
+		switch r := src[start-1]; {
+		case isIdentRune(r) || r == '.':
+			start--
+		case r == ']' || r == ')':
+			open := map[rune]rune{']': '[', ')': '('}[r]
+			depth := 0
+			i := start - 1
+			for ; i >= 0; i-- {
+				if src[i] == r {
+					depth++
+				} else if src[i] == open {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if i < 0 {
+				return start
+			}
+			start = i
+		default:
+			return start
+		}
+	}
+	return start
+}
+
+// isSideEffectFree returns true if evaluating expr calls no functions nor
+// receives from channels, so that it can be evaluated for completion.
+func isSideEffectFree(expr ast.Expr) bool {
+	free := true
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr, *ast.FuncLit:
+			free = false
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW {
+				free = false
+			}
+		}
+		return free
+	})
+	return free
+}
+
+// memberNames returns the names of the fields and methods selectable on vl.
+func (mch *machine) memberNames(vl reflect.Value) []string {
+	switch vl.Type() {
+	case PackageType:
+		var names []string
+		for name, mVl := range vl.Interface().(Package) {
+			if mVl.Type() != deniedSymbolType {
+				names = append(names, name)
+			}
+		}
+		return names
+	case TypeValueType:
+		// method expressions
+		var names []string
+		tp := vl.Interface().(TypeValue).Type
+		for i := 0; i < tp.NumMethod(); i++ {
+			names = append(names, tp.Method(i).Name)
+		}
+		return names
+	case MapIndexValueType, ConstValueType:
+		vl = echoValue(vl)
+	}
+
+	if vl.Kind() == reflect.Interface {
+		if vl.IsNil() {
+			return nil
+		}
+		vl = vl.Elem()
+	}
+
+	var names []string
+	tp := vl.Type()
+	mTp := tp
+	if tp.Kind() != reflect.Ptr && tp.Kind() != reflect.Interface {
+		mTp = reflect.PtrTo(tp)
+	}
+	for i := 0; i < mTp.NumMethod(); i++ {
+		names = append(names, mTp.Method(i).Name)
+	}
+
+	if tp.Kind() == reflect.Ptr {
+		tp = tp.Elem()
+	}
+	if tp.Kind() == reflect.Struct {
+		for _, fld := range reflect.VisibleFields(tp) {
+			if fld.PkgPath != "" && !isLocalFieldPath(tp, fld.Index) && mch.Options.Unexported != ReadUnexported {
+				continue
+			}
+			names = append(names, fld.Name)
+		}
+	}
+	return names
+}
+
+// Go keywords completed for bare identifiers.
+var keywords = []string{
+	"break", "case", "chan", "const", "continue", "default", "defer", "else",
+	"fallthrough", "for", "func", "go", "goto", "if", "import", "interface",
+	"map", "package", "range", "return", "select", "struct", "switch", "type",
+	"var",
+}
+
+func (mch *machine) Complete(src string) (partial string, candidates []string) {
+	rs := []rune(src)
+	start := len(rs)
+	for start > 0 && isIdentRune(rs[start-1]) {
+		start--
+	}
+	partial = string(rs[start:])
+
+	var names []string
+	if start > 0 && rs[start-1] == '.' {
+		base := selectorBase(rs, start-1)
+		expr, err := parser.ParseExprFrom(mch.fset, inputName, string(rs[base:start-1]), 0)
+		if err != nil || !isSideEffectFree(expr) {
+			return partial, nil
+		}
+		vl, err := checkSingleValue(mch.evalExpr(mch.GlobalNameSpace, expr))
+		if err != nil || !vl.IsValid() || vl == NoValue {
+			return partial, nil
+		}
+		names = mch.memberNames(vl)
+	} else {
+		if partial != "" && unicode.IsDigit(rs[start]) {
+			// a number
+			return partial, nil
+		}
+		names = append(names, keywords...)
+		for name := range gBuiltinFuncs {
+			names = append(names, name)
+		}
+		for name := range basicTypes {
+			names = append(names, name)
+		}
+		names = append(names, "true", "false", "nil")
+		names = append(names, mch.GlobalNameSpace.Names()...)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if strings.HasPrefix(name, partial) && !seen[name] && name != resultsVarName {
+			seen[name] = true
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return partial, candidates
+}
@@ -0,0 +1,57 @@
+package gsvm
+
+import (
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestCompletePackage(t *testing.T) {
+	mch := newMachine()
+
+	partial, candidates := mch.Complete(`x := math.S`)
+	assert.Equals(t, "partial", partial, "S")
+	assert.StringEquals(t, "candidates", candidates, []string{"Sin", "Sincos"})
+
+	_, candidates = mch.Complete(`fmt.`)
+	assert.StringEquals(t, "candidates", candidates, []string{"Errorf", "Printf", "Println", "Sprint", "Stringer"})
+}
+
+func TestCompleteMembers(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`type point struct {
+	X, y int
+}`))
+	assert.NoError(t, mch.Run(`p := point{1, 2}
+ps := []point{p}
+o := sample.NewOuter()`))
+
+	_, candidates := mch.Complete(`p.`)
+	assert.StringEquals(t, "candidates", candidates, []string{"X", "y"})
+	_, candidates = mch.Complete(`fmt.Println(ps[len(ps)-1].`)
+	assert.StringEquals(t, "candidates", candidates, []string{})
+	_, candidates = mch.Complete(`fmt.Println(ps[0].`)
+	assert.StringEquals(t, "candidates", candidates, []string{"X", "y"})
+
+	// unexported fields of compiled types are denied by default
+	_, candidates = mch.Complete(`o.`)
+	assert.StringEquals(t, "candidates", candidates, []string{"Count", "ID", "Inc", "Name", "String", "Stringer"})
+	_, candidates = mch.Complete(`o.sampleInner.`)
+	assert.StringEquals(t, "candidates", candidates, []string{})
+}
+
+func TestCompleteIdent(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`length := 1`))
+	partial, candidates := mch.Complete(`for i := 0; i < le`)
+	assert.Equals(t, "partial", partial, "le")
+	assert.StringEquals(t, "candidates", candidates, []string{"len", "length"})
+
+	_, candidates = mch.Complete(`ra`)
+	assert.StringEquals(t, "candidates", candidates, []string{"range"})
+
+	_, candidates = mch.Complete(`x := 12`)
+	assert.StringEquals(t, "candidates", candidates, []string{})
+}
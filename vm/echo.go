@@ -0,0 +1,72 @@
+package gsvm
+
+import (
+	"go/ast"
+	"reflect"
+	"strconv"
+)
+
+// Names of untyped literal types as shown to users.
+var untypedNames = map[reflect.Type]string{
+	intLiteralType:     "untyped int",
+	floatLiteralType:   "untyped float",
+	complexLiteralType: "untyped complex",
+	runeLiteralType:    "untyped rune",
+	stringLiteralType:  "untyped string",
+	bigIntLiteralType:  "untyped int",
+}
+
+// TypeString returns the Go name of tp. Types of untyped literals are shown as
+// "untyped int", "untyped string", etc.
+func TypeString(tp reflect.Type) string {
+	if name, ok := untypedNames[tp]; ok {
+		return name
+	}
+	return tp.String()
+}
+
+// echoValue returns the value an expression statement evaluated to, with map
+// index and constant wrappers removed.
+func echoValue(vl reflect.Value) reflect.Value {
+	switch vl.Type() {
+	case MapIndexValueType:
+		mi := vl.Interface().(MapIndexValue)
+		if val := mi.X.MapIndex(mi.Key); val.IsValid() {
+			return val
+		}
+		return reflect.Zero(mi.X.Type().Elem())
+	case ConstValueType:
+		return vl.Field(0).Interface().(reflect.Value)
+	}
+	return vl
+}
+
+// historyName returns the name of the n-th history variable, 1 based.
+func historyName(n int) string {
+	return "_" + strconv.Itoa(n)
+}
+
+// echo binds the values of a bare expression statement at the top level to
+// history variables and reports them to Options.Echo.
+func (mch *machine) echo(st *ast.ExprStmt) error {
+	vls, err := mch.evalExpr(mch.GlobalNameSpace, st.X)
+	if err != nil {
+		return err
+	}
+	for _, vl := range vls {
+		if !vl.IsValid() || vl == NoValue {
+			continue
+		}
+		vl = echoValue(vl)
+
+		mch.nHistory++
+		name := historyName(mch.nHistory)
+		v := removeBasicLit(vl)
+		hv := reflect.New(v.Type()).Elem()
+		hv.Set(v)
+		mch.GlobalNameSpace.AddLocal(name, hv)
+
+		mch.Options.Echo(name, vl)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package gsvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestEcho(t *testing.T) {
+	var names, echoed []string
+	mch := newMachineWithOptions(Options{
+		Echo: func(name string, vl reflect.Value) {
+			names = append(names, name)
+			echoed = append(echoed, FormatValue(vl))
+		},
+	})
+
+	assert.NoError(t, mch.Run(`x := 45
+x
+fmt.Println()
+math.Sincos(0)`))
+	assert.StringEquals(t, "names", names, []string{"_1", "_2", "_3", "_4", "_5"})
+	assert.StringEquals(t, "echoed", echoed[0], "int(45)")
+
+	assert.NoError(t, mch.Run(`m := map[string]int{"a": 1}
+m["a"]
+3`))
+	assert.StringEquals(t, "echoed", echoed[5:], []string{"int(1)", "untyped int(3)"})
+
+	assert.NoError(t, mch.Run(`y := _1 + _7`))
+	assert.Equals(t, "y", mch.GlobalNameSpace.FindLocal("y").Interface(), 48)
+
+	// statements inside blocks are not echoed
+	assert.NoError(t, mch.Run(`if true {
+	x
+}`))
+	assert.Equals(t, "len(names)", len(names), 7)
+}
@@ -0,0 +1,285 @@
+package gsvm
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+)
+
+// definedValue returns the value value is bound to by Define.
+func definedValue(name string, value interface{}) (reflect.Value, error) {
+	switch value := value.(type) {
+	case nil:
+		return NoValue, useOfUntypedNilErr(name)
+	case reflect.Value:
+		if !value.IsValid() {
+			return NoValue, useOfUntypedNilErr(name)
+		}
+		return value, nil
+	case reflect.Type:
+		return reflect.ValueOf(TypeValue{value}), nil
+	case Package:
+		return reflect.ValueOf(value), nil
+	}
+	vl := reflect.ValueOf(value)
+	if vl.Kind() == reflect.Func {
+		return vl, nil
+	}
+	v := reflect.New(vl.Type()).Elem()
+	v.Set(vl)
+	return v, nil
+}
+
+func (mch *machine) Define(name string, value interface{}) error {
+	if !token.IsIdentifier(name) || name == "_" {
+		return invalidIdentifierErr(name)
+	}
+	vl, err := definedValue(name, value)
+	if err != nil {
+		return err
+	}
+	mch.GlobalNameSpace.AddLocal(name, vl)
+	return nil
+}
+
+// resultValues returns vls, the values of expr, with map index and constant
+// wrappers removed. Untyped literals are kept.
+func resultValues(expr ast.Expr, vls []reflect.Value) ([]reflect.Value, error) {
+	for i, vl := range vls {
+		switch vl = echoValue(vl); vl.Type() {
+		case TypeValueType, PackageType:
+			return nil, isNotAnExpressionErr(expr, vl.Type())
+		}
+		vls[i] = vl
+	}
+	return vls, nil
+}
+
+// evalValues parses, checks and evaluates expression src at the top level.
+func (mch *machine) evalValues(src string) (expr ast.Expr, vls []reflect.Value, err error) {
+	expr, err = parser.ParseExprFrom(mch.fset, inputName, src, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := mch.check([]ast.Stmt{&ast.ExprStmt{X: expr}}, nil); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = mch.atPos(expr, recoveredErr(r))
+		}
+	}()
+	vls, err = mch.evalExpr(mch.GlobalNameSpace, expr)
+	if err == nil {
+		vls, err = resultValues(expr, vls)
+	}
+	return expr, vls, mch.atPos(expr, err)
+}
+
+// evalValue evaluates expression src of a single value at the top level.
+func (mch *machine) evalValue(src string) (ast.Expr, reflect.Value, error) {
+	expr, vls, err := mch.evalValues(src)
+	if err != nil {
+		return nil, NoValue, err
+	}
+	vl, err := checkSingleValue(vls, nil)
+	return expr, vl, mch.atPos(expr, err)
+}
+
+// typedValue returns vl, the value of expr, with an untyped constant
+// converted to tp, or its default type if tp is nil or an interface. An
+// integer constant overflowing the type is an error.
+func (mch *machine) typedValue(expr ast.Expr, vl reflect.Value, tp reflect.Type) (reflect.Value, error) {
+	if tp != nil && tp.Kind() != reflect.Interface {
+		vl = matchDestType(vl, tp)
+	}
+	if vl.Type() == bigIntLiteralType {
+		if tp == nil || tp.Kind() == reflect.Interface {
+			tp = intType
+		}
+		return NoValue, mch.atPos(expr, constantOverflowsErr(expr, vl.Interface().(bigIntLiteral), tp))
+	}
+	return removeBasicLit(vl), nil
+}
+
+func (mch *machine) EvalExpr(src string) ([]reflect.Value, error) {
+	defer mch.start(context.Background())()
+	expr, vls, err := mch.evalValues(src)
+	if err != nil {
+		return nil, err
+	}
+	for i, vl := range vls {
+		if vls[i], err = mch.typedValue(expr, vl, nil); err != nil {
+			return nil, err
+		}
+	}
+	return vls, nil
+}
+
+func (mch *machine) Eval(src string) (reflect.Value, error) {
+	defer mch.start(context.Background())()
+	expr, vl, err := mch.evalValue(src)
+	if err != nil {
+		return NoValue, err
+	}
+	return mch.typedValue(expr, vl, nil)
+}
+
+// EvalAs evaluates expression src of a single value in m, as Machine.Eval, and
+// returns it as a T. The value must be assignable to T, with untyped constants
+// converted to T, e.g. EvalAs[float64](m, "1") returns 1.0 and
+// EvalAs[fmt.Stringer](m, "time.Second") returns the time.Duration.
+func EvalAs[T any](m Machine, src string) (T, error) {
+	var t T
+	dst := reflect.ValueOf(&t).Elem()
+
+	var vl reflect.Value
+	var err error
+	if mch, ok := m.(*machine); ok {
+		defer mch.start(context.Background())()
+		var expr ast.Expr
+		if expr, vl, err = mch.evalValue(src); err == nil {
+			vl, err = mch.typedValue(expr, vl, dst.Type())
+			if err == nil && !vl.Type().AssignableTo(dst.Type()) {
+				err = mch.atPos(expr, cannotUseAsTypeInErr(expr, vl.Type(), dst.Type(), "assignment"))
+			}
+		}
+	} else if vl, err = m.Eval(src); err == nil && !vl.Type().AssignableTo(dst.Type()) {
+		err = cannotUseAsInAssignmentErr(vl, dst.Type())
+	}
+	if err != nil {
+		return t, err
+	}
+	dst.Set(vl)
+	return t, nil
+}
+
+func (mch *machine) Get(name string) (reflect.Value, bool) {
+	vl := mch.GlobalNameSpace.Find(name)
+	if vl == NoValue || checkAccess(vl) != nil {
+		return NoValue, false
+	}
+	return echoValue(vl), true
+}
+
+// callArgs returns args as the arguments of a call of fn.
+func callArgs(fn reflect.Value, args []interface{}) []reflect.Value {
+	fnType := fn.Type()
+	vls := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case reflect.Value:
+			vls[i] = arg
+		case nil:
+			switch {
+			case fnType.IsVariadic() && i >= fnType.NumIn()-1:
+				vls[i] = reflect.Zero(fnType.In(fnType.NumIn() - 1).Elem())
+			case i < fnType.NumIn():
+				vls[i] = reflect.Zero(fnType.In(i))
+			default:
+				vls[i] = reflect.ValueOf(&arg).Elem()
+			}
+		default:
+			vls[i] = reflect.ValueOf(arg)
+		}
+	}
+	return vls
+}
+
+func (mch *machine) Call(funcName string, args ...interface{}) ([]reflect.Value, error) {
+	defer mch.start(context.Background())()
+	expr, fn, err := mch.evalValue(funcName)
+	if err != nil {
+		return nil, err
+	}
+	if fn.Kind() != reflect.Func {
+		return nil, mch.atPos(expr, cannotCallNonFunctionErr(expr, fn.Type()))
+	}
+	vls, err := callFunc(fn, callArgs(fn, args))
+	return vls, mch.atPos(expr, err)
+}
+
+// PackageBuilder builds a Package of the functions, variables, constants and
+// types of the host, e.g.
+//
+//	pkg := NewPackageBuilder().
+//		Func("Load", config.Load).
+//		Var("Verbose", &config.Verbose).
+//		Const("Version", config.Version).
+//		Type("Config", (*config.Config)(nil)).
+//		Build()
+type PackageBuilder struct {
+	pkg Package
+}
+
+func NewPackageBuilder() *PackageBuilder {
+	return &PackageBuilder{pkg: make(Package)}
+}
+
+func (b *PackageBuilder) add(name string, vl reflect.Value) *PackageBuilder {
+	if !token.IsIdentifier(name) {
+		panic(fmt.Sprintf("gsvm: invalid identifier %q", name))
+	}
+	if _, ok := b.pkg[name]; ok {
+		panic(fmt.Sprintf("gsvm: %s redeclared in the package", name))
+	}
+	b.pkg[name] = vl
+	return b
+}
+
+// Func adds function fn.
+func (b *PackageBuilder) Func(name string, fn interface{}) *PackageBuilder {
+	vl := reflect.ValueOf(fn)
+	if vl.Kind() != reflect.Func {
+		panic(fmt.Sprintf("gsvm: %s is not a function: %T", name, fn))
+	}
+	return b.add(name, vl)
+}
+
+// Var adds the variable ptr points to, which is shared by the host and the
+// machine.
+func (b *PackageBuilder) Var(name string, ptr interface{}) *PackageBuilder {
+	vl := reflect.ValueOf(ptr)
+	if vl.Kind() != reflect.Ptr || vl.IsNil() {
+		panic(fmt.Sprintf("gsvm: %s is not a pointer to a variable: %T", name, ptr))
+	}
+	return b.add(name, vl.Elem())
+}
+
+// Const adds a typed constant of value v.
+func (b *PackageBuilder) Const(name string, v interface{}) *PackageBuilder {
+	if v == nil {
+		panic(fmt.Sprintf("gsvm: %s is nil", name))
+	}
+	return b.add(name, reflect.ValueOf(v))
+}
+
+// UntypedConst adds an untyped constant of kind "bool", "int", "float",
+// "complex", "rune" or "string", and literal lit, as UntypedConstant.
+func (b *PackageBuilder) UntypedConst(name, kind, lit string) *PackageBuilder {
+	return b.add(name, UntypedConstant(kind, lit))
+}
+
+// Type adds a type, either a reflect.Type or a nil pointer to the type, e.g.
+// (*io.Reader)(nil).
+func (b *PackageBuilder) Type(name string, tp interface{}) *PackageBuilder {
+	if tp, ok := tp.(reflect.Type); ok {
+		return b.add(name, reflect.ValueOf(TypeValue{tp}))
+	}
+	if reflect.TypeOf(tp) == nil || reflect.TypeOf(tp).Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("gsvm: %s is not a pointer to the type: %T", name, tp))
+	}
+	return b.add(name, PtrToTypeValue(tp))
+}
+
+// Build returns the package built.
+func (b *PackageBuilder) Build() Package {
+	pkg := make(Package, len(b.pkg))
+	for name, vl := range b.pkg {
+		pkg[name] = vl
+	}
+	return pkg
+}
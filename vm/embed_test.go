@@ -0,0 +1,276 @@
+package gsvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+type embedConfig struct {
+	Name  string
+	Ports []int
+}
+
+func TestDefineEvalGet(t *testing.T) {
+	mch := newMachine()
+
+	cfg := embedConfig{Name: "web"}
+	assert.NoError(t, mch.Define("cfg", cfg))
+	assert.NoError(t, mch.Define("limit", 3))
+	assert.NoError(t, mch.Define("join", strings.Join))
+	assert.NoError(t, mch.Define("Config", reflect.TypeOf(embedConfig{})))
+	assert.NoError(t, mch.Define("half", func(x float64) float64 { return x / 2 }))
+
+	assert.NotEquals(t, "nil", mch.Define("x", nil), nil)
+	assert.NotEquals(t, "invalid", mch.Define("a b", 1), nil)
+	assert.NotEquals(t, "keyword", mch.Define("func", 1), nil)
+
+	assert.NoError(t, mch.Run(`cfg.Ports = append(cfg.Ports, 80, 443)
+limit++
+c := Config{Name: "api"}`))
+	// the value defined is copied
+	assert.Equals(t, "cfg.Ports", len(cfg.Ports), 0)
+
+	cases := []struct {
+		src string
+		vl  interface{}
+	}{
+		{`1 + 2`, 3},
+		{`1.5`, 1.5},
+		{`"a" + "b"`, "ab"},
+		{`'a'`, 'a'},
+		{`limit * 2`, 8},
+		{`len(cfg.Ports)`, 2},
+		{`join([]string{cfg.Name, c.Name}, ",")`, "web,api"},
+		{`half(3)`, 1.5},
+		{`map[string]int{"a": 1}["a"]`, 1},
+		{`map[string]int{"a": 1}["b"]`, 0},
+		{`math.Pi > 3`, true},
+	}
+	for _, c := range cases {
+		vl, err := mch.Eval(c.src)
+		if assert.NoError(t, err) {
+			assert.Equals(t, c.src, vl.Interface(), c.vl)
+		}
+	}
+
+	for _, src := range []string{`math.Sincos(1)`, `Config`, `fmt`, `undefinedName`, `1 +`, `[]int{}[1]`} {
+		_, err := mch.Eval(src)
+		assert.NotEquals(t, src, err, nil)
+	}
+	_, err := mch.Eval(`[]int{}[1]`)
+	var pe *PanicError
+	assert.Equals(t, "PanicError", errors.As(err, &pe), true)
+
+	vl, ok := mch.Get("cfg")
+	assert.Equals(t, "ok", ok, true)
+	assert.StringEquals(t, "cfg", vl.Interface(), embedConfig{Name: "web", Ports: []int{80, 443}})
+	// a variable got is shared with the machine
+	vl.FieldByName("Name").SetString("db")
+	vl, _ = mch.Eval(`cfg.Name`)
+	assert.Equals(t, "cfg.Name", vl.Interface(), "db")
+
+	_, ok = mch.Get("undefined")
+	assert.Equals(t, "ok", ok, false)
+}
+
+func TestCall(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func add(a, b int) int {
+	return a + b
+}
+
+func sum(base float64, xs ...float64) float64 {
+	for _, x := range xs {
+		base += x
+	}
+	return base
+}
+
+func fail(msg string) error {
+	return fmt.Errorf("failed: %s", msg)
+}
+
+func first(xs []int) int {
+	return xs[0]
+}`))
+
+	vls, err := mch.Call("add", 1, 2)
+	if assert.NoError(t, err) {
+		assert.Equals(t, "add", vls[0].Interface(), 3)
+	}
+	vls, err = mch.Call("sum", 1.0, 2.0, reflect.ValueOf(3.5))
+	if assert.NoError(t, err) {
+		assert.Equals(t, "sum", vls[0].Interface(), 6.5)
+	}
+	vls, err = mch.Call("fail", "x")
+	if assert.NoError(t, err) {
+		assert.StringEquals(t, "fail", vls[0].Interface(), "failed: x")
+	}
+	vls, err = mch.Call("fmt.Sprint", "a", nil, 1)
+	if assert.NoError(t, err) {
+		assert.Equals(t, "fmt.Sprint", vls[0].Interface(), fmt.Sprint("a", nil, 1))
+	}
+
+	_, err = mch.Call("add", 1)
+	assert.NotEquals(t, "not enough arguments", err, nil)
+	_, err = mch.Call("add", 1, "2")
+	assert.NotEquals(t, "mismatched type", err, nil)
+	_, err = mch.Call("undefined")
+	assert.NotEquals(t, "undefined", err, nil)
+	_, err = mch.Call("first", nil)
+	var pe *PanicError
+	assert.Equals(t, "PanicError", errors.As(err, &pe), true)
+
+	assert.NoError(t, mch.Define("n", 1))
+	_, err = mch.Call("n")
+	assert.NotEquals(t, "non-function", err, nil)
+}
+
+var embedVerbose = false
+
+func TestPackageBuilder(t *testing.T) {
+	pkg := NewPackageBuilder().
+		Func("Upper", strings.ToUpper).
+		Var("Verbose", &embedVerbose).
+		Const("Version", "1.0").
+		UntypedConst("Max", "int", "100").
+		Type("Config", (*embedConfig)(nil)).
+		Type("Stringer", reflect.TypeOf((*fmt.Stringer)(nil)).Elem()).
+		Build()
+	mch := newMachine()
+	assert.NoError(t, mch.Define("host", pkg))
+
+	assert.NoError(t, mch.Run(`host.Verbose = true
+var max int8 = host.Max
+c := host.Config{Name: host.Upper("x")}`))
+	assert.Equals(t, "embedVerbose", embedVerbose, true)
+
+	vl, err := mch.Eval(`c.Name + host.Version`)
+	if assert.NoError(t, err) {
+		assert.Equals(t, "c.Name + host.Version", vl.Interface(), "X1.0")
+	}
+	vl, err = mch.Eval(`max`)
+	if assert.NoError(t, err) {
+		assert.Equals(t, "max", vl.Interface(), int8(100))
+	}
+
+	mch = NewWithOptions(&PackageNameSpace{Packages: map[string]Package{"host": pkg}}, Options{}).(*machine)
+	vl, err = mch.Eval(`host.Upper("y")`)
+	if assert.NoError(t, err) {
+		assert.Equals(t, "host.Upper", vl.Interface(), "Y")
+	}
+
+	assert.Equals(t, "not a function", catchPanic(func() { NewPackageBuilder().Func("F", 1) }) != nil, true)
+	assert.Equals(t, "not a pointer", catchPanic(func() { NewPackageBuilder().Var("V", 1) }) != nil, true)
+	assert.Equals(t, "redeclared", catchPanic(func() { NewPackageBuilder().Const("C", 1).Const("C", 2) }) != nil, true)
+}
+
+func catchPanic(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	f()
+	return nil
+}
+
+func TestEvalExpr(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`m := map[string]int{"a": 1}
+const big = 1000 + 24
+var i8 int8 = 3`))
+
+	cases := []struct {
+		src string
+		vls []interface{}
+	}{
+		{`1`, []interface{}{1}},
+		{`1.0`, []interface{}{1.0}},
+		{`'x'`, []interface{}{'x'}},
+		{`"s"`, []interface{}{"s"}},
+		{`big`, []interface{}{1024}},
+		{`i8 + 1`, []interface{}{int8(4)}},
+		{`m["a"]`, []interface{}{1}},
+		{`math.Sincos(0)`, []interface{}{0.0, 1.0}},
+		{`fmt.Sprint()`, []interface{}{""}},
+	}
+	for _, c := range cases {
+		vls, err := mch.EvalExpr(c.src)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equals(t, c.src, len(vls), len(c.vls))
+		for i, vl := range vls {
+			assert.Equals(t, c.src, vl.Interface(), c.vls[i])
+		}
+	}
+
+	for _, src := range []string{`int`, `m[`, `undefinedName`} {
+		_, err := mch.EvalExpr(src)
+		assert.NotEquals(t, src, err, nil)
+	}
+
+	// an untyped constant overflowing its default type
+	_, err := mch.EvalExpr(`math.MaxUint64`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "error", te.Error(), `input:1:1: cannot use math.MaxUint64 (untyped int constant 18446744073709551615) as int value (overflows)`)
+	}
+	_, err = mch.Eval(`math.MaxUint64`)
+	assert.True(t, "TypeError", errors.As(err, &te))
+}
+
+func TestEvalAs(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`var i8 int8 = 3
+var s fmt.Stringer
+ch := make(chan int)`))
+
+	f, err := EvalAs[float64](mch, `1`)
+	assert.NoError(t, err)
+	assert.Equals(t, "float64", f, 1.0)
+
+	b, err := EvalAs[byte](mch, `'a' + 1`)
+	assert.NoError(t, err)
+	assert.Equals(t, "byte", b, byte('b'))
+
+	i8, err := EvalAs[int8](mch, `i8 * 2`)
+	assert.NoError(t, err)
+	assert.Equals(t, "int8", i8, int8(6))
+
+	a, err := EvalAs[interface{}](mch, `"x"`)
+	assert.NoError(t, err)
+	assert.Equals(t, "any", a, "x")
+
+	st, err := EvalAs[fmt.Stringer](mch, `s`)
+	assert.NoError(t, err)
+	assert.Equals(t, "Stringer", st, nil)
+
+	rch, err := EvalAs[<-chan int](mch, `ch`)
+	assert.NoError(t, err)
+	assert.Equals(t, "<-chan int", rch != nil, true)
+
+	_, err = EvalAs[int](mch, `i8`)
+	assert.NotEquals(t, "int8 as int", err, nil)
+	_, err = EvalAs[string](mch, `1`)
+	assert.NotEquals(t, "untyped int as string", err, nil)
+	_, err = EvalAs[int](mch, `1.5`)
+	assert.NotEquals(t, "untyped float as int", err, nil)
+	u64, err := EvalAs[uint64](mch, `math.MaxUint64`)
+	assert.NoError(t, err)
+	assert.Equals(t, "uint64", u64, uint64(math.MaxUint64))
+	_, err = EvalAs[int64](mch, `math.MaxUint64`)
+	assert.NotEquals(t, "overflows int64", err, nil)
+	_, err = EvalAs[interface{}](mch, `math.MaxUint64`)
+	assert.NotEquals(t, "overflows int", err, nil)
+	_, err = EvalAs[int](mch, `math.Sincos(0)`)
+	assert.NotEquals(t, "multiple values", err, nil)
+}
@@ -1,11 +1,14 @@
 package gsvm
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/printer"
 	"go/token"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/daviddengcn/go-villa"
 )
@@ -17,128 +20,478 @@ func exprToStr(expr ast.Expr) string {
 }
 
 func redeclareVarErr(name string) error {
-	return fmt.Errorf("%s redeclare in this block", name)
+	return typeErr(Redeclared, "%s redeclare in this block", name)
 }
 
 func nonBoolAsConditionErr(cnd reflect.Value, st string) error {
-	return fmt.Errorf("non-bool %v (type %v) used as %s condition)", cnd.Interface(), cnd.Type(), st)
+	return typeErr(MismatchedTypes, "non-bool %v (type %v) used as %s condition)", cnd.Interface(), cnd.Type(), st)
 }
 
 func invalidOperationErr(op string, tp reflect.Type) error {
-	return fmt.Errorf("operator %s not defined on %s", op, tp.Name())
+	return typeErr(InvalidOperation, "operator %s not defined on %s", op, tp.Name())
 }
 
 func invalidOperationTypeDoesNotSupportIndexingErr(expr ast.Expr, kind reflect.Kind) error {
-	return fmt.Errorf("invalid operation: %v (type %v does not support indexing)", exprToStr(expr), kind)
+	return typeErr(InvalidOperation, "invalid operation: %v (type %v does not support indexing)", exprToStr(expr), kind)
 }
 
 func cannotAssignToErr(expr ast.Expr) error {
-	return villa.ErrorfN(2, "cannot assign to %v", exprToStr(expr))
+	return typeErr(InvalidOperation, "cannot assign to %v", exprToStr(expr))
 }
 
 func cannotUseAsInAssignmentErr(vl reflect.Value, dstTp reflect.Type) error {
-	return fmt.Errorf("cannot use %s (type %s) as type %s in assignment", vl, vl.Type(), dstTp)
+	return typeErr(MismatchedTypes, "cannot use %s (type %s) as type %s in assignment", vl, vl.Type(), dstTp)
 }
 
 func cannotUseAsInArgumentErr(vl reflect.Value, dstTp reflect.Type, fn string) error {
-	return fmt.Errorf("cannot use %s (type %s) as type %s in argument to %s", vl, vl.Type(), dstTp, fn)
+	return typeErr(MismatchedTypes, "cannot use %s (type %s) as type %s in argument to %s", vl, vl.Type(), dstTp, fn)
+}
+
+func cannotUseAsInReturnErr(vl reflect.Value, dstTp reflect.Type) error {
+	return typeErr(MismatchedTypes, "cannot use %s (type %s) as type %s in return argument", vl, vl.Type(), dstTp)
 }
 
 func unknownTypeErr(name string) error {
-	return fmt.Errorf("Unknown type %s", name)
+	return typeErr(UndefinedName, "Unknown type %s", name)
 }
 
 func cannotTakeTheAddressOfErr(expr ast.Expr) error {
-	return fmt.Errorf("cannot take the address of %v", expr)
+	return typeErr(InvalidOperation, "cannot take the address of %v", expr)
 }
 
 func invalidIndirectOfErr(vl reflect.Value) error {
-	return fmt.Errorf("invalid indirect of %v (type %v)", vl, vl.Type())
+	return typeErr(InvalidOperation, "invalid indirect of %v (type %v)", vl, vl.Type())
 }
 
 func mismatchTypesErr(t1, t2 reflect.Type) error {
-	return fmt.Errorf("mismatched types %v and %v", t1, t2)
+	return typeErr(MismatchedTypes, "mismatched types %v and %v", t1, t2)
 }
 
 func tooManyArgumentsToConversionErr(tp reflect.Type) error {
-	return fmt.Errorf("too many arguments to conversion to %v", tp)
+	return typeErr(WrongArgumentCount, "too many arguments to conversion to %v", tp)
 }
 
 func missingArgumentToConversionErr(tp reflect.Type) error {
-	return fmt.Errorf("missing argument to conversion to %v", tp)
+	return typeErr(WrongArgumentCount, "missing argument to conversion to %v", tp)
 }
 
 func missingArgumentToFuncErr(name string) error {
-	return fmt.Errorf("missing argument to %s", name)
+	return typeErr(WrongArgumentCount, "missing argument to %s", name)
 }
 
 func cannotConvertToErr(vl reflect.Value, dstTp reflect.Type) error {
-	return fmt.Errorf("cannot convert %v (type %v) to type %v", vl, vl.Type(), dstTp)
+	return typeErr(InvalidConversion, "cannot convert %v (type %v) to type %v", vl, TypeString(vl.Type()), dstTp)
 }
 
 func notEnoughArgumentsErr(fn string) error {
-	return fmt.Errorf("not enough arguments in call to %s", fn)
+	return typeErr(WrongArgumentCount, "not enough arguments in call to %s", fn)
 }
 
 func tooManyArgumentsErr(fn string) error {
-	return fmt.Errorf("too many arguments in call to %s", fn)
+	return typeErr(WrongArgumentCount, "too many arguments in call to %s", fn)
+}
+
+// ErrorCode classifies the errors of the machine.
+type ErrorCode int
+
+const (
+	UnknownError ErrorCode = iota
+	InvalidSyntax
+	UndefinedName
+	Redeclared
+	MismatchedTypes
+	InvalidOperation
+	InvalidConversion
+	WrongArgumentCount
+	InvalidGeneric
+	NotSupported
+	NilDereference
+	FailedTypeAssertion
+	InvalidRangeFunc
+	Panicked
+	// The run was canceled by its context.
+	Canceled
+	// The run exceeded a limit of Options, e.g. MaxSteps.
+	LimitExceeded
+	// The run allocated more memory than Options.MaxAlloc.
+	ResourceExhausted
+	// A symbol denied by the Policy of a PackageNameSpace was accessed.
+	AccessDenied
+)
+
+var errorCodeNames = [...]string{
+	UnknownError:        "UnknownError",
+	InvalidSyntax:       "InvalidSyntax",
+	UndefinedName:       "UndefinedName",
+	Redeclared:          "Redeclared",
+	MismatchedTypes:     "MismatchedTypes",
+	InvalidOperation:    "InvalidOperation",
+	InvalidConversion:   "InvalidConversion",
+	WrongArgumentCount:  "WrongArgumentCount",
+	InvalidGeneric:      "InvalidGeneric",
+	NotSupported:        "NotSupported",
+	NilDereference:      "NilDereference",
+	FailedTypeAssertion: "FailedTypeAssertion",
+	InvalidRangeFunc:    "InvalidRangeFunc",
+	Panicked:            "Panicked",
+	Canceled:            "Canceled",
+	LimitExceeded:       "LimitExceeded",
+	ResourceExhausted:   "ResourceExhausted",
+	AccessDenied:        "AccessDenied",
+}
+
+func (c ErrorCode) String() string {
+	if c >= 0 && int(c) < len(errorCodeNames) {
+		return errorCodeNames[c]
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// Location is where an error occurred in the input.
+type Location struct {
+	// The position of the innermost node failed, e.g. input:3:7, which is
+	// relative to the input of Run. Invalid if unknown.
+	Pos token.Position
+	// The source of the node, the first line only if it spans lines
+	Node string
+}
+
+// ErrorLocation returns l itself, so that the location of an Error can be
+// updated, e.g. the filename of the position.
+func (l *Location) ErrorLocation() *Location {
+	return l
+}
+
+func (l *Location) prefix() string {
+	if !l.Pos.IsValid() {
+		return ""
+	}
+	return l.Pos.String() + ": "
+}
+
+// Error is implemented by all errors of the machine: *SyntaxError,
+// *TypeError, *RuntimeError and *PanicError.
+type Error interface {
+	error
+	ErrorLocation() *Location
+	ErrorCode() ErrorCode
+}
+
+// SyntaxError is an error parsing the input.
+type SyntaxError struct {
+	Location
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return e.prefix() + e.Msg
+}
+
+func (e *SyntaxError) ErrorCode() ErrorCode {
+	return InvalidSyntax
+}
+
+// TypeError is an error found with the types and names of the input, the
+// ones a Go compiler reports, e.g. an undefined name or mismatched types.
+type TypeError struct {
+	Location
+	Code ErrorCode
+	Msg  string
+	// The underlying error, if any
+	Err error
+}
+
+func typeErr(code ErrorCode, format string, args ...interface{}) *TypeError {
+	return &TypeError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *TypeError) Error() string {
+	return e.prefix() + e.Msg
+}
+
+func (e *TypeError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// RuntimeError is an error found running the input, e.g. a nil pointer
+// dereference, or an error of the machine not classified.
+type RuntimeError struct {
+	Location
+	Code ErrorCode
+	Msg  string
+	// The underlying error, if any
+	Err error
+}
+
+func runtimeErr(code ErrorCode, format string, args ...interface{}) *RuntimeError {
+	return &RuntimeError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *RuntimeError) Error() string {
+	return e.prefix() + e.Msg
+}
+
+func (e *RuntimeError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a panic in a native function called, or in the machine,
+// recovered.
+type PanicError struct {
+	Location
+	// The value panicked with
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%spanic: %v", e.prefix(), e.Value)
 }
 
+func (e *PanicError) ErrorCode() ErrorCode {
+	return Panicked
+}
+
+// Unwrap returns the value panicked with if it is an error, e.g. a
+// runtime.Error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// UndefinedError is the underlying error of the TypeError of an undefined
+// name.
 type UndefinedError struct {
 	error
 }
 
 func undefinedErr(s string) error {
-	return UndefinedError{fmt.Errorf("undefined: %v", s)}
+	err := UndefinedError{fmt.Errorf("undefined: %v", s)}
+	return &TypeError{Code: UndefinedName, Msg: err.Error(), Err: err}
+}
+
+// withLocation returns err with the location of node set, unless it has
+// one. Errors not of the machine are returned as a RuntimeError.
+func withLocation(err error, pos token.Position, node ast.Node) error {
+	switch e := err.(type) {
+	case *SyntaxError:
+		if !e.Pos.IsValid() {
+			c := *e
+			c.Location = nodeLocation(pos, node)
+			return &c
+		}
+	case *TypeError:
+		if !e.Pos.IsValid() {
+			c := *e
+			c.Location = nodeLocation(pos, node)
+			return &c
+		}
+	case *RuntimeError:
+		if !e.Pos.IsValid() {
+			c := *e
+			c.Location = nodeLocation(pos, node)
+			return &c
+		}
+	case *PanicError:
+		if !e.Pos.IsValid() {
+			c := *e
+			c.Location = nodeLocation(pos, node)
+			return &c
+		}
+	default:
+		var me Error
+		if errors.As(err, &me) {
+			return err
+		}
+		return &RuntimeError{Location: nodeLocation(pos, node), Msg: err.Error(), Err: err}
+	}
+	return err
+}
+
+func nodeLocation(pos token.Position, node ast.Node) Location {
+	var src villa.ByteSlice
+	(&printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}).Fprint(&src, token.NewFileSet(), node)
+	s := string(src)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i] + " ..."
+	}
+	return Location{Pos: pos, Node: s}
 }
 
 func undefinedTypeHasNotFieldOrMethod(expr ast.Expr, tp reflect.Type, field string) error {
-	return fmt.Errorf("%s undefined (type %v has not field or method %v)", exprToStr(expr), tp, field)
+	return typeErr(UndefinedName, "%s undefined (type %v has not field or method %v)", exprToStr(expr), tp, field)
+}
+
+func cannotReferToUnexportedFieldErr(expr ast.Expr, field string) error {
+	return typeErr(UndefinedName, "%s undefined (cannot refer to unexported field or method %v)", exprToStr(expr), field)
+}
+
+func unknownFieldInStructLiteralErr(field string, tp reflect.Type) error {
+	return typeErr(UndefinedName, "unknown field '%s' in struct literal of type %v", field, tp)
 }
 
 func cannotMakeTypeErr(tp reflect.Type) error {
-	return fmt.Errorf("cannot make type %v", tp)
+	return typeErr(InvalidOperation, "cannot make type %v", tp)
 }
 
 func invalidArgumentForFuncErr(vl reflect.Value, fn string) error {
-	return fmt.Errorf("invalid argument %v (type %v) for %v", vl, vl.Type(), fn)
+	return typeErr(MismatchedTypes, "invalid argument %v (type %v) for %v", vl, vl.Type(), fn)
+}
+
+func cannotUseGenericTypeWithoutInstantiationErr(name string) error {
+	return typeErr(InvalidGeneric, "cannot use generic type %s without instantiation", name)
+}
+
+func cannotUseGenericFuncWithoutInstantiationErr(name string) error {
+	return typeErr(InvalidGeneric, "cannot use generic function %s without instantiation", name)
+}
+
+func wrongTypeArgumentCountErr(name string, got, want int) error {
+	if got > want {
+		return typeErr(InvalidGeneric, "got %d type arguments but %s has %d type parameters", got, name, want)
+	}
+	return typeErr(InvalidGeneric, "not enough type arguments for %s: have %d, want %d", name, got, want)
+}
+
+func noMatchingInstanceErr(fun ast.Expr, args []reflect.Value) error {
+	tps := make([]string, len(args))
+	for i, arg := range args {
+		tps[i] = arg.Type().String()
+	}
+	return typeErr(InvalidGeneric, "no instantiation of generic function %s accepts arguments of types (%s)", exprToStr(fun), strings.Join(tps, ", "))
+}
+
+func cannotInferErr(param string) error {
+	return typeErr(InvalidGeneric, "cannot infer %s", param)
+}
+
+func typeInferenceMismatchErr(param string, inferred, tp reflect.Type) error {
+	return typeErr(InvalidGeneric, "type %v of argument does not match inferred type %v for %s", tp, inferred, param)
+}
+
+func doesNotSatisfyErr(tp reflect.Type, constraint ast.Expr) error {
+	return typeErr(InvalidGeneric, "%v does not satisfy %s", tp, exprToStr(constraint))
+}
+
+func methodsNotSupportedErr(name string) error {
+	return typeErr(NotSupported, "cannot declare method %s: methods are not supported", name)
 }
 
 func notATypeErr(name string) error {
-	return fmt.Errorf("%v is not a type", name)
+	return typeErr(InvalidOperation, "%v is not a type", name)
 }
 
 func cannotUseAsTypeInErr(x ast.Expr, tpX reflect.Type, tp reflect.Type, pos string) error {
 	if tpX.Kind() == reflect.Interface {
-		return fmt.Errorf("cannot use %v (type %v) as type %v in %v: need type assertion", exprToStr(x), tpX, tp, pos)
+		return typeErr(MismatchedTypes, "cannot use %v (type %v) as type %v in %v: need type assertion", exprToStr(x), tpX, tp, pos)
 	}
-	return fmt.Errorf("cannot use %v (type %v) as type %v in %v", exprToStr(x), tpX, tp, pos)
+	return typeErr(MismatchedTypes, "cannot use %v (type %v) as type %v in %v", exprToStr(x), tpX, tp, pos)
 }
 
 func arugmentToMustBeHaveErr(nth, fn, expTp string, actTp reflect.Type) error {
-	return fmt.Errorf("%s argument to %s must be %s; have %v", nth, fn, expTp, actTp)
+	return typeErr(MismatchedTypes, "%s argument to %s must be %s; have %v", nth, fn, expTp, actTp)
 }
 
 func cannotSliceErr(expr ast.Expr, tp reflect.Type) error {
-	return fmt.Errorf("cannot slice %v (type %v)", expr, tp)
+	return typeErr(InvalidOperation, "cannot slice %v (type %v)", expr, tp)
 }
 
 func assignmentCountMismatchErr(nL int, tok token.Token, nR int) error {
-	return fmt.Errorf("assignment count mismatch: %d %v %d", nL, tok, nR)
+	return typeErr(WrongArgumentCount, "assignment count mismatch: %d %v %d", nL, tok, nR)
 }
 
 func cannotRangeOverErr(x ast.Expr, tp reflect.Type) error {
-	return fmt.Errorf("cannot range over %s (type %v)", exprToStr(x), tp)
+	return typeErr(InvalidOperation, "cannot range over %s (type %v)", exprToStr(x), tp)
+}
+
+func cannotRangeOverSendOnlyErr(x ast.Expr, tp reflect.Type) error {
+	return typeErr(InvalidOperation, "invalid operation: range %s: receive from send-only channel %v", exprToStr(x), tp)
+}
+
+func rangePermitsOnlyErr(x ast.Expr, tp reflect.Type, nVars int) error {
+	if nVars == 0 {
+		return typeErr(WrongArgumentCount, "range over %s (type %v) permits no iteration variables", exprToStr(x), tp)
+	}
+	return typeErr(WrongArgumentCount, "range over %s (type %v) permits only one iteration variable", exprToStr(x), tp)
 }
 
 func invalidTypeAssertionErr(expr ast.Expr, tp reflect.Type) error {
-	return fmt.Errorf("invalid type assertion: %s (non-interface type %v on left)", exprToStr(expr), tp)
+	return typeErr(InvalidOperation, "invalid type assertion: %s (non-interface type %v on left)", exprToStr(expr), tp)
 }
 
 func interfaceConversionIsNotErr(xTp, dstTp reflect.Type) error {
-	return fmt.Errorf("interface conversion: %v is not %v", xTp, dstTp)
+	return runtimeErr(FailedTypeAssertion, "interface conversion: %v is not %v", xTp, dstTp)
 }
 
 var (
-	noNewVarsErr = fmt.Errorf("no new on left side of :=")
+	noNewVarsErr                  = typeErr(Redeclared, "no new on left side of :=")
+	nilPointerDereferenceErr      = runtimeErr(NilDereference, "invalid memory address or nil pointer dereference")
+	notEnoughArgumentsToReturnErr = typeErr(WrongArgumentCount, "not enough arguments to return")
+	tooManyArgumentsToReturnErr   = typeErr(WrongArgumentCount, "too many arguments to return")
+	rangeFuncContinuedErr         = runtimeErr(InvalidRangeFunc, "range function continued iteration after function for loop body returned false")
 )
+
+func canceledErr(err error) error {
+	e := runtimeErr(Canceled, "execution canceled: %v", err)
+	e.Err = err
+	return e
+}
+
+func timeLimitErr(d time.Duration, err error) error {
+	e := runtimeErr(LimitExceeded, "execution time limit exceeded (%v)", d)
+	e.Err = err
+	return e
+}
+
+func stepLimitErr(n int64) error {
+	e := runtimeErr(LimitExceeded, "execution step limit exceeded (%d)", n)
+	e.Err = ErrStepLimit
+	return e
+}
+
+func memoryLimitErr(max int64) error {
+	e := runtimeErr(ResourceExhausted, "memory limit exceeded (%d bytes)", max)
+	e.Err = ErrMemoryLimit
+	return e
+}
+
+func accessDeniedErr(pkgPath, name string) error {
+	e := runtimeErr(AccessDenied, "access denied: %s.%s", pkgPath, name)
+	e.Err = ErrAccessDenied
+	return e
+}
+
+func isNotAnExpressionErr(expr ast.Expr, tp reflect.Type) error {
+	return typeErr(InvalidOperation, "%s (type %v) is not an expression", exprToStr(expr), tp)
+}
+
+func cannotDetermineTypeErr(expr ast.Expr) error {
+	return typeErr(NotSupported, "cannot determine the type of %s without evaluating it", exprToStr(expr))
+}
+
+func cannotCallNonFunctionErr(expr ast.Expr, tp reflect.Type) error {
+	return typeErr(InvalidOperation, "cannot call non-function %s (type %v)", exprToStr(expr), tp)
+}
+
+func invalidIdentifierErr(name string) error {
+	return typeErr(InvalidSyntax, "invalid identifier %q", name)
+}
+
+func useOfUntypedNilErr(name string) error {
+	return typeErr(InvalidOperation, "use of untyped nil as the value of %s", name)
+}
+
+func constantOverflowsErr(expr ast.Expr, lit bigIntLiteral, tp reflect.Type) error {
+	return typeErr(MismatchedTypes, "cannot use %s (untyped int constant %v) as %v value (overflows)", exprToStr(expr), lit, tp)
+}
+
+func invalidUseOfTildeErr(tp reflect.Type) error {
+	return typeErr(InvalidGeneric, "invalid use of ~ (underlying type of %v is not itself)", tp)
+}
@@ -0,0 +1,128 @@
+package gsvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestErrorPositions(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func f(p *struct{ N int }) int {
+	return p.N
+}`))
+
+	cases := []struct {
+		src string
+		pos string
+	}{
+		{`x := undefinedX`, "input:1:6"},
+		{`x := 1
+y := x +
+	undefinedY`, "input:3:2"},
+		{`if true {
+	fmt.Println(1, 2 +)
+}`, "input:2:20"},
+		{`for i := 0; i < 3; i++ {
+	i.Foo()
+}`, "input:2:4"},
+		{`var q *struct{ N int }; z := f(q)`, "input:2:9"},
+		{`type T struct{}; var t T; t.Missing = 1`, "input:1:29"},
+	}
+	for _, c := range cases {
+		err := mch.Run(c.src)
+		var e Error
+		if assert.True(t, c.src, errors.As(err, &e)) {
+			assert.Equals(t, c.src, e.ErrorLocation().Pos.String(), c.pos)
+		}
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	mch := newMachine()
+
+	err := mch.Run(`x := )`)
+	var se *SyntaxError
+	if assert.True(t, "SyntaxError", errors.As(err, &se)) {
+		assert.Equals(t, "code", se.ErrorCode(), InvalidSyntax)
+	}
+
+	err = mch.Run(`y := 1 + undefinedX`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "code", te.Code, UndefinedName)
+		assert.Equals(t, "node", te.Node, "undefinedX")
+		assert.Equals(t, "error", te.Error(), "input:1:10: undefined: undefinedX")
+	}
+	assert.True(t, "UndefinedError", errors.As(err, new(UndefinedError)))
+
+	err = mch.Run(`var p *struct{ A int }; a := p.A`)
+	var re *RuntimeError
+	if assert.True(t, "RuntimeError", errors.As(err, &re)) {
+		assert.Equals(t, "code", re.Code, NilDereference)
+		assert.Equals(t, "node", re.Node, "p.A")
+	}
+
+	err = mch.Run(`s := []int{1, 2}
+if true {
+	s[5] = 1
+}`)
+	var pe *PanicError
+	if assert.True(t, "PanicError", errors.As(err, &pe)) {
+		assert.Equals(t, "code", pe.ErrorCode(), Panicked)
+		assert.Equals(t, "pos", pe.Pos.String(), "input:3:2")
+		assert.Equals(t, "node", pe.Node, "s[5] = 1")
+	}
+	assert.NoError(t, mch.Run(`s[1] = 3`))
+}
+
+// Panics are recovered once for each function and input, and reported at the
+// innermost statement running.
+func TestPanicPositions(t *testing.T) {
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachine()
+		mch.walkOnly = walkOnly
+
+		assert.NoError(t, mch.Run(`func g(s []int) int {
+	n := 0
+	for i := 0; i < 1; i++ {
+		if true {
+			n = s[5]
+		}
+	}
+	return n
+}`))
+		cases := []struct {
+			src string
+			pos string
+		}{
+			{`v := g([]int{1})`, "input:5:4"},
+			{`s := []int{1}
+for i := 0; s[i] > 0; i++ {
+	s[0] = 1
+}`, "input:2:1"},
+			{`r := []int{1}
+for i, p := range sample.Pairs("a", "b") {
+	if i > 0 {
+		r[i] = len(p)
+	}
+}`, "input:4:3"},
+			{`w := []int{1}
+for i := 0; i < 2; i++ {
+	switch {
+	case i > 0:
+		w[i] = 1
+	}
+}`, "input:5:3"},
+		}
+		for _, c := range cases {
+			err := mch.Run(c.src)
+			var pe *PanicError
+			if assert.True(t, c.src, errors.As(err, &pe)) {
+				assert.Equals(t, c.src, pe.Pos.String(), c.pos)
+			}
+		}
+	}
+}
@@ -1,14 +1,14 @@
 package gsvm
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/token"
 	"reflect"
 	"strconv"
 	"unicode/utf8"
-
-	"github.com/daviddengcn/go-villa"
+	"unsafe"
 )
 
 func checkSingleValue(vls []reflect.Value, err error) (reflect.Value, error) {
@@ -16,7 +16,7 @@ func checkSingleValue(vls []reflect.Value, err error) (reflect.Value, error) {
 		return NoValue, err
 	}
 	if len(vls) != 1 {
-		return NoValue, fmt.Errorf("multiple-value(%d) in single-value context", len(vls))
+		return NoValue, typeErr(WrongArgumentCount, "multiple-value(%d) in single-value context", len(vls))
 	}
 	return vls[0], nil
 }
@@ -49,10 +49,10 @@ func calcFuncInNumRange(tp reflect.Type) (mn, mx int) {
 
 func valueEqual(a, b reflect.Value) (bool, error) {
 	if !a.Type().Comparable() {
-		return false, fmt.Errorf("%v not comparable", a)
+		return false, typeErr(InvalidOperation, "%v not comparable", a)
 	}
 	if !b.Type().Comparable() {
-		return false, fmt.Errorf("%v not comparable", b)
+		return false, typeErr(InvalidOperation, "%v not comparable", b)
 	}
 
 	return a.Interface() == b.Interface(), nil
@@ -65,7 +65,7 @@ func asInteger(vl reflect.Value) (int, error) {
 		return int(vl.Int()), nil
 	}
 
-	return 0, villa.Errorf("%v is not an int", vl)
+	return 0, typeErr(MismatchedTypes, "%v is not an int", vl)
 }
 
 type builtinFuncImpl func(mch *machine, ns NameSpace, args []ast.Expr) ([]reflect.Value, error)
@@ -112,6 +112,9 @@ func init() {
 					}
 				}
 
+				if err := mch.allocElems(tp.Elem(), cp); err != nil {
+					return nil, err
+				}
 				return singleValue(reflect.MakeSlice(tp, ln, cp))
 
 			case reflect.Map:
@@ -136,6 +139,9 @@ func init() {
 					}
 				}
 
+				if err := mch.allocElems(tp.Elem(), buf); err != nil {
+					return nil, err
+				}
 				return singleValue(reflect.MakeChan(tp, buf))
 
 			default:
@@ -188,7 +194,14 @@ func init() {
 				els[i] = matchDestType(argV, x.Type().Elem())
 			}
 
-			return singleValue(reflect.Append(x, els...))
+			res := reflect.Append(x, els...)
+			if res.Cap() != x.Cap() {
+				// a new underlying array
+				if err := mch.allocElems(x.Type().Elem(), res.Cap()); err != nil {
+					return nil, err
+				}
+			}
+			return singleValue(res)
 		},
 		"copy": func(mch *machine, ns NameSpace, args []ast.Expr) ([]reflect.Value, error) {
 			if len(args) < 2 {
@@ -259,8 +272,643 @@ func builtinFunc(fun ast.Expr) string {
 	return ""
 }
 
+// methodByName returns the method named name in the method set of x. If x is
+// addressable, methods with pointer receivers are also included.
+func methodByName(x reflect.Value, name string) reflect.Value {
+	if x.Kind() == reflect.Interface && x.IsNil() {
+		return NoValue
+	}
+	if x.Kind() != reflect.Ptr && x.CanAddr() {
+		if vl := x.Addr().MethodByName(name); vl.IsValid() {
+			return vl
+		}
+	}
+	if vl := x.MethodByName(name); vl.IsValid() {
+		return vl
+	}
+	return NoValue
+}
+
+// fieldByIndex is similar to reflect.Value.FieldByIndex but returns an error
+// instead of panicking on a nil embedded pointer.
+func fieldByIndex(x reflect.Value, index []int) (reflect.Value, error) {
+	for i, idx := range index {
+		if i > 0 && x.Kind() == reflect.Ptr {
+			if x.IsNil() {
+				return NoValue, nilPointerDereferenceErr
+			}
+			x = x.Elem()
+		}
+		x = x.Field(idx)
+	}
+	return x, nil
+}
+
+// readOnlyCopy returns a copy of an addressable value obtained through
+// unexported fields. The copy can be Interface()'ed but not set. The values it
+// refers to through pointers, slices, maps and interfaces are copied as well,
+// so that they can not be changed through the copy either. Channels, functions
+// and unsafe pointers are shared with the original.
+func readOnlyCopy(vl reflect.Value) reflect.Value {
+	cp := deepCopy(unlocked(vl), make(map[copyKey]reflect.Value))
+	// Convert returns a non-addressable value.
+	return cp.Convert(vl.Type())
+}
+
+// unlocked returns addressable value vl without the read-only flag of values
+// obtained through unexported fields.
+func unlocked(vl reflect.Value) reflect.Value {
+	return reflect.NewAt(vl.Type(), unsafe.Pointer(vl.UnsafeAddr())).Elem()
+}
+
+// copyKey identifies a pointer or a map copied by deepCopy.
+type copyKey struct {
+	ptr uintptr
+	tp  reflect.Type
+}
+
+// deepCopy returns a copy of vl, which is not read-only, with the values
+// referred to copied recursively. Pointers and maps copied are recorded in
+// seen so that shared and cyclic values are copied once.
+func deepCopy(vl reflect.Value, seen map[copyKey]reflect.Value) reflect.Value {
+	tp := vl.Type()
+	cp := reflect.New(tp).Elem()
+	switch tp.Kind() {
+	case reflect.Ptr:
+		if vl.IsNil() {
+			return cp
+		}
+		key := copyKey{vl.Pointer(), tp}
+		if p, ok := seen[key]; ok {
+			return p
+		}
+		p := reflect.New(tp.Elem())
+		seen[key] = p
+		p.Elem().Set(deepCopy(vl.Elem(), seen))
+		return p
+
+	case reflect.Map:
+		if vl.IsNil() {
+			return cp
+		}
+		key := copyKey{vl.Pointer(), tp}
+		if m, ok := seen[key]; ok {
+			return m
+		}
+		m := reflect.MakeMapWithSize(tp, vl.Len())
+		seen[key] = m
+		for it := vl.MapRange(); it.Next(); {
+			m.SetMapIndex(deepCopy(it.Key(), seen), deepCopy(it.Value(), seen))
+		}
+		return m
+
+	case reflect.Slice:
+		if vl.IsNil() {
+			return cp
+		}
+		cp = reflect.MakeSlice(tp, vl.Len(), vl.Len())
+		for i := 0; i < vl.Len(); i++ {
+			cp.Index(i).Set(deepCopy(vl.Index(i), seen))
+		}
+
+	case reflect.Array:
+		for i := 0; i < vl.Len(); i++ {
+			cp.Index(i).Set(deepCopy(vl.Index(i), seen))
+		}
+
+	case reflect.Struct:
+		if !vl.CanAddr() {
+			// Fields are read through their addresses.
+			addr := reflect.New(tp).Elem()
+			addr.Set(vl)
+			vl = addr
+		}
+		for i := 0; i < vl.NumField(); i++ {
+			unlocked(cp.Field(i)).Set(deepCopy(unlocked(vl.Field(i)), seen))
+		}
+
+	case reflect.Interface:
+		if !vl.IsNil() {
+			cp.Set(deepCopy(vl.Elem(), seen))
+		}
+
+	default:
+		cp.Set(vl)
+	}
+	return cp
+}
+
+// isLocalFieldPath returns true if all unexported fields, specified by index,
+// in a path of embedded fields of struct type tp are declared in the
+// interpreter.
+func isLocalFieldPath(tp reflect.Type, index []int) bool {
+	for _, idx := range index {
+		if tp.Kind() == reflect.Ptr {
+			tp = tp.Elem()
+		}
+		fld := tp.Field(idx)
+		if fld.PkgPath != "" && fld.PkgPath != localPkgPath {
+			return false
+		}
+		tp = fld.Type
+	}
+	return true
+}
+
+// exposeLocalField returns a settable version of an addressable field value,
+// specified by index of struct type tp, if it is unexported and declared in
+// the interpreter. Otherwise vl is returned.
+func exposeLocalField(vl reflect.Value, tp reflect.Type, index []int) reflect.Value {
+	if vl.CanSet() || !vl.CanAddr() || !isLocalFieldPath(tp, index) {
+		return vl
+	}
+	return reflect.NewAt(vl.Type(), unsafe.Pointer(vl.UnsafeAddr())).Elem()
+}
+
+// selectMember evaluates a field or method of x following the promotion rules
+// of embedded structs, pointers and interfaces. Unexported fields are treated
+// according to mch.Options.Unexported.
+func (mch *machine) selectMember(expr *ast.SelectorExpr, x reflect.Value) (reflect.Value, error) {
+	name := expr.Sel.Name
+	for {
+		// A field shadowing a promoted method is excluded from the method set
+		// by the compiler, so methods are checked first.
+		if vl := methodByName(x, name); vl.IsValid() {
+			return vl, nil
+		}
+
+		if x.Kind() == reflect.Struct {
+			if fld, ok := x.Type().FieldByName(name); ok {
+				vl, err := fieldByIndex(x, fld.Index)
+				if err != nil {
+					return NoValue, err
+				}
+				if vl.CanInterface() {
+					return vl, nil
+				}
+
+				local := isLocalFieldPath(x.Type(), fld.Index)
+				if !local && mch.Options.Unexported != ReadUnexported {
+					return NoValue, cannotReferToUnexportedFieldErr(expr, name)
+				}
+				if local && vl.CanAddr() {
+					return exposeLocalField(vl, x.Type(), fld.Index), nil
+				}
+				if !vl.CanAddr() {
+					// Make an addressable copy of x so that the field can be
+					// read through its address.
+					cp := reflect.New(x.Type()).Elem()
+					cp.Set(x)
+					if vl, err = fieldByIndex(cp, fld.Index); err != nil {
+						return NoValue, err
+					}
+				}
+				return readOnlyCopy(vl), nil
+			}
+		}
+
+		if x.Kind() != reflect.Ptr {
+			break
+		}
+		if x.IsNil() {
+			return NoValue, nilPointerDereferenceErr
+		}
+		x = x.Elem()
+	}
+
+	return NoValue, undefinedTypeHasNotFieldOrMethod(expr, x.Type(), name)
+}
+
+// The name of the variable holding the result values, a []reflect.Value, of an
+// interpreted function. The name can not be referenced in source.
+const resultsVarName = "~results"
+
+// defineFields adds the named parameters or results in fields as local
+// variables with values copied from vls.
+func defineFields(ns NameSpace, fields *ast.FieldList, vls []reflect.Value) {
+	if fields == nil {
+		return
+	}
+	i := 0
+	for _, fld := range fields.List {
+		if len(fld.Names) == 0 {
+			i++
+			continue
+		}
+		for _, name := range fld.Names {
+			if name.Name != "_" {
+				v := vls[i]
+				if !v.CanSet() {
+					v = reflect.New(v.Type()).Elem()
+					v.Set(vls[i])
+				}
+				ns.AddLocal(name.Name, v)
+			}
+			i++
+		}
+	}
+}
+
+// evalArgs evaluates the arguments of a call. A single argument may be a call
+// returning multiple values.
+func (mch *machine) evalArgs(ns NameSpace, exprs []ast.Expr) ([]reflect.Value, error) {
+	if len(exprs) == 1 {
+		// actually input args number is the number of return values
+		return mch.evalExpr(ns, exprs[0])
+	}
+
+	args := make([]reflect.Value, len(exprs))
+	for i, arg := range exprs {
+		argV, err := checkSingleValue(mch.evalExpr(ns, arg))
+		if err != nil {
+			return nil, err
+		}
+		args[i] = argV
+	}
+	return args, nil
+}
+
+// acceptsArgs returns true if args can be passed to fn.
+func acceptsArgs(fn reflect.Value, args []reflect.Value) bool {
+	fnType := fn.Type()
+	mn, mx := calcFuncInNumRange(fnType)
+	if len(args) < mn || mx >= 0 && len(args) > mx {
+		return false
+	}
+	for i, arg := range args {
+		var tp reflect.Type
+		if i < mn {
+			tp = fnType.In(i)
+		} else {
+			tp = fnType.In(fnType.NumIn() - 1).Elem()
+		}
+		if !removeBasicLit(matchDestType(arg, tp)).Type().AssignableTo(tp) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectInstance returns the first variant of a pre-instantiated generic
+// function accepting args.
+func selectInstance(fun ast.Expr, fns Instances, args []reflect.Value) (reflect.Value, error) {
+	for _, fn := range fns {
+		if acceptsArgs(fn, args) {
+			return fn, nil
+		}
+	}
+	return NoValue, noMatchingInstanceErr(fun, args)
+}
+
+// callFunc checks args against the parameters of fn and calls it.
+func callFunc(fn reflect.Value, args []reflect.Value) ([]reflect.Value, error) {
+	fnType := fn.Type()
+	mn, mx := calcFuncInNumRange(fnType)
+	if len(args) < mn {
+		return nil, notEnoughArgumentsErr(fn.String())
+	}
+
+	if mx >= 0 && len(args) > mx {
+		return nil, tooManyArgumentsErr(fn.String())
+	}
+
+	for i := 0; i < mn; i++ {
+		tp := fnType.In(i)
+		args[i] = removeBasicLit(matchDestType(args[i], tp))
+		if !args[i].Type().AssignableTo(tp) {
+			return nil, cannotUseAsInArgumentErr(args[i], tp, fn.String())
+		}
+	}
+
+	if fnType.IsVariadic() {
+		tp := fnType.In(fnType.NumIn() - 1).Elem()
+		for i := mn; i < len(args); i++ {
+			args[i] = removeBasicLit(matchDestType(args[i], tp))
+			if !args[i].Type().AssignableTo(tp) {
+				return nil, cannotUseAsInArgumentErr(args[i], tp, fn.String())
+			}
+		}
+	}
+
+	return callValue(fn, args)
+}
+
+// funcErr is the panic value of an error in an interpreted function, which is
+// returned by callValue as the error of the call.
+type funcErr struct {
+	error
+}
+
+// callValue calls fn with args, returning the error of an interpreted
+// function, even if it is called by native code in between. A panic is
+// returned as a PanicError.
+func callValue(fn reflect.Value, args []reflect.Value) (vls []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			vls, err = nil, recoveredErr(r)
+		}
+	}()
+	return fn.Call(args), nil
+}
+
+// recoveredErr returns the error of r, a value recovered.
+func recoveredErr(r interface{}) error {
+	switch r := r.(type) {
+	case funcErr:
+		return r.error
+	case Error:
+		// e.g. rangeFuncContinuedErr
+		return r
+	}
+	return &PanicError{Value: r}
+}
+
+// makeFunc returns a function of type tp which runs body in a new block of ns
+// with parameters and results defined as in ftp.
+func (mch *machine) makeFunc(ns NameSpace, tp reflect.Type, ftp *ast.FuncType, body *ast.BlockStmt) reflect.Value {
+	return reflect.MakeFunc(tp, func(args []reflect.Value) []reflect.Value {
+		if err := mch.tick(); err != nil {
+			panic(funcErr{err})
+		}
+		newNS := newFrameBlock(ns)
+		defer func() {
+			if r := recover(); r != nil {
+				panic(funcErr{mch.atPos(panicStmt(newNS.frame, body), recoveredErr(r))})
+			}
+		}()
+		defineFields(newNS, ftp.Params, args)
+
+		results := make([]reflect.Value, tp.NumOut())
+		for i := range results {
+			results[i] = reflect.New(tp.Out(i)).Elem()
+		}
+		newNS.AddLocal(resultsVarName, reflect.ValueOf(results))
+		defineFields(newNS, ftp.Results, results)
+
+		if err := mch.runStatement(newNS, body); err != nil && err != beReturn {
+			panic(funcErr{err})
+		}
+
+		return results
+	})
+}
+
+// unaryOp returns the result of the unary expression expr with the operand x.
+func unaryOp(expr *ast.UnaryExpr, x reflect.Value) ([]reflect.Value, error) {
+	switch expr.Op {
+	case token.ADD:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return valueToResult(x.Interface())
+		}
+	case token.SUB:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(-x.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(-x.Uint(), x.Type())
+		}
+	case token.NOT:
+		switch x.Kind() {
+		case reflect.Bool:
+			return typedValueToResult(!x.Bool(), x.Type())
+		}
+	case token.XOR:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(^x.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(^x.Uint(), x.Type())
+		}
+	case token.AND:
+		if x.CanAddr() {
+			return singleValue(x.Addr())
+		}
+		return nil, cannotTakeTheAddressOfErr(expr.X)
+		// TODO token.ARROW
+	}
+	return nil, invalidOperationErr(expr.Op.String(), x.Type())
+}
+
+// selectExpr returns the value of the selector expression expr with the
+// operand x, a member of a package, a field or a method.
+func (mch *machine) selectExpr(expr *ast.SelectorExpr, x reflect.Value) ([]reflect.Value, error) {
+	switch x.Type() {
+	case ConstValueType:
+		return nil, typeErr(NotSupported, "Not implemented!")
+	case TypeValueType:
+		return nil, typeErr(NotSupported, "Not implemented!")
+	case PackageType:
+		x := x.Interface().(Package)
+		if vl, ok := x[expr.Sel.Name]; ok {
+			if err := checkAccess(vl); err != nil {
+				return nil, err
+			}
+			return singleValue(vl)
+		}
+		return nil, undefinedErr(fmt.Sprintf("%v.%v", expr.X, expr.Sel.Name))
+	default:
+	}
+
+	return fromSingleValue(mch.selectMember(expr, x))
+}
+
+// indexValue returns the element of x at index, of the index expression
+// expr.
+func indexValue(expr *ast.IndexExpr, x, index reflect.Value) ([]reflect.Value, error) {
+	switch x.Kind() {
+	case reflect.Slice:
+		i, err := asInteger(index)
+		if err != nil {
+			return nil, err
+		}
+
+		return singleValue(x.Index(i))
+	case reflect.Map:
+		// TODO check type of index
+		index = matchDestType(index, x.Type().Key())
+		return valueToResult(MapIndexValue{x, index})
+	}
+
+	return nil, invalidOperationTypeDoesNotSupportIndexingErr(expr, x.Kind())
+}
+
+// convertTo returns v converted to tp, as T(v).
+func convertTo(v reflect.Value, tp reflect.Type) (reflect.Value, error) {
+	v = matchDestType(v, tp)
+	if !v.Type().ConvertibleTo(tp) {
+		return NoValue, cannotConvertToErr(v, tp)
+	}
+	return v.Convert(tp), nil
+}
+
+// binaryOp returns the result of x op y, where op is not a logical operator.
+func binaryOp(op token.Token, x, y reflect.Value) ([]reflect.Value, error) {
+	x, y, err := matchType(x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case token.LSS:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return fromSingleValue(reflect.ValueOf(x.Int() < y.Int()), nil)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return fromSingleValue(reflect.ValueOf(x.Uint() < y.Uint()), nil)
+		case reflect.Float32, reflect.Float64:
+			return fromSingleValue(reflect.ValueOf(x.Float() < y.Float()), nil)
+		case reflect.String:
+			return fromSingleValue(reflect.ValueOf(x.String() < y.String()), nil)
+		}
+	case token.LEQ:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return fromSingleValue(reflect.ValueOf(x.Int() <= y.Int()), nil)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return fromSingleValue(reflect.ValueOf(x.Uint() <= y.Uint()), nil)
+		case reflect.Float32, reflect.Float64:
+			return fromSingleValue(reflect.ValueOf(x.Float() <= y.Float()), nil)
+		case reflect.String:
+			return fromSingleValue(reflect.ValueOf(x.String() <= y.String()), nil)
+		}
+	case token.GTR:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return fromSingleValue(reflect.ValueOf(x.Int() > y.Int()), nil)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return fromSingleValue(reflect.ValueOf(x.Uint() > y.Uint()), nil)
+		case reflect.Float32, reflect.Float64:
+			return fromSingleValue(reflect.ValueOf(x.Float() > y.Float()), nil)
+		case reflect.String:
+			return fromSingleValue(reflect.ValueOf(x.String() > y.String()), nil)
+		}
+	case token.GEQ:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return fromSingleValue(reflect.ValueOf(x.Int() >= y.Int()), nil)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return fromSingleValue(reflect.ValueOf(x.Uint() >= y.Uint()), nil)
+		case reflect.Float32, reflect.Float64:
+			return fromSingleValue(reflect.ValueOf(x.Float() >= y.Float()), nil)
+		case reflect.String:
+			return fromSingleValue(reflect.ValueOf(x.String() >= y.String()), nil)
+		}
+
+	case token.EQL:
+		return fromSingleValue(reflect.ValueOf(x.Interface() == y.Interface()), nil)
+	case token.NEQ:
+		return fromSingleValue(reflect.ValueOf(x.Interface() != y.Interface()), nil)
+
+	case token.ADD:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()+y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()+y.Uint(), x.Type())
+		case reflect.Float32, reflect.Float64:
+			return typedValueToResult(x.Float()+y.Float(), x.Type())
+		case reflect.Complex64, reflect.Complex128:
+			return typedValueToResult(x.Complex()+y.Complex(), x.Type())
+		case reflect.String:
+			return typedValueToResult(x.String()+y.String(), x.Type())
+		}
+	case token.SUB:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()-y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()-y.Uint(), x.Type())
+		case reflect.Float32, reflect.Float64:
+			return typedValueToResult(x.Float()-y.Float(), x.Type())
+		case reflect.Complex64, reflect.Complex128:
+			return typedValueToResult(x.Complex()-y.Complex(), x.Type())
+		}
+	case token.MUL:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()*y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()*y.Uint(), x.Type())
+		case reflect.Float32, reflect.Float64:
+			return typedValueToResult(x.Float()*y.Float(), x.Type())
+		case reflect.Complex64, reflect.Complex128:
+			return typedValueToResult(x.Complex()*y.Complex(), x.Type())
+		}
+	case token.QUO:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()/y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()/y.Uint(), x.Type())
+		case reflect.Float32, reflect.Float64:
+			return typedValueToResult(x.Float()/y.Float(), x.Type())
+		case reflect.Complex64, reflect.Complex128:
+			return typedValueToResult(x.Complex()/y.Complex(), x.Type())
+		}
+	case token.REM:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()%y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()%y.Uint(), x.Type())
+		}
+	case token.AND:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()&y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()&y.Uint(), x.Type())
+		}
+	case token.OR:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()|y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()|y.Uint(), x.Type())
+		}
+	case token.XOR:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()^y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()^y.Uint(), x.Type())
+		}
+	case token.SHL:
+		switch x.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()<<y.Uint(), x.Type())
+		}
+	case token.SHR:
+		switch x.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()>>y.Uint(), x.Type())
+		}
+	case token.AND_NOT:
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return typedValueToResult(x.Int()&^y.Int(), x.Type())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return typedValueToResult(x.Uint()&^y.Uint(), x.Type())
+		}
+
+	default:
+		return nil, typeErr(NotSupported, "Unknown op: %v", op)
+	}
+
+	return nil, invalidOperationErr(op.String(), x.Type())
+}
+
 // Returns slice of values themselves not the pointers.
+// evalExpr evaluates expr. Errors are reported at the position of the
+// innermost expression failed.
 func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, error) {
+	vls, err := mch.evalExprNode(ns, expr)
+	return vls, mch.atPos(expr, err)
+}
+
+func (mch *machine) evalExprNode(ns NameSpace, expr ast.Expr) ([]reflect.Value, error) {
 	switch expr := expr.(type) {
 	case *ast.BasicLit:
 		switch expr.Kind {
@@ -294,7 +942,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 		}
 
 		if v := ns.Find(expr.Name); v != NoValue {
-			return fromSingleValue(v, nil)
+			return fromSingleValue(v, checkAccess(v))
 		}
 
 		if tp, err := mch.evalType(ns, expr); err == nil {
@@ -306,7 +954,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 	case *ast.CallExpr:
 		fn, err := checkSingleValue(mch.evalExpr(ns, expr.Fun))
 		if err != nil {
-			if _, ok := err.(UndefinedError); ok {
+			if errors.As(err, new(UndefinedError)) {
 				fun := builtinFunc(expr.Fun)
 				if fun == "" {
 					return nil, err
@@ -329,63 +977,40 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			if err != nil {
 				return nil, err
 			}
-
-			if !v.Type().ConvertibleTo(tp) {
-				return nil, cannotConvertToErr(v, tp)
-			}
-			return singleValue(v.Convert(tp))
-		}
-
-		if fn.Kind() != reflect.Func {
-			return nil, fmt.Errorf("cannot call non-function (type %s)", fn.Type())
+			return fromSingleValue(convertTo(v, tp))
 		}
 
-		var args []reflect.Value
-		if len(expr.Args) == 1 {
-			// actually input args number is the number of return values
-			var err error
-			if args, err = mch.evalExpr(ns, expr.Args[0]); err != nil {
+		if fnType == GenericFuncType || fnType == partialGenericFuncType {
+			args, err := mch.evalArgs(ns, expr.Args)
+			if err != nil {
 				return nil, err
 			}
-		} else {
-			args = make([]reflect.Value, len(expr.Args))
-			for i, arg := range expr.Args {
-				argV, err := checkSingleValue(mch.evalExpr(ns, arg))
-				if err != nil {
-					return nil, err
-				}
-				args[i] = argV
+			if fn, err = mch.instantiateFuncFor(fn, args); err != nil {
+				return nil, err
 			}
+			return callFunc(fn, args)
 		}
 
-		mn, mx := calcFuncInNumRange(fnType)
-		if len(args) < mn {
-			return nil, notEnoughArgumentsErr(fn.String())
-		}
-
-		if mx >= 0 && len(args) > mx {
-			return nil, tooManyArgumentsErr(fn.String())
-		}
-
-		for i := 0; i < mn; i++ {
-			tp := fnType.In(i)
-			args[i] = removeBasicLit(matchDestType(args[i], tp))
-			if !args[i].Type().AssignableTo(tp) {
-				return nil, cannotUseAsInArgumentErr(args[i], tp, fn.String())
+		if fnType == InstancesType {
+			args, err := mch.evalArgs(ns, expr.Args)
+			if err != nil {
+				return nil, err
 			}
+			if fn, err = selectInstance(expr.Fun, fn.Interface().(Instances), args); err != nil {
+				return nil, err
+			}
+			return callFunc(fn, args)
 		}
 
-		if fn.Type().IsVariadic() {
-			tp := fnType.In(fnType.NumIn() - 1).Elem()
-			for i := mn; i < len(args); i++ {
-				args[i] = removeBasicLit(matchDestType(args[i], tp))
-				if !args[i].Type().AssignableTo(tp) {
-					return nil, cannotUseAsInArgumentErr(args[i], tp, fn.String())
-				}
-			}
+		if fn.Kind() != reflect.Func {
+			return nil, typeErr(InvalidOperation, "cannot call non-function (type %s)", fn.Type())
 		}
 
-		return fn.Call(args), nil
+		args, err := mch.evalArgs(ns, expr.Args)
+		if err != nil {
+			return nil, err
+		}
+		return callFunc(fn, args)
 
 	case *ast.SelectorExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
@@ -393,38 +1018,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			return nil, err
 		}
 
-		switch x.Type() {
-		case ConstValueType:
-			return nil, villa.Errorf("Not implemented!")
-		case TypeValueType:
-			return nil, villa.Errorf("Not implemented!")
-		case PackageType:
-			x := x.Interface().(Package)
-			if vl, ok := x[expr.Sel.Name]; ok {
-				return singleValue(vl)
-			}
-			return nil, undefinedErr(fmt.Sprintf("%v.%v", expr.X, expr.Sel.Name))
-		default:
-		}
-
-		for {
-			if x.Kind() == reflect.Struct {
-				if vl := x.FieldByName(expr.Sel.Name); vl.IsValid() {
-					return singleValue(vl)
-				}
-			}
-
-			if vl := x.MethodByName(expr.Sel.Name); vl.IsValid() {
-				return singleValue(vl)
-			}
-
-			if x.Kind() != reflect.Ptr {
-				break
-			}
-			x = x.Elem()
-		}
-
-		return nil, undefinedTypeHasNotFieldOrMethod(expr, x.Type(), expr.Sel.Name)
+		return mch.selectExpr(expr, x)
 
 	case *ast.UnaryExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
@@ -432,40 +1026,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			return nil, err
 		}
 
-		switch expr.Op {
-		case token.ADD:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return valueToResult(x.Interface())
-			}
-		case token.SUB:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(-x.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(-x.Uint(), x.Type())
-			}
-		case token.NOT:
-			switch x.Kind() {
-			case reflect.Bool:
-				return typedValueToResult(!x.Bool(), x.Type())
-			}
-		case token.XOR:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(^x.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(^x.Uint(), x.Type())
-			}
-		case token.AND:
-			if x.CanAddr() {
-				return singleValue(x.Addr())
-			}
-			return nil, cannotTakeTheAddressOfErr(expr.X)
-			// TODO token.ARROW
-		}
-		return nil, invalidOperationErr(expr.Op.String(), x.Type())
+		return unaryOp(expr, x)
 
 	case *ast.StarExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
@@ -502,159 +1063,11 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 		if err != nil {
 			return nil, err
 		}
-
-		if x, y, err = matchType(x, y); err != nil {
+		if err := mch.allocConcat(expr.Op, x, y); err != nil {
 			return nil, err
 		}
 
-		switch expr.Op {
-		case token.LSS:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return fromSingleValue(reflect.ValueOf(x.Int() < y.Int()), nil)
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return fromSingleValue(reflect.ValueOf(x.Uint() < y.Uint()), nil)
-			case reflect.Float32, reflect.Float64:
-				return fromSingleValue(reflect.ValueOf(x.Float() < y.Float()), nil)
-			case reflect.String:
-				return fromSingleValue(reflect.ValueOf(x.String() < y.String()), nil)
-			}
-		case token.LEQ:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return fromSingleValue(reflect.ValueOf(x.Int() <= y.Int()), nil)
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return fromSingleValue(reflect.ValueOf(x.Uint() <= y.Uint()), nil)
-			case reflect.Float32, reflect.Float64:
-				return fromSingleValue(reflect.ValueOf(x.Float() <= y.Float()), nil)
-			case reflect.String:
-				return fromSingleValue(reflect.ValueOf(x.String() <= y.String()), nil)
-			}
-		case token.GTR:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return fromSingleValue(reflect.ValueOf(x.Int() > y.Int()), nil)
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return fromSingleValue(reflect.ValueOf(x.Uint() > y.Uint()), nil)
-			case reflect.Float32, reflect.Float64:
-				return fromSingleValue(reflect.ValueOf(x.Float() > y.Float()), nil)
-			case reflect.String:
-				return fromSingleValue(reflect.ValueOf(x.String() > y.String()), nil)
-			}
-		case token.GEQ:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return fromSingleValue(reflect.ValueOf(x.Int() >= y.Int()), nil)
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return fromSingleValue(reflect.ValueOf(x.Uint() >= y.Uint()), nil)
-			case reflect.Float32, reflect.Float64:
-				return fromSingleValue(reflect.ValueOf(x.Float() >= y.Float()), nil)
-			case reflect.String:
-				return fromSingleValue(reflect.ValueOf(x.String() >= y.String()), nil)
-			}
-
-		case token.EQL:
-			return fromSingleValue(reflect.ValueOf(x.Interface() == y.Interface()), nil)
-		case token.NEQ:
-			return fromSingleValue(reflect.ValueOf(x.Interface() != y.Interface()), nil)
-
-		case token.ADD:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()+y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()+y.Uint(), x.Type())
-			case reflect.Float32, reflect.Float64:
-				return typedValueToResult(x.Float()+y.Float(), x.Type())
-			case reflect.Complex64, reflect.Complex128:
-				return typedValueToResult(x.Complex()+y.Complex(), x.Type())
-			case reflect.String:
-				return typedValueToResult(x.String()+y.String(), x.Type())
-			}
-		case token.SUB:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()-y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()-y.Uint(), x.Type())
-			case reflect.Float32, reflect.Float64:
-				return typedValueToResult(x.Float()-y.Float(), x.Type())
-			case reflect.Complex64, reflect.Complex128:
-				return typedValueToResult(x.Complex()-y.Complex(), x.Type())
-			}
-		case token.MUL:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()*y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()*y.Uint(), x.Type())
-			case reflect.Float32, reflect.Float64:
-				return typedValueToResult(x.Float()*y.Float(), x.Type())
-			case reflect.Complex64, reflect.Complex128:
-				return typedValueToResult(x.Complex()*y.Complex(), x.Type())
-			}
-		case token.QUO:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()/y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()/y.Uint(), x.Type())
-			case reflect.Float32, reflect.Float64:
-				return typedValueToResult(x.Float()/y.Float(), x.Type())
-			case reflect.Complex64, reflect.Complex128:
-				return typedValueToResult(x.Complex()/y.Complex(), x.Type())
-			}
-		case token.REM:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()%y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()%y.Uint(), x.Type())
-			}
-		case token.AND:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()&y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()&y.Uint(), x.Type())
-			}
-		case token.OR:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()|y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()|y.Uint(), x.Type())
-			}
-		case token.XOR:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()^y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()^y.Uint(), x.Type())
-			}
-		case token.SHL:
-			switch x.Kind() {
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()<<y.Uint(), x.Type())
-			}
-		case token.SHR:
-			switch x.Kind() {
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()>>y.Uint(), x.Type())
-			}
-		case token.AND_NOT:
-			switch x.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return typedValueToResult(x.Int()&^y.Int(), x.Type())
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				return typedValueToResult(x.Uint()&^y.Uint(), x.Type())
-			}
-
-		default:
-			return nil, villa.Errorf("Unknown op: %v", expr.Op)
-		}
-
-		return nil, invalidOperationErr(expr.Op.String(), x.Type())
+		return binaryOp(expr.Op, x, y)
 
 	case *ast.IndexExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
@@ -662,26 +1075,29 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			return nil, err
 		}
 
+		switch x.Type() {
+		case GenericFuncType, GenericTypeType:
+			return fromSingleValue(mch.instantiate(ns, x, []ast.Expr{expr.Index}))
+		}
+
 		index, err := checkSingleValue(mch.evalExpr(ns, expr.Index))
 		if err != nil {
 			return nil, err
 		}
 
-		switch x.Kind() {
-		case reflect.Slice:
-			i, err := asInteger(index)
-			if err != nil {
-				return nil, err
-			}
-
-			return singleValue(x.Index(i))
-		case reflect.Map:
-			// TODO check type of index
-			index = matchDestType(index, x.Type().Key())
-			return valueToResult(MapIndexValue{x, index})
+		return indexValue(expr, x, index)
+	case *ast.IndexListExpr:
+		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
+		if err != nil {
+			return nil, err
 		}
 
+		switch x.Type() {
+		case GenericFuncType, GenericTypeType:
+			return fromSingleValue(mch.instantiate(ns, x, expr.Indices))
+		}
 		return nil, invalidOperationTypeDoesNotSupportIndexingErr(expr, x.Kind())
+
 	case *ast.CompositeLit:
 		tp, err := mch.evalType(ns, expr.Type)
 		if err != nil {
@@ -690,6 +1106,9 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 
 		switch tp.Kind() {
 		case reflect.Slice:
+			if err := mch.allocElems(tp.Elem(), len(expr.Elts)); err != nil {
+				return nil, err
+			}
 			vl := reflect.MakeSlice(tp, len(expr.Elts), len(expr.Elts))
 			for i, elt := range expr.Elts {
 				vlElt, err := checkSingleValue(mch.evalExpr(ns, elt))
@@ -704,6 +1123,9 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			}
 			return singleValue(vl)
 		case reflect.Map:
+			if err := mch.allocMap(tp, len(expr.Elts)); err != nil {
+				return nil, err
+			}
 			vl := reflect.MakeMap(tp)
 			for _, elt := range expr.Elts {
 				kv := elt.(*ast.KeyValueExpr)
@@ -731,6 +1153,9 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			}
 			return singleValue(vl)
 		case reflect.Struct:
+			if err := mch.allocElems(tp, 1); err != nil {
+				return nil, err
+			}
 			res := reflect.New(tp).Elem()
 
 			for idx, elt := range expr.Elts {
@@ -745,7 +1170,14 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 					}
 
 					key := elt.Key.(*ast.Ident).Name
-					vFld = res.FieldByName(key)
+					fld, ok := tp.FieldByName(key)
+					if !ok {
+						return nil, unknownFieldInStructLiteralErr(key, tp)
+					}
+					if vFld, err = fieldByIndex(res, fld.Index); err != nil {
+						return nil, err
+					}
+					vFld = exposeLocalField(vFld, tp, fld.Index)
 
 					valExpr = elt.Value
 				default:
@@ -755,7 +1187,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 						return nil, err
 					}
 
-					vFld = res.Field(idx)
+					vFld = exposeLocalField(res.Field(idx), tp, []int{idx})
 
 					valExpr = elt
 				}
@@ -770,7 +1202,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			return singleValue(res)
 		default:
 			ast.Print(token.NewFileSet(), expr)
-			return nil, villa.Errorf("Unknown CompositeLit expr Kind: %v", tp.Kind())
+			return nil, typeErr(NotSupported, "Unknown CompositeLit expr Kind: %v", tp.Kind())
 		}
 
 	case *ast.SliceExpr:
@@ -829,17 +1261,7 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 			return nil, err
 		}
 
-		_ = tp
-		return singleValue(reflect.MakeFunc(tp, func(args []reflect.Value) []reflect.Value {
-			if len(args) > 0 {
-				panic("Not implemented!")
-			}
-
-			newNS := ns.NewBlock()
-			mch.runStatement(newNS, expr.Body)
-
-			return nil
-		}))
+		return singleValue(mch.makeFunc(ns, tp, expr.Type, expr.Body))
 	case *ast.TypeAssertExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
 		if err != nil {
@@ -865,5 +1287,5 @@ func (mch *machine) evalExpr(ns NameSpace, expr ast.Expr) ([]reflect.Value, erro
 		return singleValue(x.Convert(tp))
 	}
 	ast.Print(token.NewFileSet(), expr)
-	return nil, villa.Errorf("Unknown expr type")
+	return nil, typeErr(NotSupported, "Unknown expr type")
 }
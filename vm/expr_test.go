@@ -145,6 +145,70 @@ t := s.Error()`))
 	assert.Equals(t, "t", mch.GlobalNameSpace.FindLocal("t").Interface(), "hello")
 }
 
+func TestSelectorPromotion(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`o := sample.NewOuter()
+n := o.Name
+o.Inc()
+o.Inc()
+c := o.Count()
+s := o.String()
+id := o.ID`))
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), "inner")
+	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), 2)
+	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), "name:outer")
+	assert.Equals(t, "id", mch.GlobalNameSpace.FindLocal("id").Interface(), 1)
+
+	assert.NoError(t, mch.Run(`o.Name = "changed"
+n = o.Name`))
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), "changed")
+}
+
+func TestSelectorUnexported(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`o := sample.NewOuter()`))
+	assert.NotEquals(t, "err", mch.Run(`s := o.secret`), nil)
+	assert.NotEquals(t, "err", mch.Run(`c := o.count`), nil)
+
+	mch = newMachineWithOptions(Options{Unexported: ReadUnexported})
+
+	assert.NoError(t, mch.Run(`o := sample.NewOuter()
+s := o.secret
+o.Inc()
+c := o.count`))
+	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), "xyz")
+	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), 1)
+	assert.NotEquals(t, "err", mch.Run(`o.secret = "abc"`), nil)
+	assert.NotEquals(t, "err", mch.Run(`o.count++`), nil)
+
+	// fields of a non-addressable struct
+	assert.NoError(t, mch.Run(`t := sample.NewOuter().secret`))
+	assert.Equals(t, "t", mch.GlobalNameSpace.FindLocal("t").Interface(), "xyz")
+
+	// values referred to by the fields are copied as well
+	assert.NoError(t, mch.Run(`r := sample.Refs
+in := r.inner
+in.Name = "changed"
+in.Inc()
+r.inner.Name = "changed"
+ints := r.ints
+ints[0] = 10
+m := r.m
+m["a"] = 10
+m["b"] = 2
+a := r.any.(*sample.Inner)
+a.Name = "changed"
+self := r.self.self.self
+self.ints[1] = 20`))
+	assert.StringEquals(t, "refs", *sampleRefsShared.inner, sampleInner{Name: "inner"})
+	assert.StringEquals(t, "ints", sampleRefsShared.ints, []int{1, 2})
+	assert.StringEquals(t, "m", sampleRefsShared.m, map[string]int{"a": 1})
+	assert.Equals(t, "any", sampleRefsShared.any.(*sampleInner).Name, "any")
+	assert.Equals(t, "self", sampleRefsShared.self, sampleRefsShared)
+}
+
 func TestTypeAssertion(t *testing.T) {
 	mch := newMachine()
 
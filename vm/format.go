@@ -0,0 +1,391 @@
+package gsvm
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter renders values in a Go-syntax-like form, e.g.
+//
+//	[]main.point{
+//	  {x: 1, y: 2},
+//	  {x: 3, y: 4},
+//	}
+type Formatter struct {
+	// Indentation of each nesting level of multi-line composites.
+	Indent string
+	// Composites not longer than Width are rendered in a single line.
+	Width int
+	// Maximum number of elements shown for slices, arrays and maps. 0 means
+	// no limit.
+	MaxElems int
+	// Maximum nesting depth of composites shown. 0 means no limit.
+	MaxDepth int
+	// Maximum number of bytes shown in the hex dump of a []byte. 0 means no
+	// limit.
+	MaxBytes int
+}
+
+// DefaultFormatter is used by FormatValue.
+var DefaultFormatter = &Formatter{
+	Indent:   "  ",
+	Width:    80,
+	MaxElems: 100,
+	MaxDepth: 10,
+	MaxBytes: 256,
+}
+
+// FormatValue formats vl with DefaultFormatter.
+func FormatValue(vl reflect.Value) string {
+	return DefaultFormatter.Format(vl)
+}
+
+// Where a value is rendered, which determines what type information can be
+// elided as in Go composite literals.
+type formatCtx int
+
+const (
+	// Standalone values, shown with their types, e.g. int(45).
+	fullCtx formatCtx = iota
+	// Struct field values, basic values are shown without types.
+	fieldCtx
+	// Elements and keys of slices, arrays and maps, shown without types.
+	elemCtx
+)
+
+type formatState struct {
+	*Formatter
+	// pointers and maps on the path from the root, for cycle detection
+	visiting map[uintptr]bool
+}
+
+// Format returns the rendering of vl.
+func (f *Formatter) Format(vl reflect.Value) string {
+	st := &formatState{
+		Formatter: f,
+		visiting:  make(map[uintptr]bool),
+	}
+	return st.format(vl, fullCtx, 0)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func isBasicKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+// basicString returns the literal of a value of a basic kind. Accessors of
+// reflect.Value are used so that unexported fields can be shown.
+func basicString(vl reflect.Value) string {
+	switch vl.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(vl.Bool())
+	case reflect.String:
+		return strconv.Quote(vl.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int64:
+		return strconv.FormatInt(vl.Int(), 10)
+	case reflect.Int32:
+		// rune is int32, so only untyped rune constants are known to be
+		// characters.
+		if vl.Type() == runeLiteralType {
+			return strconv.QuoteRune(rune(vl.Int()))
+		}
+		return strconv.FormatInt(vl.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(vl.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(vl.Float(), 'g', -1, 32)
+	case reflect.Float64:
+		return strconv.FormatFloat(vl.Float(), 'g', -1, 64)
+	case reflect.Complex64, reflect.Complex128:
+		return fmt.Sprint(vl.Complex())
+	}
+	return ""
+}
+
+func (st *formatState) format(vl reflect.Value, ctx formatCtx, depth int) string {
+	if !vl.IsValid() {
+		return "nil"
+	}
+
+	switch vl.Type() {
+	case MapIndexValueType, ConstValueType:
+		s := st.format(echoValue(vl), ctx, depth)
+		if vl.Type() == ConstValueType {
+			return "const " + s
+		}
+		return s
+	case TypeValueType:
+		return "type " + vl.Interface().(TypeValue).Type.String()
+	case PackageType:
+		return "package"
+	case GenericFuncType:
+		return "generic func " + vl.Interface().(GenericFunc).Decl.Name.Name
+	case GenericTypeType:
+		return "generic type " + vl.Interface().(GenericType).Spec.Name.Name
+	case InstancesType:
+		return fmt.Sprintf("generic func (%d instances)", vl.Len())
+	}
+
+	tp := TypeString(vl.Type())
+	if vl.Kind() == reflect.Interface {
+		if vl.IsNil() {
+			if ctx != fullCtx {
+				return "nil"
+			}
+			return tp + "(nil)"
+		}
+		// dynamic types are always shown
+		return st.format(vl.Elem(), fullCtx, depth)
+	}
+
+	if s, ok := st.special(vl); ok {
+		return s
+	}
+
+	if isBasicKind(vl.Kind()) || vl.Type() == bigIntLiteralType {
+		s := basicString(vl)
+		if vl.Type() == bigIntLiteralType {
+			s = vl.Interface().(bigIntLiteral).String()
+		}
+		if ctx != fullCtx {
+			return s
+		}
+		return tp + "(" + s + ")"
+	}
+
+	if ctx == elemCtx {
+		// types of composite elements are elided
+		tp = ""
+	}
+
+	switch vl.Kind() {
+	case reflect.Ptr:
+		if vl.IsNil() {
+			if ctx != fullCtx {
+				return "nil"
+			}
+			return "(" + tp + ")(nil)"
+		}
+		switch vl.Elem().Kind() {
+		case reflect.Struct, reflect.Array, reflect.Slice, reflect.Map:
+		default:
+			return fmt.Sprintf("(%s)(%#x)", TypeString(vl.Type()), vl.Pointer())
+		}
+		if st.visiting[vl.Pointer()] {
+			return fmt.Sprintf("(%s)(%#x) /* cycle */", TypeString(vl.Type()), vl.Pointer())
+		}
+		st.visiting[vl.Pointer()] = true
+		defer delete(st.visiting, vl.Pointer())
+
+		if ctx == elemCtx {
+			// &T is elided as well
+			return st.format(vl.Elem(), elemCtx, depth)
+		}
+		return "&" + st.format(vl.Elem(), fullCtx, depth)
+
+	case reflect.Struct:
+		if st.MaxDepth > 0 && depth >= st.MaxDepth {
+			return tp + "{/* ... */}"
+		}
+		var items []string
+		for i := 0; i < vl.NumField(); i++ {
+			fld := vl.Type().Field(i)
+			items = append(items, fld.Name+": "+st.format(vl.Field(i), fieldCtx, depth+1))
+		}
+		return st.composite(tp, items, 0)
+
+	case reflect.Slice:
+		if vl.IsNil() {
+			if ctx != fullCtx {
+				return "nil"
+			}
+			return tp + "(nil)"
+		}
+		if vl.Type().Elem().Kind() == reflect.Uint8 {
+			return st.hexDump(tp, vl)
+		}
+		return st.elements(tp, vl, depth)
+
+	case reflect.Array:
+		return st.elements(tp, vl, depth)
+
+	case reflect.Map:
+		if vl.IsNil() {
+			if ctx != fullCtx {
+				return "nil"
+			}
+			return tp + "(nil)"
+		}
+		if st.visiting[vl.Pointer()] {
+			return fmt.Sprintf("(%s)(%#x) /* cycle */", TypeString(vl.Type()), vl.Pointer())
+		}
+		if st.MaxDepth > 0 && depth >= st.MaxDepth {
+			return tp + "{/* ... */}"
+		}
+		st.visiting[vl.Pointer()] = true
+		defer delete(st.visiting, vl.Pointer())
+
+		keys := vl.MapKeys()
+		st.sortKeys(keys)
+		n, more := st.limit(len(keys))
+		items := make([]string, 0, n)
+		for _, key := range keys[:n] {
+			items = append(items, st.format(key, elemCtx, depth+1)+": "+st.format(vl.MapIndex(key), elemCtx, depth+1))
+		}
+		return st.composite(tp, items, more)
+
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if vl.IsNil() {
+			if ctx != fullCtx {
+				return "nil"
+			}
+			return "(" + TypeString(vl.Type()) + ")(nil)"
+		}
+		return fmt.Sprintf("(%s)(%#x)", TypeString(vl.Type()), vl.Pointer())
+	}
+
+	return fmt.Sprint(vl)
+}
+
+// special returns the rendering of values of types shown in a specific way,
+// i.e. time.Time and errors.
+func (st *formatState) special(vl reflect.Value) (s string, ok bool) {
+	if !vl.CanInterface() {
+		return "", false
+	}
+	if vl.Type() == timeType {
+		return formatTime(vl.Interface().(time.Time)), true
+	}
+	if vl.Kind() == reflect.Ptr && vl.IsNil() {
+		return "", false
+	}
+	if err, isErr := vl.Interface().(error); isErr {
+		defer func() {
+			// Error() of some values panics
+			if r := recover(); r != nil {
+				s, ok = "", false
+			}
+		}()
+		return TypeString(vl.Type()) + "(" + strconv.Quote(err.Error()) + ")", true
+	}
+	return "", false
+}
+
+func formatTime(t time.Time) string {
+	var loc string
+	switch t.Location() {
+	case time.UTC:
+		loc = "time.UTC"
+	case time.Local:
+		loc = "time.Local"
+	default:
+		name, offset := t.Zone()
+		loc = fmt.Sprintf("time.FixedZone(%q, %d)", name, offset)
+	}
+	return fmt.Sprintf("time.Date(%d, time.%v, %d, %d, %d, %d, %d, %s)",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// limit returns the number of elements shown out of n, and the number of
+// the rest.
+func (st *formatState) limit(n int) (shown, more int) {
+	if st.MaxElems > 0 && n > st.MaxElems {
+		return st.MaxElems, n - st.MaxElems
+	}
+	return n, 0
+}
+
+// elements renders a slice or an array.
+func (st *formatState) elements(tp string, vl reflect.Value, depth int) string {
+	if st.MaxDepth > 0 && depth >= st.MaxDepth && vl.Len() > 0 {
+		return tp + "{/* ... */}"
+	}
+	n, more := st.limit(vl.Len())
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, st.format(vl.Index(i), elemCtx, depth+1))
+	}
+	return st.composite(tp, items, more)
+}
+
+// hexDump renders a byte slice as a hex dump.
+func (st *formatState) hexDump(tp string, vl reflect.Value) string {
+	if tp == "[]uint8" {
+		tp = "[]byte"
+	}
+	bs := make([]byte, vl.Len())
+	reflect.Copy(reflect.ValueOf(bs), vl)
+	if len(bs) == 0 {
+		return tp + "{}"
+	}
+
+	more := 0
+	if st.MaxBytes > 0 && len(bs) > st.MaxBytes {
+		bs, more = bs[:st.MaxBytes], len(bs)-st.MaxBytes
+	}
+	lines := strings.Split(strings.TrimSuffix(hex.Dump(bs), "\n"), "\n")
+	if more > 0 {
+		lines = append(lines, fmt.Sprintf("/* %d more bytes */", more))
+	}
+	return fmt.Sprintf("%s{ // %d bytes\n%s%s\n}", tp, vl.Len(), st.Indent,
+		strings.Join(lines, "\n"+st.Indent))
+}
+
+// composite renders tp{item, ...}, in a single line if it fits.
+func (st *formatState) composite(tp string, items []string, more int) string {
+	if more > 0 {
+		items = append(items, fmt.Sprintf("/* %d more */", more))
+	}
+	line := tp + "{" + strings.Join(items, ", ") + "}"
+	if len(line) <= st.Width && !strings.Contains(line, "\n") {
+		return line
+	}
+
+	lines := []string{tp + "{"}
+	for i, item := range items {
+		item = st.Indent + strings.Replace(item, "\n", "\n"+st.Indent, -1)
+		if more == 0 || i < len(items)-1 {
+			item += ","
+		}
+		lines = append(lines, item)
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+// sortKeys sorts map keys, numerically for numbers and by rendering for other
+// kinds.
+func (st *formatState) sortKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Kind() == reflect.Interface {
+			a, b = a.Elem(), b.Elem()
+		}
+		if a.IsValid() && b.IsValid() && a.Type() == b.Type() {
+			switch a.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				return a.Int() < b.Int()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+				return a.Uint() < b.Uint()
+			case reflect.Float32, reflect.Float64:
+				return a.Float() < b.Float()
+			case reflect.String:
+				return a.String() < b.String()
+			}
+		}
+		return st.format(keys[i], elemCtx, 0) < st.format(keys[j], elemCtx, 0)
+	})
+}
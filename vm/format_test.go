@@ -0,0 +1,72 @@
+package gsvm
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+type formatNode struct {
+	Name string
+	Next *formatNode
+	tags map[string]int
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equals(t, "int", FormatValue(reflect.ValueOf(45)), "int(45)")
+	assert.Equals(t, "[]string", FormatValue(reflect.ValueOf([]string{"a", "b"})), `[]string{"a", "b"}`)
+	assert.Equals(t, "[]interface{}", FormatValue(reflect.ValueOf([]interface{}{1, "a", nil})), `[]interface {}{int(1), string("a"), nil}`)
+	assert.Equals(t, "intLiteral", FormatValue(reflect.ValueOf(intLiteral(45))), "untyped int(45)")
+	assert.Equals(t, "runeLiteral", FormatValue(reflect.ValueOf(runeLiteral('a'))), "untyped rune('a')")
+	assert.Equals(t, "int32", FormatValue(reflect.ValueOf(int32(65))), "int32(65)")
+	assert.Equals(t, "[]int32", FormatValue(reflect.ValueOf([]int32{1, 2})), "[]int32{1, 2}")
+	assert.Equals(t, "stringLiteral", FormatValue(reflect.ValueOf(stringLiteral("a"))), `untyped string("a")`)
+	var err error
+	assert.Equals(t, "error", FormatValue(reflect.ValueOf(&err).Elem()), "error(nil)")
+	assert.Equals(t, "errors.New", FormatValue(reflect.ValueOf(errors.New("failed"))), `*errors.errorString("failed")`)
+
+	assert.Equals(t, "ConstValue", FormatValue(ToConstant(reflect.ValueOf(intLiteral(1)))), "const untyped int(1)")
+	assert.Equals(t, "TypeValue", FormatValue(PtrToTypeValue((*error)(nil))), "type error")
+	m := map[string]int{"a": 1}
+	assert.Equals(t, "MapIndexValue", FormatValue(reflect.ValueOf(MapIndexValue{reflect.ValueOf(m), reflect.ValueOf("a")})), "int(1)")
+
+	assert.Equals(t, "time.Time", FormatValue(reflect.ValueOf(time.Date(2024, time.March, 4, 5, 6, 7, 8, time.UTC))),
+		"time.Date(2024, time.March, 4, 5, 6, 7, 8, time.UTC)")
+}
+
+func TestFormatValueMap(t *testing.T) {
+	m := map[int]string{10: "j", 2: "b", 1: "a"}
+	assert.Equals(t, "map", FormatValue(reflect.ValueOf(m)), `map[int]string{1: "a", 2: "b", 10: "j"}`)
+
+	n := &formatNode{Name: "a", tags: map[string]int{"y": 2, "x": 1}}
+	assert.Equals(t, "node", FormatValue(reflect.ValueOf(n)), `&gsvm.formatNode{Name: "a", Next: nil, tags: map[string]int{"x": 1, "y": 2}}`)
+}
+
+func TestFormatValueMultiLine(t *testing.T) {
+	ns := []formatNode{{Name: "a long name for the first node"}, {Name: "a long name for the second node"}}
+	assert.Equals(t, "nodes", FormatValue(reflect.ValueOf(ns)), `[]gsvm.formatNode{
+  {Name: "a long name for the first node", Next: nil, tags: nil},
+  {Name: "a long name for the second node", Next: nil, tags: nil},
+}`)
+}
+
+func TestFormatValueCycle(t *testing.T) {
+	n := &formatNode{Name: "a"}
+	n.Next = &formatNode{Name: "b", Next: n}
+	s := FormatValue(reflect.ValueOf(n))
+	assert.Equals(t, "cycles", strings.Count(s, "/* cycle */"), 1)
+}
+
+func TestFormatValueLimits(t *testing.T) {
+	f := &Formatter{Indent: "  ", Width: 80, MaxElems: 3, MaxDepth: 2, MaxBytes: 4}
+	assert.Equals(t, "elems", f.Format(reflect.ValueOf([]int{1, 2, 3, 4, 5})), "[]int{1, 2, 3, /* 2 more */}")
+	assert.Equals(t, "depth", f.Format(reflect.ValueOf([][][]int{{{1}}})), "[][][]int{{{/* ... */}}}")
+	assert.Equals(t, "bytes", f.Format(reflect.ValueOf([]byte("hello"))), `[]byte{ // 5 bytes
+  00000000  68 65 6c 6c                                       |hell|
+  /* 1 more bytes */
+}`)
+}
@@ -0,0 +1,504 @@
+package gsvm
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+)
+
+// Holding a generic function declared in the interpreter. It is instantiated
+// to a function value when called or indexed with type arguments.
+type GenericFunc struct {
+	Decl *ast.FuncDecl
+	// The namespace the function is declared in
+	NS NameSpace
+}
+
+var GenericFuncType = reflect.TypeOf(GenericFunc{})
+
+// Holding a generic type declared in the interpreter. It is instantiated to a
+// TypeValue when indexed with type arguments.
+type GenericType struct {
+	Spec *ast.TypeSpec
+	// The namespace the type is declared in
+	NS NameSpace
+}
+
+var GenericTypeType = reflect.TypeOf(GenericType{})
+
+// Holding a constraint interface declared in the interpreter, i.e. an
+// interface containing type elements such as interface{ ~int | ~string }.
+// It can only be used in type parameter lists.
+type Constraint struct {
+	Expr ast.Expr
+	// The namespace the constraint is declared in
+	NS NameSpace
+}
+
+var ConstraintType = reflect.TypeOf(Constraint{})
+
+type typeParam struct {
+	Name       string
+	Constraint ast.Expr
+}
+
+func typeParams(fields *ast.FieldList) []typeParam {
+	var params []typeParam
+	if fields == nil {
+		return params
+	}
+	for _, fld := range fields.List {
+		for _, name := range fld.Names {
+			params = append(params, typeParam{Name: name.Name, Constraint: fld.Type})
+		}
+	}
+	return params
+}
+
+// isConstraintInterface returns true if expr is an interface with type
+// elements, which can not be represented as a reflect.Type.
+func isConstraintInterface(expr ast.Expr) bool {
+	it, ok := expr.(*ast.InterfaceType)
+	if !ok {
+		return false
+	}
+	for _, m := range it.Methods.List {
+		if _, ok := m.Type.(*ast.FuncType); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bindTypeParams checks typeArgs against the constraints of params and returns
+// a new block of ns with the type parameters defined.
+func (mch *machine) bindTypeParams(ns NameSpace, name string, params []typeParam, typeArgs []reflect.Type) (NameSpace, error) {
+	if len(typeArgs) != len(params) {
+		return nil, wrongTypeArgumentCountErr(name, len(typeArgs), len(params))
+	}
+
+	tns := ns.NewBlock()
+	for i, param := range params {
+		tns.AddLocal(param.Name, reflect.ValueOf(TypeValue{typeArgs[i]}))
+	}
+	// Constraints may refer to other type parameters, so they are checked
+	// after all parameters are defined.
+	for i, param := range params {
+		ok, err := mch.satisfies(tns, typeArgs[i], param.Constraint)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, doesNotSatisfyErr(typeArgs[i], param.Constraint)
+		}
+	}
+	return tns, nil
+}
+
+func (mch *machine) instantiateFunc(g GenericFunc, typeArgs []reflect.Type) (reflect.Value, error) {
+	decl := g.Decl
+	tns, err := mch.bindTypeParams(g.NS, decl.Name.Name, typeParams(decl.Type.TypeParams), typeArgs)
+	if err != nil {
+		return NoValue, err
+	}
+	tp, err := mch.evalType(tns, decl.Type)
+	if err != nil {
+		return NoValue, err
+	}
+	return mch.makeFunc(tns, tp, decl.Type, decl.Body), nil
+}
+
+func (mch *machine) instantiateType(g GenericType, typeArgs []reflect.Type) (reflect.Type, error) {
+	spec := g.Spec
+	tns, err := mch.bindTypeParams(g.NS, spec.Name.Name, typeParams(spec.TypeParams), typeArgs)
+	if err != nil {
+		return nil, err
+	}
+	return mch.evalType(tns, spec.Type)
+}
+
+// instantiate evaluates a generic function or type x indexed with type
+// arguments. Missing type arguments of a function are inferred when it is
+// called, so a GenericFunc may be returned.
+func (mch *machine) instantiate(ns NameSpace, x reflect.Value, indices []ast.Expr) (reflect.Value, error) {
+	typeArgs := make([]reflect.Type, len(indices))
+	for i, index := range indices {
+		tp, err := mch.evalType(ns, index)
+		if err != nil {
+			return NoValue, err
+		}
+		typeArgs[i] = tp
+	}
+
+	switch g := x.Interface().(type) {
+	case GenericFunc:
+		params := typeParams(g.Decl.Type.TypeParams)
+		if len(typeArgs) < len(params) {
+			return reflect.ValueOf(partialGenericFunc{g, typeArgs}), nil
+		}
+		return mch.instantiateFunc(g, typeArgs)
+
+	case GenericType:
+		tp, err := mch.instantiateType(g, typeArgs)
+		if err != nil {
+			return NoValue, err
+		}
+		return reflect.ValueOf(TypeValue{tp}), nil
+	}
+	return NoValue, notATypeErr(x.Type().String())
+}
+
+// A generic function with leading type arguments specified, e.g. F[int] for
+// func F[T, U any](...). The rest are inferred when called.
+type partialGenericFunc struct {
+	GenericFunc
+	TypeArgs []reflect.Type
+}
+
+var partialGenericFuncType = reflect.TypeOf(partialGenericFunc{})
+
+// instantiateFuncFor instantiates a generic function for a call with args,
+// inferring the type arguments not specified.
+func (mch *machine) instantiateFuncFor(fn reflect.Value, args []reflect.Value) (reflect.Value, error) {
+	var g GenericFunc
+	var typeArgs []reflect.Type
+	switch f := fn.Interface().(type) {
+	case GenericFunc:
+		g = f
+	case partialGenericFunc:
+		g, typeArgs = f.GenericFunc, f.TypeArgs
+	}
+
+	params := typeParams(g.Decl.Type.TypeParams)
+	bindings := make(map[string]reflect.Type)
+	isParam := make(map[string]bool)
+	for i, param := range params {
+		isParam[param.Name] = true
+		if i < len(typeArgs) {
+			bindings[param.Name] = typeArgs[i]
+		}
+	}
+
+	// Pairs of parameter type expressions and arguments.
+	var pExprs []ast.Expr
+	for _, fld := range g.Decl.Type.Params.List {
+		n := len(fld.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			pExprs = append(pExprs, fld.Type)
+		}
+	}
+	argExprs := make([]ast.Expr, len(args))
+	for i := range args {
+		switch {
+		case i < len(pExprs)-1:
+			argExprs[i] = pExprs[i]
+		case len(pExprs) == 0:
+			return NoValue, tooManyArgumentsErr(g.Decl.Name.Name)
+		default:
+			last := pExprs[len(pExprs)-1]
+			if ell, ok := last.(*ast.Ellipsis); ok {
+				last = ell.Elt
+			} else if i >= len(pExprs) {
+				return NoValue, tooManyArgumentsErr(g.Decl.Name.Name)
+			}
+			argExprs[i] = last
+		}
+	}
+
+	// Typed arguments first.
+	for i, arg := range args {
+		if isUntyped(arg.Type()) {
+			continue
+		}
+		if err := unify(argExprs[i], matchDestType(arg, arg.Type()).Type(), isParam, bindings); err != nil {
+			return NoValue, err
+		}
+	}
+	// Untyped arguments for bare type parameters get the default type of the
+	// largest kind of them, e.g. float64 for 1 and 2.5.
+	untyped := make(map[string]reflect.Value)
+	for i, arg := range args {
+		ident, ok := argExprs[i].(*ast.Ident)
+		if !ok || !isParam[ident.Name] || !isUntyped(arg.Type()) {
+			continue
+		}
+		if _, ok := bindings[ident.Name]; ok {
+			continue
+		}
+		if cur, ok := untyped[ident.Name]; !ok || untypedRank(arg.Type()) > untypedRank(cur.Type()) {
+			untyped[ident.Name] = arg
+		}
+	}
+	for name, arg := range untyped {
+		bindings[name] = removeBasicLit(arg).Type()
+	}
+
+	typeArgs = make([]reflect.Type, len(params))
+	for i, param := range params {
+		tp, ok := bindings[param.Name]
+		if !ok {
+			return NoValue, cannotInferErr(param.Name)
+		}
+		typeArgs[i] = tp
+	}
+	return mch.instantiateFunc(g, typeArgs)
+}
+
+func isUntyped(tp reflect.Type) bool {
+	switch tp {
+	case intLiteralType, runeLiteralType, floatLiteralType, complexLiteralType, stringLiteralType:
+		return true
+	}
+	return false
+}
+
+func untypedRank(tp reflect.Type) int {
+	switch tp {
+	case runeLiteralType:
+		return 1
+	case floatLiteralType:
+		return 2
+	case complexLiteralType:
+		return 3
+	}
+	return 0
+}
+
+// unify matches the type expression pExpr of a parameter with the type tp of
+// an argument and records the types of type parameters in bindings.
+func unify(pExpr ast.Expr, tp reflect.Type, isParam map[string]bool, bindings map[string]reflect.Type) error {
+	switch pExpr := pExpr.(type) {
+	case *ast.Ident:
+		if !isParam[pExpr.Name] {
+			return nil
+		}
+		if bound, ok := bindings[pExpr.Name]; ok {
+			if bound != tp {
+				return typeInferenceMismatchErr(pExpr.Name, bound, tp)
+			}
+			return nil
+		}
+		bindings[pExpr.Name] = tp
+
+	case *ast.ParenExpr:
+		return unify(pExpr.X, tp, isParam, bindings)
+
+	case *ast.Ellipsis:
+		if tp.Kind() == reflect.Slice {
+			return unify(pExpr.Elt, tp.Elem(), isParam, bindings)
+		}
+
+	case *ast.ArrayType:
+		if pExpr.Len == nil && tp.Kind() == reflect.Slice ||
+			pExpr.Len != nil && tp.Kind() == reflect.Array {
+			return unify(pExpr.Elt, tp.Elem(), isParam, bindings)
+		}
+
+	case *ast.StarExpr:
+		if tp.Kind() == reflect.Ptr {
+			return unify(pExpr.X, tp.Elem(), isParam, bindings)
+		}
+
+	case *ast.MapType:
+		if tp.Kind() == reflect.Map {
+			if err := unify(pExpr.Key, tp.Key(), isParam, bindings); err != nil {
+				return err
+			}
+			return unify(pExpr.Value, tp.Elem(), isParam, bindings)
+		}
+
+	case *ast.ChanType:
+		if tp.Kind() == reflect.Chan {
+			return unify(pExpr.Value, tp.Elem(), isParam, bindings)
+		}
+
+	case *ast.FuncType:
+		if tp.Kind() != reflect.Func {
+			return nil
+		}
+		for i, expr := range fieldTypeExprs(pExpr.Params) {
+			if i < tp.NumIn() {
+				if err := unify(expr, tp.In(i), isParam, bindings); err != nil {
+					return err
+				}
+			}
+		}
+		for i, expr := range fieldTypeExprs(pExpr.Results) {
+			if i < tp.NumOut() {
+				if err := unify(expr, tp.Out(i), isParam, bindings); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// fieldTypeExprs returns the type expressions of a parameter list, one for
+// each name.
+func fieldTypeExprs(fields *ast.FieldList) []ast.Expr {
+	var exprs []ast.Expr
+	if fields == nil {
+		return exprs
+	}
+	for _, fld := range fields.List {
+		n := len(fld.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			exprs = append(exprs, fld.Type)
+		}
+	}
+	return exprs
+}
+
+// satisfies returns true if tp is in the type set of constraint.
+func (mch *machine) satisfies(ns NameSpace, tp reflect.Type, constraint ast.Expr) (bool, error) {
+	switch cons := constraint.(type) {
+	case *ast.Ident:
+		switch cons.Name {
+		case "any":
+			return true, nil
+		case "comparable":
+			return tp.Comparable(), nil
+		}
+		if vl := ns.Find(cons.Name); vl != NoValue && vl.Type() == ConstraintType {
+			c := vl.Interface().(Constraint)
+			return mch.satisfies(c.NS, tp, c.Expr)
+		}
+
+	case *ast.ParenExpr:
+		return mch.satisfies(ns, tp, cons.X)
+
+	case *ast.BinaryExpr:
+		if cons.Op == token.OR {
+			if ok, err := mch.satisfies(ns, tp, cons.X); ok || err != nil {
+				return ok, err
+			}
+			return mch.satisfies(ns, tp, cons.Y)
+		}
+
+	case *ast.UnaryExpr:
+		if cons.Op == token.TILDE {
+			termTp, err := mch.evalType(ns, cons.X)
+			if err != nil {
+				return false, err
+			}
+			if termTp.Name() != "" && termTp.PkgPath() != "" {
+				// e.g. ~time.Duration
+				return false, invalidUseOfTildeErr(termTp)
+			}
+			return sameUnderlying(tp, termTp), nil
+		}
+
+	case *ast.InterfaceType:
+		for _, m := range cons.Methods.List {
+			if ftp, ok := m.Type.(*ast.FuncType); ok {
+				mTp, err := mch.evalType(ns, ftp)
+				if err != nil {
+					return false, err
+				}
+				for _, name := range m.Names {
+					if !hasMethod(tp, name.Name, mTp) {
+						return false, nil
+					}
+				}
+				continue
+			}
+			// an embedded element
+			if ok, err := mch.satisfies(ns, tp, m.Type); !ok || err != nil {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+
+	termTp, err := mch.evalType(ns, constraint)
+	if err != nil {
+		return false, err
+	}
+	if termTp.Kind() == reflect.Interface {
+		return tp.Implements(termTp), nil
+	}
+	return tp == termTp, nil
+}
+
+// hasMethod returns true if the method set of tp contains a method named name
+// of type mTp, which does not contain the receiver.
+func hasMethod(tp reflect.Type, name string, mTp reflect.Type) bool {
+	m, ok := tp.MethodByName(name)
+	if !ok {
+		return false
+	}
+	if tp.Kind() == reflect.Interface {
+		return m.Type == mTp
+	}
+	// Remove the receiver
+	in := make([]reflect.Type, m.Type.NumIn()-1)
+	for i := range in {
+		in[i] = m.Type.In(i + 1)
+	}
+	out := make([]reflect.Type, m.Type.NumOut())
+	for i := range out {
+		out[i] = m.Type.Out(i)
+	}
+	return reflect.FuncOf(in, out, m.Type.IsVariadic()) == mTp
+}
+
+// sameUnderlying returns true if the underlying type of tp is identical to
+// termTp, an unnamed or a predeclared type. A predeclared type is identified
+// by its kind, as the underlying type of a named basic type is the predeclared
+// type of its kind. Types defined in the machine are their underlying types,
+// see declareType.
+func sameUnderlying(tp, termTp reflect.Type) bool {
+	if tp == termTp {
+		return true
+	}
+	if tp.Kind() != termTp.Kind() {
+		return false
+	}
+	switch tp.Kind() {
+	case reflect.Array:
+		return tp.Len() == termTp.Len() && tp.Elem() == termTp.Elem()
+	case reflect.Slice, reflect.Ptr:
+		return tp.Elem() == termTp.Elem()
+	case reflect.Chan:
+		return tp.ChanDir() == termTp.ChanDir() && tp.Elem() == termTp.Elem()
+	case reflect.Map:
+		return tp.Key() == termTp.Key() && tp.Elem() == termTp.Elem()
+	case reflect.Func:
+		if tp.NumIn() != termTp.NumIn() || tp.NumOut() != termTp.NumOut() || tp.IsVariadic() != termTp.IsVariadic() {
+			return false
+		}
+		for i := 0; i < tp.NumIn(); i++ {
+			if tp.In(i) != termTp.In(i) {
+				return false
+			}
+		}
+		for i := 0; i < tp.NumOut(); i++ {
+			if tp.Out(i) != termTp.Out(i) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if tp.NumField() != termTp.NumField() {
+			return false
+		}
+		for i := 0; i < tp.NumField(); i++ {
+			f, tf := tp.Field(i), termTp.Field(i)
+			if f.Name != tf.Name || f.Type != tf.Type || f.Tag != tf.Tag || f.Anonymous != tf.Anonymous {
+				return false
+			}
+		}
+		return true
+	case reflect.Interface:
+		return tp.Implements(termTp) && termTp.Implements(tp)
+	}
+	// basic kinds
+	return true
+}
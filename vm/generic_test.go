@@ -0,0 +1,209 @@
+package gsvm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestFuncDecl(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}`))
+	assert.NoError(t, mch.Run(`f := fib(10)`))
+	assert.Equals(t, "f", mch.GlobalNameSpace.FindLocal("f").Interface(), 55)
+
+	assert.Equals(t, "err", mch.Run(`func fib(n int) int {`), FragmentErr)
+}
+
+func TestTypeDecl(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`type point struct {
+	x, y int
+}
+func dist2(p point) int {
+	return p.x*p.x + p.y*p.y
+}`))
+	assert.NoError(t, mch.Run(`p := point{3, 4}
+d := dist2(p)
+p.x = 6
+q := point{y: 8}
+e := dist2(q) + p.x`))
+	assert.Equals(t, "d", mch.GlobalNameSpace.FindLocal("d").Interface(), 25)
+	assert.Equals(t, "e", mch.GlobalNameSpace.FindLocal("e").Interface(), 70)
+}
+
+func TestDefinedTypes(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`type celsius float64
+type alpha color.Alpha
+type pair struct {
+	a, b int
+}
+type other struct {
+	a, b int
+}
+c := celsius(1.5) * 2
+p := pair{1, 2}
+o := other(p)`))
+	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), 3.0)
+	assert.Equals(t, "o.b", mch.GlobalNameSpace.FindLocal("o").Field(1).Int(), int64(2))
+	// redeclaring a type identically is fine
+	assert.NoError(t, mch.Run(`type pair struct {
+	a, b int
+}`))
+	assert.NoError(t, mch.Run(`type List[T any] []T
+var l List[int] = []int{1}`))
+	assert.NoError(t, mch.Run(`type ints []int
+type moreInts List[int]
+func count() int {
+	type local []int
+	var xs local = []int{1, 2}
+	return len(xs) + len(ints{3})
+}`))
+	assert.NoError(t, mch.Run(`n := len(l) + count()`))
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), 4)
+
+	// types defined in the same input are distinct to the type checker
+	err := mch.Run(`type kelvin float64
+var k kelvin = 1
+var f float64 = k`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "code", te.Code, MismatchedTypes)
+	}
+
+	assert.NoError(t, mch.Run(`func Opaque[T ~int](x T) T {
+	return x
+}`))
+	assert.NotEquals(t, "~ of a named type", mch.Run(`func Bad[T ~color.Alpha](x T) T {
+	return x
+}
+b := Bad(color.Alpha{})`), nil)
+}
+
+func TestGenericFunc(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func Map[T, U any](xs []T, f func(T) U) []U {
+	ys := make([]U, 0, len(xs))
+	for _, x := range xs {
+		ys = append(ys, f(x))
+	}
+	return ys
+}`))
+	assert.NoError(t, mch.Run(`ss := Map([]int{1, 2, 3}, func(i int) string {
+	return fmt.Sprint(i * 2)
+})`))
+	assert.StringEquals(t, "ss", mch.GlobalNameSpace.FindLocal("ss").Interface(), []string{"2", "4", "6"})
+
+	// explicit instantiation
+	assert.NoError(t, mch.Run(`toStr := Map[float64, string]
+fs := toStr([]float64{1.5}, func(f float64) string {
+	return fmt.Sprint(f)
+})`))
+	assert.StringEquals(t, "fs", mch.GlobalNameSpace.FindLocal("fs").Interface(), []string{"1.5"})
+
+	// partial instantiation
+	assert.NoError(t, mch.Run(`bs := Map[int]([]int{0, 1}, func(i int) bool {
+	return i > 0
+})`))
+	assert.StringEquals(t, "bs", mch.GlobalNameSpace.FindLocal("bs").Interface(), []bool{false, true})
+
+	assert.NoError(t, mch.Run(`func Zero[T any]() T {
+	var z T
+	return z
+}`))
+	assert.NotEquals(t, "err", mch.Run(`z := Zero()`), nil)
+}
+
+func TestGenericConstraint(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`func Sum[T ~int | ~float64](xs ...T) T {
+	var s T
+	for _, x := range xs {
+		s += x
+	}
+	return s
+}`))
+	assert.NoError(t, mch.Run(`a := Sum(1, 2, 3)
+b := Sum(2, 1.5)`))
+	assert.Equals(t, "a", mch.GlobalNameSpace.FindLocal("a").Interface(), 6)
+	assert.Equals(t, "b", mch.GlobalNameSpace.FindLocal("b").Interface(), 3.5)
+	assert.NotEquals(t, "err", mch.Run(`c := Sum("a", "b")`), nil)
+
+	assert.NoError(t, mch.Run(`type Number interface {
+	~int | ~int64 | ~float64
+}
+func Max[T Number](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}`))
+	assert.NoError(t, mch.Run(`var i, j int64 = 3, 7
+m := Max(i, j)`))
+	assert.Equals(t, "m", mch.GlobalNameSpace.FindLocal("m").Interface(), int64(7))
+	assert.NotEquals(t, "err", mch.Run(`n := Max[string]("a", "b")`), nil)
+
+	assert.NoError(t, mch.Run(`func Keys[K comparable, V any](m map[K]V) []K {
+	ks := []K{}
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}`))
+	assert.NoError(t, mch.Run(`ks := Keys(map[string]int{"a": 1})`))
+	assert.StringEquals(t, "ks", mch.GlobalNameSpace.FindLocal("ks").Interface(), []string{"a"})
+	assert.NotEquals(t, "err", mch.Run(`ms := Keys[[]int, int](nil)`), nil)
+
+	assert.NoError(t, mch.Run(`func Str[T fmt.Stringer](v T) string {
+	return v.String()
+}`))
+	assert.NoError(t, mch.Run(`o := sample.NewOuter()
+s := Str(o)`))
+	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), "name:outer")
+	assert.NotEquals(t, "err", mch.Run(`s = Str(1)`), nil)
+}
+
+func TestGenericType(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+p := Pair[string, int]{Key: "a", Val: 1}
+k, v := p.Key, p.Val`))
+	assert.Equals(t, "k", mch.GlobalNameSpace.FindLocal("k").Interface(), "a")
+	assert.Equals(t, "v", mch.GlobalNameSpace.FindLocal("v").Interface(), 1)
+
+	assert.NoError(t, mch.Run(`func MakePair[K comparable, V any](k K, v V) Pair[K, V] {
+	return Pair[K, V]{k, v}
+}`))
+	assert.NoError(t, mch.Run(`q := MakePair("a", 1)
+same := p == q`))
+	assert.Equals(t, "same", mch.GlobalNameSpace.FindLocal("same").Interface(), true)
+
+	assert.NotEquals(t, "err", mch.Run(`var r Pair`), nil)
+	assert.NotEquals(t, "err", mch.Run(`var r Pair[[]int, int]`), nil)
+}
+
+func TestGenericInstances(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`a := slices.Contains([]int{1, 2}, 2)
+b := slices.Contains([]string{"x"}, "y")`))
+	assert.Equals(t, "a", mch.GlobalNameSpace.FindLocal("a").Interface(), true)
+	assert.Equals(t, "b", mch.GlobalNameSpace.FindLocal("b").Interface(), false)
+	assert.NotEquals(t, "err", mch.Run(`c := slices.Contains([]float64{1}, 1.0)`), nil)
+}
@@ -0,0 +1,88 @@
+package gsvm
+
+import (
+	"go/token"
+	"math"
+	"reflect"
+	"sync/atomic"
+)
+
+// tick counts a step, an iteration of a loop or a call of a function of the
+// machine, and returns an error if the input running is canceled or has run
+// out of steps. Functions declared may be called by goroutines, so steps are
+// counted atomically.
+func (mch *machine) tick() error {
+	limits := mch.limits.Load()
+	steps := atomic.AddInt64(&limits.steps, 1)
+	if max := mch.Options.MaxSteps; max > 0 && steps > max {
+		return stepLimitErr(max)
+	}
+	select {
+	case <-limits.limitCtx.Done():
+	default:
+		return nil
+	}
+
+	if err := limits.ctx.Err(); err != nil {
+		return canceledErr(err)
+	}
+	return timeLimitErr(mch.Options.MaxDuration, limits.limitCtx.Err())
+}
+
+// alloc accounts n bytes allocated by the input running, and returns an
+// error if the total exceeds Options.MaxAlloc. Only the allocations the
+// machine makes for the input are accounted, e.g. by make, append, composite
+// literals and string concatenation, but not the ones of native functions
+// called, and memory freed is not subtracted.
+func (mch *machine) alloc(n int64) error {
+	max := mch.Options.MaxAlloc
+	if max <= 0 {
+		return nil
+	}
+	if n > max || atomic.AddInt64(&mch.limits.Load().allocated, n) > max {
+		return memoryLimitErr(max)
+	}
+	return nil
+}
+
+// allocElems accounts an allocation of n elements of type tp.
+func (mch *machine) allocElems(tp reflect.Type, n int) error {
+	return mch.allocN(int64(tp.Size()), n)
+}
+
+// allocMap accounts an allocation of a map of type tp with n entries.
+func (mch *machine) allocMap(tp reflect.Type, n int) error {
+	return mch.allocN(int64(tp.Key().Size()+tp.Elem().Size()), n)
+}
+
+// setMapIndex sets the entry of key of the map m to vl, accounting an entry
+// of m if key is new.
+func (mch *machine) setMapIndex(m, key, vl reflect.Value) error {
+	if mch.Options.MaxAlloc > 0 && !m.MapIndex(key).IsValid() {
+		if err := mch.allocMap(m.Type(), 1); err != nil {
+			return err
+		}
+	}
+	m.SetMapIndex(key, vl)
+	return nil
+}
+
+// allocN accounts an allocation of n elements of size bytes each.
+func (mch *machine) allocN(size int64, n int) error {
+	if mch.Options.MaxAlloc <= 0 || n <= 0 || size == 0 {
+		return nil
+	}
+	if int64(n) > math.MaxInt64/size {
+		return memoryLimitErr(mch.Options.MaxAlloc)
+	}
+	return mch.alloc(int64(n) * size)
+}
+
+// allocConcat accounts the string x + y of a binary or assignment operation
+// op, if it is a concatenation.
+func (mch *machine) allocConcat(op token.Token, x, y reflect.Value) error {
+	if op != token.ADD && op != token.ADD_ASSIGN || x.Kind() != reflect.String || y.Kind() != reflect.String {
+		return nil
+	}
+	return mch.alloc(int64(x.Len()) + int64(y.Len()))
+}
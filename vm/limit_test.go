@@ -0,0 +1,187 @@
+package gsvm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestRunContext(t *testing.T) {
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachine()
+		mch.walkOnly = walkOnly
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		err := mch.RunContext(ctx, `n := 0
+for {
+	n++
+}`)
+		var re *RuntimeError
+		if assert.True(t, "RuntimeError", errors.As(err, &re)) {
+			assert.Equals(t, "code", re.Code, Canceled)
+			assert.Equals(t, "pos", re.Pos.String(), "input:2:1")
+		}
+		assert.True(t, "context.Canceled", errors.Is(err, context.Canceled))
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		assert.NoError(t, mch.Run(`func spin() { for i := 0; ; i++ {} }`))
+		err = mch.RunContext(ctx, `spin()`)
+		cancel()
+		assert.True(t, "context.DeadlineExceeded", errors.Is(err, context.DeadlineExceeded))
+
+		// the machine runs on
+		assert.NoError(t, mch.Run(`m := 1`))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	mch := newMachineWithOptions(Options{MaxSteps: 1000})
+	err := mch.Run(`n := 0; for { n++ }`)
+	var re *RuntimeError
+	if assert.True(t, "RuntimeError", errors.As(err, &re)) {
+		assert.Equals(t, "code", re.Code, LimitExceeded)
+	}
+	assert.True(t, "ErrStepLimit", errors.Is(err, ErrStepLimit))
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), 1000)
+
+	assert.NoError(t, mch.Run(`func down(n int) int { return down(n + 1) }`))
+	err = mch.Run(`down(0)`)
+	assert.True(t, "ErrStepLimit", errors.Is(err, ErrStepLimit))
+
+	// steps are counted for each input
+	assert.NoError(t, mch.Run(`for i := 0; i < 900; i++ {}`))
+	assert.NoError(t, mch.Run(`for i := 0; i < 900; i++ {}`))
+
+	mch = newMachineWithOptions(Options{MaxDuration: 10 * time.Millisecond})
+	err = mch.Run(`for {}`)
+	if assert.True(t, "RuntimeError", errors.As(err, &re)) {
+		assert.Equals(t, "code", re.Code, LimitExceeded)
+		assert.Equals(t, "error", re.Msg, "execution time limit exceeded (10ms)")
+	}
+	assert.True(t, "context.DeadlineExceeded", errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestMemoryLimit(t *testing.T) {
+	cases := []string{
+		`b := make([]byte, 1099511627776)`,
+		`s := []int{}
+for {
+	s = append(s, 1)
+}`,
+		`str := "x"
+for {
+	str += str
+}`,
+		`t := ""
+for i := 0; ; i++ {
+	u := t + "abcdefgh"
+	t = u
+}`,
+		`for {
+	p := []int{1, 2, 3}
+	p[0] = 4
+}`,
+		`for {
+	m := map[string]int{"a": 1}
+	m["b"] = 2
+}`,
+	}
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachineWithOptions(Options{MaxAlloc: 1 << 16})
+		mch.walkOnly = walkOnly
+		for _, src := range cases {
+			err := mch.Run(src)
+			var re *RuntimeError
+			if assert.True(t, src, errors.As(err, &re)) {
+				assert.Equals(t, src, re.Code, ResourceExhausted)
+			}
+			assert.True(t, src, errors.Is(err, ErrMemoryLimit))
+		}
+
+		// allocations are accounted for each input
+		assert.NoError(t, mch.Run(`x := make([]int64, 1000)`))
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, mch.Run(`x = make([]int64, 1000)`))
+		}
+	}
+}
+
+func TestMemoryLimitLargeMake(t *testing.T) {
+	mch := newMachineWithOptions(Options{MaxAlloc: 1 << 20})
+
+	// Shifts of untyped constants, e.g. 1<<40, are not supported by the
+	// interpreter, so the sizes are written as literals.
+	cases := []string{
+		// 1<<40
+		`b := make([]byte, 1099511627776)`,
+		// 1<<40 elements of 8 bytes
+		`i64 := make([]int64, 0, 1099511627776)`,
+		// overflows the bytes of int64, 1<<62 elements of 8 bytes
+		`o := make([]int64, 4611686018427387904)`,
+		`ch := make(chan string, 1048576)`,
+		`n := 1099511627776
+bn := make([]byte, n)`,
+		`ms := []map[int64]int64{}
+for {
+	ms = append(ms, map[int64]int64{1: 1, 2: 2, 3: 3})
+}`,
+	}
+	for _, src := range cases {
+		err := mch.Run(src)
+		assert.True(t, src, errors.Is(err, ErrMemoryLimit))
+	}
+	assert.NoError(t, mch.Run(`ok := make([]byte, 524288)`))
+}
+
+func TestMemoryLimitMapInserts(t *testing.T) {
+	cases := []string{
+		`m := map[int]int{}
+for i := 0; ; i++ {
+	m[i] = i
+}`,
+		`m2 := map[int]string{}
+n := 0
+for i := 0; ; i++ {
+	m2[i], n = "x", i
+}`,
+	}
+	for _, walkOnly := range []bool{false, true} {
+		mch := newMachineWithOptions(Options{MaxAlloc: 100000})
+		mch.walkOnly = walkOnly
+		for _, src := range cases {
+			err := mch.Run(src)
+			assert.True(t, src, errors.Is(err, ErrMemoryLimit))
+		}
+
+		// entries replaced are not accounted
+		assert.NoError(t, mch.Run(`r := map[int]int{1: 0}
+for i := 0; i < 100000; i++ {
+	r[1] = i
+}`))
+	}
+}
+
+func TestLimitsOfGoroutines(t *testing.T) {
+	mch := newMachineWithOptions(Options{MaxSteps: 1e6})
+	done := make(chan struct{})
+	assert.NoError(t, mch.Define("spawn", func(f func()) {
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				f()
+			}
+		}()
+	}))
+
+	// a function of an input called by a goroutine while later inputs run
+	assert.NoError(t, mch.Run(`n := 0
+spawn(func() {})`))
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, mch.Run(`for i := 0; i < 10; i++ { n++ }`))
+	}
+	<-done
+}
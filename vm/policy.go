@@ -0,0 +1,111 @@
+package gsvm
+
+import (
+	"path"
+	"reflect"
+	"strings"
+)
+
+// Policy restricts the symbols of the packages of a PackageNameSpace which
+// can be accessed.
+//
+// A pattern is a glob of path.Match of an import path, e.g. "os/*", matching
+// all the symbols of the packages, or of an import path and a symbol joined
+// by a dot, e.g. "os.Remove*". A symbol matched by both Allow and Deny is
+// decided by the more specific pattern, i.e. one of symbols over one of
+// packages, and denied if they are as specific, so that
+//
+//	Deny: []string{"os"}, Allow: []string{"os.Getenv"}
+//
+// denies all of os but Getenv.
+type Policy struct {
+	Allow, Deny []string
+	// If true, symbols matched by no pattern are denied instead of allowed.
+	DenyByDefault bool
+	// Audit, if not nil, is called with each access denied.
+	Audit func(path, symbol string)
+}
+
+// Match levels of a pattern
+const (
+	noMatch = iota
+	packageMatch
+	symbolMatch
+)
+
+// matchPattern returns how pattern matches the symbol of the package
+// pkgPath. Import paths may have dots, e.g. gopkg.in/yaml.v3, so pattern is
+// tried being split at each dot.
+func matchPattern(pattern, pkgPath, symbol string) int {
+	if ok, _ := path.Match(pattern, pkgPath); ok {
+		return packageMatch
+	}
+	for i := strings.LastIndex(pattern, "/") + 1; i < len(pattern); i++ {
+		if pattern[i] != '.' {
+			continue
+		}
+		if ok, _ := path.Match(pattern[:i], pkgPath); !ok {
+			continue
+		}
+		if ok, _ := path.Match(pattern[i+1:], symbol); ok {
+			return symbolMatch
+		}
+	}
+	return noMatch
+}
+
+// bestMatch returns the most specific match of patterns.
+func bestMatch(patterns []string, pkgPath, symbol string) int {
+	best := noMatch
+	for _, pattern := range patterns {
+		if m := matchPattern(pattern, pkgPath, symbol); m > best {
+			best = m
+		}
+	}
+	return best
+}
+
+// Allowed returns true if symbol of the package pkgPath can be accessed.
+func (p *Policy) Allowed(pkgPath, symbol string) bool {
+	allow := bestMatch(p.Allow, pkgPath, symbol)
+	deny := bestMatch(p.Deny, pkgPath, symbol)
+	if allow == noMatch && deny == noMatch {
+		return !p.DenyByDefault
+	}
+	return allow > deny
+}
+
+// deniedSymbol is bound, in place of its value, to a symbol of a package the
+// policy denies access to.
+type deniedSymbol struct {
+	path, name string
+	policy     *Policy
+}
+
+var deniedSymbolType = reflect.TypeOf(deniedSymbol{})
+
+// filter returns pkg, of the import path pkgPath, with the symbols denied by
+// p bound to deniedSymbols.
+func (p *Policy) filter(pkgPath string, pkg Package) Package {
+	filtered := make(Package, len(pkg))
+	for name, vl := range pkg {
+		if !p.Allowed(pkgPath, name) {
+			vl = reflect.ValueOf(deniedSymbol{path: pkgPath, name: name, policy: p})
+		}
+		filtered[name] = vl
+	}
+	return filtered
+}
+
+// checkAccess returns an error, which is audited, if vl is bound to a symbol
+// denied.
+func checkAccess(vl reflect.Value) error {
+	if !vl.IsValid() || vl.Type() != deniedSymbolType {
+		return nil
+	}
+	d := vl.Interface().(deniedSymbol)
+	if d.policy.Audit != nil {
+		d.policy.Audit(d.path, d.name)
+	}
+	return accessDeniedErr(d.path, d.name)
+}
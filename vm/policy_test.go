@@ -0,0 +1,91 @@
+package gsvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p := &Policy{
+		Allow: []string{"os.Getenv", "gopkg.in/yaml.v3.Marshal"},
+		Deny:  []string{"os", "os/*", "net/http.Get*", "gopkg.in/yaml.v3"},
+	}
+	cases := []struct {
+		path, symbol string
+		allowed      bool
+	}{
+		{"fmt", "Println", true},
+		{"os", "RemoveAll", false},
+		{"os", "Getenv", true},
+		{"os/exec", "Command", false},
+		{"net/http", "Get", false},
+		{"net/http", "Post", true},
+		{"gopkg.in/yaml.v3", "Marshal", true},
+		{"gopkg.in/yaml.v3", "Unmarshal", false},
+	}
+	for _, c := range cases {
+		assert.Equals(t, c.path+"."+c.symbol, p.Allowed(c.path, c.symbol), c.allowed)
+	}
+
+	p = &Policy{Allow: []string{"fmt", "strings.*"}, Deny: []string{"fmt.Sprint"}, DenyByDefault: true}
+	assert.True(t, "fmt.Println", p.Allowed("fmt", "Println"))
+	assert.False(t, "fmt.Sprint", p.Allowed("fmt", "Sprint"))
+	assert.True(t, "strings.Split", p.Allowed("strings", "Split"))
+	assert.False(t, "os.Getenv", p.Allowed("os", "Getenv"))
+}
+
+func TestPolicyDenied(t *testing.T) {
+	var audited []string
+	ns := &PackageNameSpace{
+		Packages: map[string]Package{
+			"fmt": Package{
+				"Sprint": reflect.ValueOf(fmt.Sprint),
+			},
+			"os": Package{
+				"Getenv":    reflect.ValueOf(os.Getenv),
+				"RemoveAll": reflect.ValueOf(os.RemoveAll),
+				"File":      PtrToTypeValue((*os.File)(nil)),
+			},
+			"": Package{
+				"Sqrt": reflect.ValueOf(math.Sqrt),
+				"Sin":  reflect.ValueOf(math.Sin),
+			},
+		},
+		Paths: map[string]string{"": "math"},
+		Policy: &Policy{
+			Deny: []string{"os.Remove*", "os.File", "math.Sin"},
+			Audit: func(path, symbol string) {
+				audited = append(audited, path+"."+symbol)
+			},
+		},
+	}
+	mch := New(ns).(*machine)
+
+	assert.NoError(t, mch.Run(`s := fmt.Sprint(Sqrt(4)); e := os.Getenv("HOME")`))
+	for _, src := range []string{
+		`os.RemoveAll("/tmp/x")`,
+		`f := os.RemoveAll`,
+		`var f *os.File`,
+		`x := Sin(1)`,
+		`for i := 0; i < 2; i++ { os.RemoveAll("/tmp/x") }`,
+	} {
+		err := mch.Run(src)
+		var re *RuntimeError
+		if assert.True(t, src, errors.As(err, &re)) {
+			assert.Equals(t, src, re.Code, AccessDenied)
+			assert.True(t, src, strings.Contains(re.Msg, "access denied: "))
+		}
+		assert.True(t, src, errors.Is(err, ErrAccessDenied))
+	}
+	assert.Equals(t, "audited", audited, []string{"os.RemoveAll", "os.RemoveAll", "os.File", "math.Sin", "os.RemoveAll"})
+
+	_, candidates := mch.Complete("os.")
+	assert.Equals(t, "candidates", candidates, []string{"Getenv"})
+}
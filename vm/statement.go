@@ -1,7 +1,6 @@
 package gsvm
 
 import (
-	"fmt"
 	"go/ast"
 	"go/token"
 	"log"
@@ -29,7 +28,7 @@ func (e BranchErr) Error() string {
 }
 
 func assignTo(v reflect.Value, vl reflect.Value) error {
-	if v.Type() != vl.Type() {
+	if !vl.Type().AssignableTo(v.Type()) {
 		return cannotUseAsInAssignmentErr(vl, v.Type())
 	}
 	v.Set(vl)
@@ -54,7 +53,411 @@ func fillSingleValues(dst []reflect.Value, src reflect.Value) {
 	}
 }
 
+func isBlankIdent(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == "_"
+}
+
+// assignToExpr assigns vl to the variable, field, element or map entry
+// specified by l.
+func (mch *machine) assignToExpr(ns NameSpace, l ast.Expr, vl reflect.Value) error {
+	v, err := checkSingleValue(mch.evalExpr(ns, l))
+	if err != nil {
+		return err
+	}
+
+	if v.Type() == MapIndexValueType {
+		v := v.Interface().(MapIndexValue)
+		vl = matchDestType(vl, v.X.Type().Elem())
+		if !vl.Type().AssignableTo(v.X.Type().Elem()) {
+			return cannotUseAsInAssignmentErr(vl, v.X.Type().Elem())
+		}
+		return mch.setMapIndex(v.X, v.Key, vl)
+	}
+	if !v.CanSet() {
+		return cannotAssignToErr(l)
+	}
+	vl = matchDestType(vl, v.Type())
+	if !vl.Type().AssignableTo(v.Type()) {
+		return cannotUseAsInAssignmentErr(vl, v.Type())
+	}
+	v.Set(vl)
+	return nil
+}
+
+// definedIdents returns the names of non-blank variables declared by st if it
+// is a short variable declaration.
+func definedIdents(st ast.Stmt) []string {
+	as, ok := st.(*ast.AssignStmt)
+	if !ok || as.Tok != token.DEFINE {
+		return nil
+	}
+	var names []string
+	for _, l := range as.Lhs {
+		if ident, ok := l.(*ast.Ident); ok && ident.Name != "_" {
+			names = append(names, ident.Name)
+		}
+	}
+	return names
+}
+
+// copyLocals adds to dst a new variable for each of names, initialized with
+// the value of the local variable of the same name in src. Returns dst.
+func copyLocals(dst, src NameSpace, names []string) NameSpace {
+	for _, name := range names {
+		old := src.FindLocal(name)
+		if old == NoValue {
+			continue
+		}
+		v := reflect.New(old.Type()).Elem()
+		v.Set(old)
+		dst.AddLocal(name, v)
+	}
+	return dst
+}
+
+// declareType defines a type, a generic type or a constraint in ns. Named
+// types can not be created with reflect, so a type defined is bound to its
+// underlying type: its values are of the underlying type, e.g. as shown by %T,
+// and are assignable to and from values of the underlying type and of other
+// types defined identically, as unnamed types are in Go. The type checker sees
+// a type defined in the same input as a distinct type.
+func (mch *machine) declareType(ns NameSpace, spec *ast.TypeSpec) error {
+	name := spec.Name.Name
+	if spec.TypeParams != nil {
+		ns.AddLocal(name, reflect.ValueOf(GenericType{Spec: spec, NS: ns}))
+		return nil
+	}
+	if isConstraintInterface(spec.Type) {
+		ns.AddLocal(name, reflect.ValueOf(Constraint{Expr: spec.Type, NS: ns}))
+		return nil
+	}
+
+	tp, err := mch.evalType(ns, spec.Type)
+	if err != nil {
+		return err
+	}
+	ns.AddLocal(name, reflect.ValueOf(TypeValue{tp}))
+	return nil
+}
+
+// declareFunc defines a function or a generic function in ns.
+func (mch *machine) declareFunc(ns NameSpace, decl *ast.FuncDecl) error {
+	name := decl.Name.Name
+	if decl.Recv != nil {
+		return methodsNotSupportedErr(name)
+	}
+	if decl.Type.TypeParams != nil {
+		ns.AddLocal(name, reflect.ValueOf(GenericFunc{Decl: decl, NS: ns}))
+		return nil
+	}
+
+	tp, err := mch.evalType(ns, decl.Type)
+	if err != nil {
+		return err
+	}
+	ns.AddLocal(name, mch.makeFunc(ns, tp, decl.Type, decl.Body))
+	return nil
+}
+
+// opAssign runs v op= delta, where tok is the assignment operator, e.g.
+// token.ADD_ASSIGN.
+func opAssign(tok token.Token, v, delta reflect.Value) error {
+	delta = matchDestType(delta, v.Type())
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch tok {
+		case token.ADD_ASSIGN:
+			v.SetInt(v.Int() + delta.Int())
+		case token.SUB_ASSIGN:
+			v.SetInt(v.Int() - delta.Int())
+		case token.MUL_ASSIGN:
+			v.SetInt(v.Int() * delta.Int())
+		case token.QUO_ASSIGN:
+			v.SetInt(v.Int() / delta.Int())
+		case token.REM_ASSIGN:
+			v.SetInt(v.Int() % delta.Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch tok {
+		case token.ADD_ASSIGN:
+			v.SetUint(v.Uint() + delta.Uint())
+		case token.SUB_ASSIGN:
+			v.SetUint(v.Uint() - delta.Uint())
+		case token.MUL_ASSIGN:
+			v.SetUint(v.Uint() * delta.Uint())
+		case token.QUO_ASSIGN:
+			v.SetUint(v.Uint() / delta.Uint())
+		case token.REM_ASSIGN:
+			v.SetUint(v.Uint() % delta.Uint())
+		}
+	case reflect.Float32, reflect.Float64:
+		switch tok {
+		case token.ADD_ASSIGN:
+			v.SetFloat(v.Float() + delta.Float())
+		case token.SUB_ASSIGN:
+			v.SetFloat(v.Float() - delta.Float())
+		case token.MUL_ASSIGN:
+			v.SetFloat(v.Float() * delta.Float())
+		case token.QUO_ASSIGN:
+			v.SetFloat(v.Float() / delta.Float())
+		case token.REM_ASSIGN:
+			return invalidOperationErr(tok.String(), v.Type())
+		}
+	case reflect.Complex64, reflect.Complex128:
+		switch tok {
+		case token.ADD_ASSIGN:
+			v.SetComplex(v.Complex() + delta.Complex())
+		case token.SUB_ASSIGN:
+			v.SetComplex(v.Complex() - delta.Complex())
+		case token.MUL_ASSIGN:
+			v.SetComplex(v.Complex() * delta.Complex())
+		case token.QUO_ASSIGN:
+			v.SetComplex(v.Complex() / delta.Complex())
+		case token.REM_ASSIGN:
+			return invalidOperationErr(tok.String(), v.Type())
+		}
+	case reflect.String:
+		switch tok {
+		case token.ADD_ASSIGN:
+			v.SetString(v.String() + delta.String())
+		default:
+			return invalidOperationErr(tok.String(), v.Type())
+		}
+	default:
+		return invalidOperationErr(tok.String(), v.Type())
+	}
+	return nil
+}
+
+// incDec runs x++ or x--, where tok is token.INC or token.DEC.
+func incDec(tok token.Token, x reflect.Value) error {
+	switch x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if tok == token.INC {
+			x.SetInt(x.Int() + 1)
+		} else {
+			x.SetInt(x.Int() - 1)
+		}
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if tok == token.INC {
+			x.SetUint(x.Uint() + 1)
+		} else {
+			x.SetUint(x.Uint() - 1)
+		}
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		if tok == token.INC {
+			x.SetFloat(x.Float() + 1)
+		} else {
+			x.SetFloat(x.Float() - 1)
+		}
+		return nil
+
+	case reflect.Complex64, reflect.Complex128:
+		if tok == token.INC {
+			x.SetComplex(x.Complex() + 1)
+		} else {
+			x.SetComplex(x.Complex() - 1)
+		}
+		return nil
+
+	default:
+		return invalidOperationErr(tok.String(), x.Type())
+	}
+}
+
+// runLoopBody runs the body of a for/range statement. cont is false if the
+// loop should stop, in which case err is the error to return, if any.
+func (mch *machine) runLoopBody(ns NameSpace, body *ast.BlockStmt) (cont bool, err error) {
+	if err := mch.tick(); err != nil {
+		return false, err
+	}
+	switch err := mch.runStatement(ns, body); err {
+	case nil, beContinue:
+		return true, nil
+	case beBreak:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// rangeClause returns x, the value of the range clause of st, to range over,
+// and the types of the iteration values.
+func rangeClause(st *ast.RangeStmt, x reflect.Value) (reflect.Value, reflect.Type, reflect.Type, error) {
+	x = matchDestType(x, x.Type())
+	if x.Kind() == reflect.Ptr && x.Type().Elem().Kind() == reflect.Array {
+		x = x.Elem()
+	}
+
+	keyTp, valueTp, err := rangeTypes(st.X, x)
+	if err != nil {
+		return NoValue, nil, nil, err
+	}
+	if st.Key != nil && keyTp == nil {
+		return NoValue, nil, nil, rangePermitsOnlyErr(st.X, x.Type(), 0)
+	}
+	if st.Value != nil && valueTp == nil {
+		return NoValue, nil, nil, rangePermitsOnlyErr(st.X, x.Type(), 1)
+	}
+	return x, keyTp, valueTp, nil
+}
+
+// rangeTypes returns the types of the iteration values of a range clause over
+// x. A nil type means the corresponding iteration variable is not permitted.
+func rangeTypes(expr ast.Expr, x reflect.Value) (keyTp, valueTp reflect.Type, err error) {
+	switch x.Kind() {
+	case reflect.Slice, reflect.Array:
+		return intType, x.Type().Elem(), nil
+	case reflect.Map:
+		return x.Type().Key(), x.Type().Elem(), nil
+	case reflect.String:
+		return intType, runeType, nil
+	case reflect.Chan:
+		if x.Type().ChanDir()&reflect.RecvDir == 0 {
+			return nil, nil, cannotRangeOverSendOnlyErr(expr, x.Type())
+		}
+		return x.Type().Elem(), nil, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return removeBasicLit(x).Type(), nil, nil
+	case reflect.Func:
+		yieldTp, ok := yieldFuncType(x.Type())
+		if !ok {
+			break
+		}
+		if yieldTp.NumIn() > 0 {
+			keyTp = yieldTp.In(0)
+		}
+		if yieldTp.NumIn() > 1 {
+			valueTp = yieldTp.In(1)
+		}
+		return keyTp, valueTp, nil
+	}
+	return nil, nil, cannotRangeOverErr(expr, x.Type())
+}
+
+// yieldFuncType returns the type of the yield function if tp is a range
+// function type such as func(yield func(K, V) bool).
+func yieldFuncType(tp reflect.Type) (reflect.Type, bool) {
+	if tp.NumIn() != 1 || tp.NumOut() != 0 || tp.IsVariadic() {
+		return nil, false
+	}
+	yieldTp := tp.In(0)
+	if yieldTp.Kind() != reflect.Func || yieldTp.NumIn() > 2 || yieldTp.IsVariadic() ||
+		yieldTp.NumOut() != 1 || yieldTp.Out(0).Kind() != reflect.Bool {
+		return nil, false
+	}
+	return yieldTp, true
+}
+
+// rangeOver calls body with each pair of iteration values of x until body
+// returns false. Values not produced by x are passed as NoValue.
+func (mch *machine) rangeOver(x reflect.Value, body func(k, v reflect.Value) (bool, error)) error {
+	switch x.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < x.Len(); i++ {
+			if cont, err := body(reflect.ValueOf(i), x.Index(i)); !cont {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, mKey := range x.MapKeys() {
+			mValue := x.MapIndex(mKey)
+			if !mValue.IsValid() {
+				// deleted during the iteration
+				continue
+			}
+			if cont, err := body(mKey, mValue); !cont {
+				return err
+			}
+		}
+
+	case reflect.String:
+		for i, r := range x.String() {
+			if cont, err := body(reflect.ValueOf(i), reflect.ValueOf(r)); !cont {
+				return err
+			}
+		}
+
+	case reflect.Chan:
+		for {
+			v, ok := x.Recv()
+			if !ok {
+				break
+			}
+			if cont, err := body(v, NoValue); !cont {
+				return err
+			}
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for i := int64(0); i < x.Int(); i++ {
+			if cont, err := body(reflect.ValueOf(i).Convert(x.Type()), NoValue); !cont {
+				return err
+			}
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		for i := uint64(0); i < x.Uint(); i++ {
+			if cont, err := body(reflect.ValueOf(i).Convert(x.Type()), NoValue); !cont {
+				return err
+			}
+		}
+
+	case reflect.Func:
+		yieldTp, _ := yieldFuncType(x.Type())
+		var bodyErr error
+		done := false
+		yield := reflect.MakeFunc(yieldTp, func(args []reflect.Value) []reflect.Value {
+			if done {
+				panic(rangeFuncContinuedErr)
+			}
+			k, v := NoValue, NoValue
+			if len(args) > 0 {
+				k = args[0]
+			}
+			if len(args) > 1 {
+				v = args[1]
+			}
+			var cont bool
+			cont, bodyErr = body(k, v)
+			done = !cont
+			return []reflect.Value{reflect.ValueOf(cont).Convert(yieldTp.Out(0))}
+		})
+		_, err := callValue(x, []reflect.Value{yield})
+		done = true
+		if err != nil {
+			return err
+		}
+		return bodyErr
+	}
+	return nil
+}
+
+// runStatement runs st. Errors are reported at the position of the innermost
+// statement or expression failed. Panics are not recovered here, but once for
+// the function or the input running, see walkFrame, which reports them as a
+// PanicError at the innermost statement.
 func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
+	fr := frameOf(ns)
+	if fr == nil {
+		return mch.atPos(st, mch.runStatementNode(ns, st))
+	}
+	// Not restored if st panics, so that the innermost statement is kept.
+	upper := fr.cur
+	fr.cur = st
+	err := mch.runStatementNode(ns, st)
+	fr.cur = upper
+	return mch.atPos(st, err)
+}
+
+func (mch *machine) runStatementNode(ns NameSpace, st ast.Stmt) error {
 	switch st := st.(type) {
 	case *ast.AssignStmt:
 		var rVs []reflect.Value
@@ -181,23 +584,25 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 				if v.Type() == MapIndexValueType {
 					v := v.Interface().(MapIndexValue)
 					values[i] = matchDestType(values[i], v.X.Type().Elem())
-					v.X.SetMapIndex(v.Key, values[i])
+					if err := mch.setMapIndex(v.X, v.Key, values[i]); err != nil {
+						return err
+					}
 					continue
 				}
 				if !v.CanSet() {
 					return cannotAssignToErr(l)
 				}
 				values[i] = matchDestType(values[i], v.Type())
-				if values[i].Type() != v.Type() {
+				if !values[i].Type().AssignableTo(v.Type()) {
 					if len(st.Rhs) == len(st.Lhs) {
 						return cannotUseAsTypeInErr(st.Rhs[i], values[i].Type(), v.Type(), "assignment")
 					}
+					return cannotUseAsInAssignmentErr(values[i], v.Type())
 				}
 				/*				m := map[string]int{}
 								var j string
 								var k int
 								j, k = m["abc"] */
-				fmt.Println(values[i].Type(), v.Type())
 				v.Set(values[i])
 			}
 
@@ -217,72 +622,10 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 			if err != nil {
 				return err
 			}
-			delta = matchDestType(delta, v.Type())
-			var newV interface{}
-			switch v.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				switch st.Tok {
-				case token.ADD_ASSIGN:
-					newV = v.Int() + delta.Int()
-				case token.SUB_ASSIGN:
-					newV = v.Int() - delta.Int()
-				case token.MUL_ASSIGN:
-					newV = v.Int() * delta.Int()
-				case token.QUO_ASSIGN:
-					newV = v.Int() / delta.Int()
-				case token.REM_ASSIGN:
-					newV = v.Int() % delta.Int()
-				}
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				switch st.Tok {
-				case token.ADD_ASSIGN:
-					newV = v.Uint() + delta.Uint()
-				case token.SUB_ASSIGN:
-					newV = v.Uint() - delta.Uint()
-				case token.MUL_ASSIGN:
-					newV = v.Uint() * delta.Uint()
-				case token.QUO_ASSIGN:
-					newV = v.Uint() / delta.Uint()
-				case token.REM_ASSIGN:
-					newV = v.Uint() % delta.Uint()
-				}
-			case reflect.Float32, reflect.Float64:
-				switch st.Tok {
-				case token.ADD_ASSIGN:
-					newV = v.Float() + delta.Float()
-				case token.SUB_ASSIGN:
-					newV = v.Float() - delta.Float()
-				case token.MUL_ASSIGN:
-					newV = v.Float() * delta.Float()
-				case token.QUO_ASSIGN:
-					newV = v.Float() / delta.Float()
-				case token.REM_ASSIGN:
-					return invalidOperationErr(st.Tok.String(), v.Type())
-				}
-			case reflect.Complex64, reflect.Complex128:
-				switch st.Tok {
-				case token.ADD_ASSIGN:
-					newV = v.Complex() + delta.Complex()
-				case token.SUB_ASSIGN:
-					newV = v.Complex() - delta.Complex()
-				case token.MUL_ASSIGN:
-					newV = v.Complex() * delta.Complex()
-				case token.QUO_ASSIGN:
-					newV = v.Complex() / delta.Complex()
-				case token.REM_ASSIGN:
-					return invalidOperationErr(st.Tok.String(), v.Type())
-				}
-			case reflect.String:
-				switch st.Tok {
-				case token.ADD_ASSIGN:
-					newV = v.String() + delta.String()
-				default:
-					return invalidOperationErr(st.Tok.String(), v.Type())
-				}
-			default:
-				return invalidOperationErr(st.Tok.String(), v.Type())
+			if err := mch.allocConcat(st.Tok, v, delta); err != nil {
+				return err
 			}
-			v.Set(reflect.ValueOf(newV).Convert(v.Type()))
+			return opAssign(st.Tok, v, delta)
 		}
 		return nil
 
@@ -293,6 +636,14 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 	case *ast.DeclStmt:
 		switch decl := st.Decl.(type) {
 		case *ast.GenDecl:
+			if decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					if err := mch.declareType(ns, spec.(*ast.TypeSpec)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
 			for _, spec := range decl.Specs {
 				isConst := decl.Tok == token.CONST
 				spec := spec.(*ast.ValueSpec)
@@ -312,11 +663,11 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 						values[i] = value
 					}
 				} else if spec.Type == nil {
-					return fmt.Errorf("Need type")
+					return typeErr(InvalidOperation, "Need type")
 				}
 
 				if values != nil && len(spec.Names) != len(values) {
-					return fmt.Errorf("assignment count mismatch: %d = %d", len(spec.Names), len(values))
+					return typeErr(WrongArgumentCount, "assignment count mismatch: %d = %d", len(spec.Names), len(values))
 				}
 
 				for i, name := range spec.Names {
@@ -359,9 +710,7 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 			return nil
 
 		case *ast.FuncDecl:
-			// TODO
-			ast.Print(token.NewFileSet(), decl)
-			return nil
+			return mch.declareFunc(ns, decl)
 		}
 
 	case *ast.BlockStmt:
@@ -374,11 +723,17 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 		return nil
 
 	case *ast.ForStmt:
+		if ok, err := mch.runCompiled(ns, st); ok {
+			return err
+		}
 		blkNs := ns
 		if st.Init != nil {
 			blkNs = ns.NewBlock()
-			mch.runStatement(blkNs, st.Init)
+			if err := mch.runStatement(blkNs, st.Init); err != nil {
+				return err
+			}
 		}
+		loopVars := definedIdents(st.Init)
 
 		for {
 			cond := true
@@ -397,14 +752,15 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 				break
 			}
 
-			if err := mch.runStatement(blkNs, st.Body); err != nil {
-				if brk, ok := err.(BranchErr); ok {
-					if brk == beBreak {
-						break
-					}
-				} else {
-					return err
-				}
+			if cont, err := mch.runLoopBody(blkNs, st.Body); !cont {
+				return err
+			}
+
+			if len(loopVars) > 0 {
+				// Each iteration has its own copy of the variables declared
+				// by the init statement, initialized with the values at the
+				// end of the previous iteration, before the post statement.
+				blkNs = copyLocals(ns.NewBlock(), blkNs, loopVars)
 			}
 
 			if st.Post != nil {
@@ -416,135 +772,95 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 		return nil
 
 	case *ast.RangeStmt:
+		if ok, err := mch.runCompiled(ns, st); ok {
+			return err
+		}
 		x, err := checkSingleValue(mch.evalExpr(ns, st.X))
 		if err != nil {
 			return err
 		}
-		x = removeBasicLit(x)
-
-		hasKey := st.Key != nil
-		if hasKey {
-			ident, ok := st.Key.(*ast.Ident)
-			if ok && ident.Name == "_" {
-				hasKey = false
-			}
-		}
-		hasValue := st.Value != nil
-		if hasValue {
-			ident, ok := st.Value.(*ast.Ident)
-			if ok && ident.Name == "_" {
-				hasValue = false
-			}
+		x, keyTp, valueTp, err := rangeClause(st, x)
+		if err != nil {
+			return err
 		}
 
-		blkNs := ns
-		if st.Tok == token.DEFINE && (hasKey || hasValue) {
-			blkNs = ns.NewBlock()
-		}
+		hasKey := st.Key != nil && !isBlankIdent(st.Key)
+		hasValue := st.Value != nil && !isBlankIdent(st.Value)
 
-		switch x.Kind() {
-		case reflect.Slice:
-			var key, value reflect.Value
-			if st.Tok == token.DEFINE {
+		err = mch.rangeOver(x, func(k, v reflect.Value) (bool, error) {
+			blkNs := ns
+			if st.Tok == token.DEFINE && (hasKey || hasValue) {
+				// Each iteration has its own iteration variables.
+				blkNs = ns.NewBlock()
 				if hasKey {
-					ident := st.Key.(*ast.Ident)
-					key = reflect.New(intType).Elem()
-					blkNs.AddLocal(ident.Name, key)
+					key := reflect.New(keyTp).Elem()
+					key.Set(matchDestType(k, keyTp))
+					blkNs.AddLocal(st.Key.(*ast.Ident).Name, key)
 				}
 				if hasValue {
-					ident := st.Value.(*ast.Ident)
-					value = reflect.New(x.Type().Elem()).Elem()
-					blkNs.AddLocal(ident.Name, value)
+					value := reflect.New(valueTp).Elem()
+					value.Set(v)
+					blkNs.AddLocal(st.Value.(*ast.Ident).Name, value)
 				}
 			} else if st.Tok == token.ASSIGN {
-				return villa.Error("Not implemented!")
-			}
-			for i := 0; i < x.Len(); i++ {
 				if hasKey {
-					key.SetInt(int64(i))
+					if err := mch.assignToExpr(blkNs, st.Key, k); err != nil {
+						return false, err
+					}
 				}
 				if hasValue {
-					value.Set(x.Index(i))
-				}
-				if st.Body != nil {
-					if err := mch.runStatement(blkNs, st.Body); err != nil {
-						return err
+					if err := mch.assignToExpr(blkNs, st.Value, v); err != nil {
+						return false, err
 					}
 				}
 			}
-			return nil
+			return mch.runLoopBody(blkNs, st.Body)
+		})
+		// A panic of the body of a range function is recovered by callValue,
+		// without the position of the statement panicked.
+		return mch.atPos(panicStmt(frameOf(ns), st), err)
 
-		case reflect.Map:
-			var key, value reflect.Value
-			if st.Tok == token.DEFINE {
-				if hasKey {
-					ident := st.Key.(*ast.Ident)
-					key = reflect.New(x.Type().Key()).Elem()
-					blkNs.AddLocal(ident.Name, key)
-				}
-				if hasValue {
-					ident := st.Value.(*ast.Ident)
-					value = reflect.New(x.Type().Elem()).Elem()
-					blkNs.AddLocal(ident.Name, value)
-				}
-			} else if st.Tok == token.ASSIGN {
-				return villa.Error("Not implemented!")
+	case *ast.ReturnStmt:
+		var results []reflect.Value
+		if vl := ns.Find(resultsVarName); vl != NoValue {
+			results = vl.Interface().([]reflect.Value)
+		}
+
+		var values []reflect.Value
+		if len(st.Results) == 1 {
+			var err error
+			if values, err = mch.evalExpr(ns, st.Results[0]); err != nil {
+				return err
 			}
-			for _, mKey := range x.MapKeys() {
-				mValue := x.MapIndex(mKey)
-				if !mValue.IsValid() {
-					continue
-				}
-				if hasKey {
-					key.Set(mKey)
-				}
-				if hasValue {
-					value.Set(mValue)
-				}
-				if st.Body != nil {
-					if err := mch.runStatement(blkNs, st.Body); err != nil {
-						return err
-					}
+		} else {
+			values = make([]reflect.Value, len(st.Results))
+			for i, r := range st.Results {
+				vl, err := checkSingleValue(mch.evalExpr(ns, r))
+				if err != nil {
+					return err
 				}
+				values[i] = vl
 			}
-			return nil
-
-		case reflect.String:
-			var key, value reflect.Value
-			if st.Tok == token.DEFINE {
-				if hasKey {
-					ident := st.Key.(*ast.Ident)
-					key = reflect.New(intType).Elem()
-					blkNs.AddLocal(ident.Name, key)
-				}
-				if hasValue {
-					ident := st.Value.(*ast.Ident)
-					value = reflect.New(runeType).Elem()
-					blkNs.AddLocal(ident.Name, value)
-				}
-			} else if st.Tok == token.ASSIGN {
-				return villa.Error("Not implemented!")
+		}
+		if len(st.Results) > 0 {
+			if len(values) < len(results) {
+				return notEnoughArgumentsToReturnErr
 			}
-			for i, r := range x.String() {
-				if hasKey {
-					key.SetInt(int64(i))
-				}
-				if hasValue {
-					value.SetInt(int64(r))
-				}
-				if st.Body != nil {
-					if err := mch.runStatement(blkNs, st.Body); err != nil {
-						return err
-					}
-				}
+			if len(values) > len(results) {
+				return tooManyArgumentsToReturnErr
 			}
-			return nil
+		}
 
-		default:
-			return cannotRangeOverErr(st.X, x.Type())
+		for i, vl := range values {
+			res := results[i]
+			vl = matchDestType(vl, res.Type())
+			if !vl.Type().AssignableTo(res.Type()) {
+				return cannotUseAsInReturnErr(vl, res.Type())
+			}
+			res.Set(vl)
 		}
+		return beReturn
 
-		return villa.Error("RangeStmt")
 	case *ast.BranchStmt:
 		if st.Tok == token.BREAK {
 			return beBreak
@@ -565,7 +881,7 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 		}
 
 		if cnd.Kind() != reflect.Bool {
-			return nonBoolAsConditionErr(cnd, "for")
+			return nonBoolAsConditionErr(cnd, "if")
 		}
 
 		if cnd.Bool() {
@@ -591,42 +907,7 @@ func (mch *machine) runStatement(ns NameSpace, st ast.Stmt) error {
 			return cannotAssignToErr(st.X)
 		}
 
-		switch x.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			if st.Tok == token.INC {
-				x.SetInt(x.Int() + 1)
-			} else {
-				x.SetInt(x.Int() - 1)
-			}
-			return nil
-
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			if st.Tok == token.INC {
-				x.SetUint(x.Uint() + 1)
-			} else {
-				x.SetUint(x.Uint() - 1)
-			}
-			return nil
-
-		case reflect.Float32, reflect.Float64:
-			if st.Tok == token.INC {
-				x.SetFloat(x.Float() + 1)
-			} else {
-				x.SetFloat(x.Float() - 1)
-			}
-			return nil
-
-		case reflect.Complex64, reflect.Complex128:
-			if st.Tok == token.INC {
-				x.SetComplex(x.Complex() + 1)
-			} else {
-				x.SetComplex(x.Complex() - 1)
-			}
-			return nil
-
-		default:
-			return invalidOperationErr(st.Tok.String(), x.Type())
-		}
+		return incDec(st.Tok, x)
 
 	case *ast.SwitchStmt:
 		blkNs := ns
@@ -1,6 +1,7 @@
 package gsvm
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"testing"
@@ -139,6 +140,155 @@ for i, c := range "go" {
 	assert.Equals(t, "sum", mch.GlobalNameSpace.FindLocal("sum").Interface(), 215)
 }
 
+func TestRangeAssign(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`var k string
+var v int
+kvs := map[string]int{"a": 1}
+for k, v = range kvs {
+}`))
+	assert.Equals(t, "k", mch.GlobalNameSpace.FindLocal("k").Interface(), "a")
+	assert.Equals(t, "v", mch.GlobalNameSpace.FindLocal("v").Interface(), 1)
+
+	assert.NotEquals(t, "err", mch.Run(`for v, k = range kvs {
+}`), nil)
+
+	assert.NoError(t, mch.Run(`s := []int{0, 0, 0}
+var i int
+for i, s[i] = range []int{4, 5, 6} {
+}`))
+	assert.StringEquals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), []int{4, 5, 6})
+	assert.Equals(t, "i", mch.GlobalNameSpace.FindLocal("i").Interface(), 2)
+}
+
+func TestRangeBranch(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`sum := 0
+for _, v := range []int{1, 2, 3, 4, 5} {
+	if v == 2 {
+		continue
+	}
+	if v == 4 {
+		break
+	}
+	sum += v
+}`))
+	assert.Equals(t, "sum", mch.GlobalNameSpace.FindLocal("sum").Interface(), 4)
+}
+
+func TestRangeChan(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`sum, n := 0, 0
+for v := range sample.Chan(4) {
+	sum += v
+}
+for range sample.Chan(3) {
+	n++
+}`))
+	assert.Equals(t, "sum", mch.GlobalNameSpace.FindLocal("sum").Interface(), 6)
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), 3)
+
+	assert.NotEquals(t, "err", mch.Run(`for i, v := range sample.Chan(1) {
+}`), nil)
+}
+
+func TestRangeInt(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`sum := 0
+for i := range 10 {
+	sum += i
+}
+var n int64 = 3
+var j int64
+for j = range n {
+}`))
+	assert.Equals(t, "sum", mch.GlobalNameSpace.FindLocal("sum").Interface(), 45)
+	assert.Equals(t, "j", mch.GlobalNameSpace.FindLocal("j").Interface(), int64(2))
+}
+
+func TestRangeFunc(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`s := ""
+for i, v := range sample.Pairs("a", "b", "c") {
+	if i == 2 {
+		break
+	}
+	s += v
+}`))
+	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), "ab")
+
+	assert.NoError(t, mch.Run(`seq := func(yield func(int) bool) {
+	for i := 1; i <= 5; i++ {
+		if !yield(i) {
+			return
+		}
+	}
+}
+sum := 0
+for v := range seq {
+	if v > 3 {
+		break
+	}
+	sum += v
+}`))
+	assert.Equals(t, "sum", mch.GlobalNameSpace.FindLocal("sum").Interface(), 6)
+}
+
+func TestLoopVarPerIteration(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`fs := []func() int{}
+for i := 0; i < 3; i++ {
+	fs = append(fs, func() int {
+		return i
+	})
+}
+a, b, c := fs[0](), fs[1](), fs[2]()`))
+	assert.Equals(t, "a", mch.GlobalNameSpace.FindLocal("a").Interface(), 0)
+	assert.Equals(t, "b", mch.GlobalNameSpace.FindLocal("b").Interface(), 1)
+	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), 2)
+
+	// Changes in the body are seen by the next iteration.
+	assert.NoError(t, mch.Run(`n := 0
+for i := 0; i < 10; i++ {
+	i++
+	n++
+}`))
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), 5)
+
+	assert.NoError(t, mch.Run(`gs := []func() string{}
+for k, v := range []string{"x", "y"} {
+	gs = append(gs, func() string {
+		return fmt.Sprint(k, v)
+	})
+}
+d, e := gs[0](), gs[1]()`))
+	assert.Equals(t, "d", mch.GlobalNameSpace.FindLocal("d").Interface(), "0x")
+	assert.Equals(t, "e", mch.GlobalNameSpace.FindLocal("e").Interface(), "1y")
+}
+
+func TestFuncLitReturn(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`add := func(a, b int) int {
+	return a + b
+}
+divmod := func(a, b int) (q, r int) {
+	q, r = a/b, a%b
+	return
+}
+c := add(1, 2)
+q, r := divmod(7, 2)`))
+	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), 3)
+	assert.Equals(t, "q", mch.GlobalNameSpace.FindLocal("q").Interface(), 3)
+	assert.Equals(t, "r", mch.GlobalNameSpace.FindLocal("r").Interface(), 1)
+}
+
 func TestMultiReturnFuncCall(t *testing.T) {
 	mch := newMachine()
 
@@ -152,3 +302,36 @@ func TestMultiReturnFuncCall(t *testing.T) {
 	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), s)
 	assert.Equals(t, "c", mch.GlobalNameSpace.FindLocal("c").Interface(), c)
 }
+
+func TestMixedDeclsAndStatements(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`s := greet("bob")
+func greet(s string) string {
+	return "hello " + s
+}
+n := twice(len(s))
+func twice(n int) int { return n * 2 }; f := func(x int) int { return twice(x) }
+m := f(n)`))
+	assert.Equals(t, "s", mch.GlobalNameSpace.FindLocal("s").Interface(), "hello bob")
+	assert.Equals(t, "n", mch.GlobalNameSpace.FindLocal("n").Interface(), 18)
+	assert.Equals(t, "m", mch.GlobalNameSpace.FindLocal("m").Interface(), 36)
+
+	// positions are of the input
+	err := mch.Run(`x := 1
+func h() int {
+	return "a"
+}`)
+	var te *TypeError
+	if assert.True(t, "TypeError", errors.As(err, &te)) {
+		assert.Equals(t, "pos", te.Pos.String(), "input:3:9")
+	}
+
+	assert.Equals(t, "fragment", mch.Run(`y := 1
+func g() {`), FragmentErr)
+	assert.Equals(t, "fragment", mch.Run(`func g() {}
+for {`), FragmentErr)
+	_, ok := mch.Run(`z := 1
+func (t T) M() {}`).(*SyntaxError)
+	assert.Equals(t, "method", ok, true)
+}
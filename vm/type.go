@@ -1,9 +1,12 @@
 package gsvm
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
+	"math/big"
 	"reflect"
+	"strconv"
 
 	"github.com/daviddengcn/go-villa"
 )
@@ -14,12 +17,18 @@ type complexLiteral complex128
 type runeLiteral rune
 type stringLiteral string
 
+// An untyped integer constant out of the range of int64, e.g. math.MaxUint64.
+type bigIntLiteral struct {
+	*big.Int
+}
+
 var (
 	intLiteralType     = reflect.TypeOf(intLiteral(0))
 	floatLiteralType   = reflect.TypeOf(floatLiteral(0))
 	complexLiteralType = reflect.TypeOf(complexLiteral(0))
 	runeLiteralType    = reflect.TypeOf(runeLiteral(0))
 	stringLiteralType  = reflect.TypeOf(stringLiteral(""))
+	bigIntLiteralType  = reflect.TypeOf(bigIntLiteral{})
 )
 
 func removeBasicLit(vl reflect.Value) reflect.Value {
@@ -37,11 +46,35 @@ func removeBasicLit(vl reflect.Value) reflect.Value {
 	case MapIndexValueType:
 		vl := vl.Interface().(MapIndexValue)
 		return removeBasicLit(vl.X.MapIndex(vl.Key))
+	case ConstValueType:
+		return removeBasicLit(vl.Field(0).Interface().(reflect.Value))
 	}
 
 	return vl
 }
 
+// convert converts lit to tp if it is representable by tp.
+func (lit bigIntLiteral) convert(tp reflect.Type) (reflect.Value, bool) {
+	vl := reflect.New(tp).Elem()
+	switch tp.Kind() {
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		if !lit.IsUint64() {
+			return vl, false
+		}
+		vl.SetUint(lit.Uint64())
+		return vl, vl.Uint() == lit.Uint64()
+	case reflect.Float32, reflect.Float64:
+		f, _ := new(big.Float).SetInt(lit.Int).Float64()
+		vl.SetFloat(f)
+		return vl, true
+	case reflect.Complex64, reflect.Complex128:
+		f, _ := new(big.Float).SetInt(lit.Int).Float64()
+		vl.SetComplex(complex(f, 0))
+		return vl, true
+	}
+	return vl, false
+}
+
 var (
 	intAssignableTo = [...]bool{
 		reflect.Int:     true,
@@ -70,6 +103,12 @@ var (
 )
 
 func matchType(x, y reflect.Value) (nX, nY reflect.Value, err error) {
+	if x.Type() == ConstValueType {
+		x = x.Field(0).Interface().(reflect.Value)
+	}
+	if y.Type() == ConstValueType {
+		y = y.Field(0).Interface().(reflect.Value)
+	}
 	if x.Type() == y.Type() {
 		return x, y, nil
 	}
@@ -109,6 +148,13 @@ func matchDestType(vl reflect.Value, dstTp reflect.Type) reflect.Value {
 		return vl
 	}
 
+	if vl.Type() == bigIntLiteralType {
+		if cv, ok := vl.Interface().(bigIntLiteral).convert(dstTp); ok {
+			return cv
+		}
+		return vl
+	}
+
 	canConvert := false
 	switch vl.Type() {
 	case intLiteralType, runeLiteralType:
@@ -184,12 +230,17 @@ func literalAssignConvert(v reflect.Value, dstTp reflect.Type) (reflect.Value, e
 
 var (
 	intType       = reflect.TypeOf(int(0))
+	boolType      = reflect.TypeOf(false)
 	runeType      = reflect.TypeOf(rune(0))
+	float64Type   = reflect.TypeOf(float64(0))
+	stringType    = reflect.TypeOf("")
 	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
 )
 
 var (
 	basicTypes = map[string]reflect.Type{
+		"any":        interfaceType,
+		"bool":       reflect.TypeOf(false),
 		"int":        intType,
 		"int8":       reflect.TypeOf(int8(0)),
 		"int16":      reflect.TypeOf(int16(0)),
@@ -222,6 +273,46 @@ func ToConstant(vl reflect.Value) reflect.Value {
 	return reflect.ValueOf(ConstValue{vl})
 }
 
+// UntypedConstant returns an untyped constant declared in a package, e.g.
+// math.MaxUint64, which is kept untyped in the VM. kind is one of "bool",
+// "int", "rune", "float", "complex" and "string", and lit is the value as a
+// Go literal.
+func UntypedConstant(kind, lit string) reflect.Value {
+	var vl reflect.Value
+	switch kind {
+	case "bool":
+		if b, err := strconv.ParseBool(lit); err == nil {
+			vl = reflect.ValueOf(b)
+		}
+	case "int", "rune":
+		if i, err := strconv.ParseInt(lit, 0, 64); err == nil {
+			if kind == "rune" {
+				vl = reflect.ValueOf(runeLiteral(i))
+			} else {
+				vl = reflect.ValueOf(intLiteral(i))
+			}
+		} else if bi, ok := new(big.Int).SetString(lit, 0); ok {
+			vl = reflect.ValueOf(bigIntLiteral{bi})
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(lit, 64); err == nil {
+			vl = reflect.ValueOf(floatLiteral(f))
+		}
+	case "complex":
+		if c, err := strconv.ParseComplex(lit, 128); err == nil {
+			vl = reflect.ValueOf(complexLiteral(c))
+		}
+	case "string":
+		if s, err := strconv.Unquote(lit); err == nil {
+			vl = reflect.ValueOf(stringLiteral(s))
+		}
+	}
+	if !vl.IsValid() {
+		panic(fmt.Sprintf("invalid untyped %s constant %s", kind, lit))
+	}
+	return ToConstant(vl)
+}
+
 // Holding a type value
 type TypeValue struct {
 	reflect.Type
@@ -233,6 +324,16 @@ func PtrToTypeValue(ptr interface{}) reflect.Value {
 
 var TypeValueType = reflect.TypeOf(TypeValue{})
 
+// Holding pre-instantiated variants of a generic function of a compiled
+// package. A call resolves to the first variant accepting the arguments.
+type Instances []reflect.Value
+
+var InstancesType = reflect.TypeOf(Instances(nil))
+
+func NewInstances(fns ...reflect.Value) reflect.Value {
+	return reflect.ValueOf(Instances(fns))
+}
+
 type MapIndexValue struct {
 	// a map Value
 	X reflect.Value
@@ -250,6 +351,75 @@ var chanDir = map[ast.ChanDir]reflect.ChanDir{
 
 var NakedFuncType = reflect.TypeOf(func() {})
 
+// The PkgPath of unexported fields of struct types declared in the
+// interpreter. Such fields are accessible as in the same package.
+const localPkgPath = "gsvm.local"
+
+func structField(name string, tp reflect.Type, tag reflect.StructTag, embedded bool) reflect.StructField {
+	fld := reflect.StructField{
+		Name:      name,
+		Type:      tp,
+		Tag:       tag,
+		Anonymous: embedded,
+	}
+	if !ast.IsExported(name) {
+		fld.PkgPath = localPkgPath
+	}
+	return fld
+}
+
+// embeddedFieldName returns the field name of an embedded field of type expr.
+func embeddedFieldName(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name
+	case *ast.StarExpr:
+		return embeddedFieldName(expr.X)
+	case *ast.SelectorExpr:
+		return expr.Sel.Name
+	case *ast.IndexExpr:
+		return embeddedFieldName(expr.X)
+	case *ast.IndexListExpr:
+		return embeddedFieldName(expr.X)
+	}
+	return ""
+}
+
+// structOf is similar to reflect.StructOf but returns an error instead of
+// panicking on unsupported fields.
+func structOf(flds []reflect.StructField) (tp reflect.Type, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = typeErr(NotSupported, "%v", r)
+		}
+	}()
+	return reflect.StructOf(flds), nil
+}
+
+// evalFieldTypes returns the types of a parameter or result list, one for each
+// name. variadic is true if the last parameter is of the form ...T.
+func (mch *machine) evalFieldTypes(ns NameSpace, fields *ast.FieldList) (tps []reflect.Type, variadic bool, err error) {
+	if fields == nil {
+		return nil, false, nil
+	}
+	for _, fld := range fields.List {
+		tp, err := mch.evalType(ns, fld.Type)
+		if err != nil {
+			return nil, false, err
+		}
+		_, variadic = fld.Type.(*ast.Ellipsis)
+
+		n := len(fld.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			tps = append(tps, tp)
+		}
+	}
+	return tps, variadic, nil
+}
+
 func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error) {
 	switch expr := expr.(type) {
 	case *ast.Ident:
@@ -258,7 +428,59 @@ func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error)
 			return tp, nil
 		}
 
+		if vl := ns.Find(expr.Name); vl != NoValue {
+			switch vl.Type() {
+			case TypeValueType:
+				return vl.Interface().(TypeValue).Type, nil
+			case GenericTypeType:
+				return nil, cannotUseGenericTypeWithoutInstantiationErr(expr.Name)
+			}
+			return nil, notATypeErr(expr.Name)
+		}
+
 		return nil, unknownTypeErr(expr.Name)
+
+	case *ast.ParenExpr:
+		return mch.evalType(ns, expr.X)
+
+	case *ast.StarExpr:
+		elTp, err := mch.evalType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elTp), nil
+
+	case *ast.StructType:
+		var flds []reflect.StructField
+		for _, f := range expr.Fields.List {
+			tp, err := mch.evalType(ns, f.Type)
+			if err != nil {
+				return nil, err
+			}
+			var tag reflect.StructTag
+			if f.Tag != nil {
+				s, _ := strconv.Unquote(f.Tag.Value)
+				tag = reflect.StructTag(s)
+			}
+
+			if len(f.Names) == 0 {
+				flds = append(flds, structField(embeddedFieldName(f.Type), tp, tag, true))
+			}
+			for _, name := range f.Names {
+				flds = append(flds, structField(name.Name, tp, tag, false))
+			}
+		}
+		return structOf(flds)
+
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		vl, err := checkSingleValue(mch.evalExpr(ns, expr))
+		if err != nil {
+			return nil, err
+		}
+		if vl.Type() != TypeValueType {
+			return nil, notATypeErr(exprToStr(expr))
+		}
+		return vl.Interface().(TypeValue).Type, nil
 	case *ast.ArrayType:
 		if expr.Len == nil {
 			elTp, err := mch.evalType(ns, expr.Elt)
@@ -268,7 +490,7 @@ func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error)
 			return reflect.SliceOf(elTp), nil
 		}
 		ast.Print(token.NewFileSet(), expr)
-		return nil, villa.Errorf("Wait for reflect.ArrayOf")
+		return nil, typeErr(NotSupported, "Wait for reflect.ArrayOf")
 
 	case *ast.SelectorExpr:
 		x, err := checkSingleValue(mch.evalExpr(ns, expr.X))
@@ -280,18 +502,21 @@ func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error)
 		case PackageType:
 			x := x.Interface().(Package)
 			if vl, ok := x[expr.Sel.Name]; ok {
+				if err := checkAccess(vl); err != nil {
+					return nil, err
+				}
 				if vl.Type() != TypeValueType {
 					return nil, notATypeErr(expr.Sel.Name)
 				}
 				return vl.Interface().(TypeValue).Type, nil
 			}
-			return nil, nil
+			return nil, undefinedErr(fmt.Sprintf("%v.%v", expr.X, expr.Sel.Name))
 		default:
 			ast.Print(token.NewFileSet(), expr)
-			return nil, villa.Errorf("Unknown type expr: SelectorExpr X: %v", x.Type())
+			return nil, typeErr(NotSupported, "Unknown type expr: SelectorExpr X: %v", x.Type())
 		}
 		ast.Print(token.NewFileSet(), expr)
-		return nil, villa.Errorf("Unknown type expr: %+v", expr)
+		return nil, typeErr(NotSupported, "Unknown type expr: %+v", expr)
 
 	case *ast.MapType:
 		keyTp, err := mch.evalType(ns, expr.Key)
@@ -312,8 +537,22 @@ func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error)
 			return NakedFuncType, nil
 		}
 
-		ast.Print(token.NewFileSet(), expr)
-		return nil, villa.Error("Waiting for reflect package to support reflect.FuncOf")
+		in, variadic, err := mch.evalFieldTypes(ns, expr.Params)
+		if err != nil {
+			return nil, err
+		}
+		out, _, err := mch.evalFieldTypes(ns, expr.Results)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.FuncOf(in, out, variadic), nil
+
+	case *ast.Ellipsis:
+		elTp, err := mch.evalType(ns, expr.Elt)
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elTp), nil
 
 	case *ast.ChanType:
 		vType, err := mch.evalType(ns, expr.Value)
@@ -331,6 +570,6 @@ func (mch *machine) evalType(ns NameSpace, expr ast.Expr) (reflect.Type, error)
 
 	default:
 		ast.Print(token.NewFileSet(), expr)
-		return nil, villa.Errorf("Unknown type expr: %+v", expr)
+		return nil, typeErr(NotSupported, "Unknown type expr: %+v", expr)
 	}
 }
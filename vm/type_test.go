@@ -3,24 +3,108 @@ package gsvm
 import (
 	"fmt"
 	"image/color"
+	"iter"
 	"math"
 	"reflect"
+	"slices"
 	"testing"
 
 	"github.com/daviddengcn/go-assert"
 )
 
+type sampleInner struct {
+	Name  string
+	count int
+}
+
+func (in *sampleInner) Inc() {
+	in.count++
+}
+
+func (in sampleInner) Count() int {
+	return in.count
+}
+
+type sampleName string
+
+func (n sampleName) String() string {
+	return "name:" + string(n)
+}
+
+type sampleOuter struct {
+	*sampleInner
+	fmt.Stringer
+	ID     int
+	secret string
+}
+
+func newSampleOuter() sampleOuter {
+	return sampleOuter{
+		sampleInner: &sampleInner{Name: "inner"},
+		Stringer:    sampleName("outer"),
+		ID:          1,
+		secret:      "xyz",
+	}
+}
+
+type sampleRefs struct {
+	inner *sampleInner
+	ints  []int
+	m     map[string]int
+	any   interface{}
+	self  *sampleRefs
+}
+
+var sampleRefsShared = newSampleRefs()
+
+func newSampleRefs() *sampleRefs {
+	r := &sampleRefs{
+		inner: &sampleInner{Name: "inner"},
+		ints:  []int{1, 2},
+		m:     map[string]int{"a": 1},
+		any:   &sampleInner{Name: "any"},
+	}
+	r.self = r
+	return r
+}
+
+func sampleChan(n int) chan int {
+	ch := make(chan int, n)
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	return ch
+}
+
+func samplePairs(strs ...string) iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		for i, s := range strs {
+			if !yield(i, s) {
+				return
+			}
+		}
+	}
+}
+
 func newMachine() *machine {
-	return New(&PackageNameSpace{Packages: map[string]Package{
+	return newMachineWithOptions(Options{})
+}
+
+func newMachineWithOptions(opts Options) *machine {
+	return NewWithOptions(&PackageNameSpace{Packages: map[string]Package{
 		"fmt": Package{
-			"Println": reflect.ValueOf(fmt.Println),
-			"Sprint":  reflect.ValueOf(fmt.Sprint),
-			"Printf":  reflect.ValueOf(fmt.Printf),
-			"Errorf":  reflect.ValueOf(fmt.Errorf),
+			"Println":  reflect.ValueOf(fmt.Println),
+			"Sprint":   reflect.ValueOf(fmt.Sprint),
+			"Printf":   reflect.ValueOf(fmt.Printf),
+			"Errorf":   reflect.ValueOf(fmt.Errorf),
+			"Stringer": PtrToTypeValue((*fmt.Stringer)(nil)),
 		},
 		"math": Package{
-			"Sin":    reflect.ValueOf(math.Sin),
-			"Sincos": reflect.ValueOf(math.Sincos),
+			"Sin":       reflect.ValueOf(math.Sin),
+			"Sincos":    reflect.ValueOf(math.Sincos),
+			"Pi":        UntypedConstant("float", "3.141592653589793"),
+			"MaxUint64": UntypedConstant("int", "18446744073709551615"),
 		},
 		"reflect": Package{
 			"ValueOf": reflect.ValueOf(reflect.ValueOf),
@@ -32,7 +116,19 @@ func newMachine() *machine {
 		"color": Package{
 			"Alpha": PtrToTypeValue((*color.Alpha)(nil)),
 		},
-	}}).(*machine)
+		"sample": Package{
+			"NewOuter": reflect.ValueOf(newSampleOuter),
+			"Refs":     reflect.ValueOf(&sampleRefsShared).Elem(),
+			"Inner":    PtrToTypeValue((*sampleInner)(nil)),
+			"Chan":     reflect.ValueOf(sampleChan),
+			"Pairs":    reflect.ValueOf(samplePairs),
+		},
+		"slices": Package{
+			"Contains": NewInstances(
+				reflect.ValueOf(slices.Contains[[]int, int]),
+				reflect.ValueOf(slices.Contains[[]string, string])),
+		},
+	}}, opts).(*machine)
 }
 
 func TestTypeLiteralConvert(t *testing.T) {
@@ -106,6 +202,28 @@ func TestTypeConversion(t *testing.T) {
 	}
 }
 
+func TestUntypedConstant(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`u := uint64(math.MaxUint64)`))
+	assert.NoError(t, mch.Run(`var f float32 = math.Pi`))
+	assert.NoError(t, mch.Run(`d := math.Pi * 2`))
+	assert.Error(t, mch.Run(`i := int(math.MaxUint64)`))
+
+	u := mch.GlobalNameSpace.FindLocal("u")
+	if assert.NotEquals(t, "u", u, NoValue) {
+		assert.Equals(t, "u", u.Interface(), uint64(math.MaxUint64))
+	}
+	f := mch.GlobalNameSpace.FindLocal("f")
+	if assert.NotEquals(t, "f", f, NoValue) {
+		assert.Equals(t, "f", f.Interface(), float32(math.Pi))
+	}
+	d := mch.GlobalNameSpace.FindLocal("d")
+	if assert.NotEquals(t, "d", d, NoValue) {
+		assert.Equals(t, "d", d.Interface(), 2*math.Pi)
+	}
+}
+
 func TestArrayType(t *testing.T) {
 	//	mch := newMachine()
 	//	assert.NoError(t, mch.Run(`var a [5]int`))
@@ -0,0 +1,482 @@
+package gsvm
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+)
+
+// Expressions of types int, float64, bool and string known when a loop is
+// compiled are compiled to functions returning the values unboxed. The type
+// of an expression is known if it is built of variables stored unboxed,
+// variables declared outside of the loop, whose types are checked each time
+// it starts, and untyped constants.
+
+type (
+	intCode    func(fr *frame) int
+	floatCode  func(fr *frame) float64
+	boolCode   func(fr *frame) bool
+	stringCode func(fr *frame) string
+)
+
+// assignOps maps assignment operators to their binary operators.
+var assignOps = map[token.Token]token.Token{
+	token.ADD_ASSIGN: token.ADD,
+	token.SUB_ASSIGN: token.SUB,
+	token.MUL_ASSIGN: token.MUL,
+	token.QUO_ASSIGN: token.QUO,
+	token.REM_ASSIGN: token.REM,
+}
+
+// isConstExpr returns true if expr consists of literals only.
+func isConstExpr(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.UnaryExpr:
+		return isConstExpr(expr.X)
+	case *ast.BinaryExpr:
+		return isConstExpr(expr.X) && isConstExpr(expr.Y)
+	}
+	return false
+}
+
+// constValue returns the value of a constant expression, converted to tp if
+// tp is not nil. ok is false if it is not a constant expression, or the value
+// can not be converted to tp.
+func (c *compiler) constValue(expr ast.Expr, tp reflect.Type) (vl reflect.Value, ok bool) {
+	if !isConstExpr(expr) {
+		return NoValue, false
+	}
+	vl, err := checkSingleValue(c.mch.evalExpr(c.ns, expr))
+	if err != nil || !isUntyped(vl.Type()) {
+		return NoValue, false
+	}
+	if tp == nil {
+		return vl, true
+	}
+	vl = matchDestType(vl, tp)
+	return vl, vl.Type() == tp
+}
+
+// varType returns the type of the variable name if it is stored unboxed, or
+// is declared outside of the loop with a type which can be, and nil
+// otherwise.
+func (c *compiler) varType(name string) reflect.Type {
+	slot, ok := c.lookup(name)
+	if !ok {
+		return nil
+	}
+	switch slot.kind {
+	case intSlot:
+		return intType
+	case floatSlot:
+		return float64Type
+	case boolSlot:
+		return boolType
+	case stringSlot:
+		return stringType
+	}
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if _, ok := c.scopes[i][name]; ok {
+			// a boxed variable declared in the loop
+			return nil
+		}
+	}
+	if tp := c.code.freeTps[c.free[name]]; slotKindOf(tp) != valueSlot {
+		return tp
+	}
+	return nil
+}
+
+// typedAs returns true if expr has type tp, or is a constant expression
+// convertible to it.
+func (c *compiler) typedAs(expr ast.Expr, tp reflect.Type) bool {
+	if c.staticType(expr) == tp {
+		return true
+	}
+	_, ok := c.constValue(expr, tp)
+	return ok
+}
+
+// operandType returns the type of the operands of a binary operation, if
+// both have, or are constants convertible to, the type of the other one.
+func (c *compiler) operandType(x, y ast.Expr) reflect.Type {
+	if tp := c.staticType(x); tp != nil && c.typedAs(y, tp) {
+		return tp
+	}
+	if tp := c.staticType(y); tp != nil && c.typedAs(x, tp) {
+		return tp
+	}
+	return nil
+}
+
+// staticType returns the type of expr if it is int, float64, bool or string
+// and known when compiled, and nil otherwise. Constant expressions have no
+// type known.
+func (c *compiler) staticType(expr ast.Expr) reflect.Type {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		if vl := keywordValue(expr.Name); vl != NoValue {
+			return vl.Type()
+		}
+		return c.varType(expr.Name)
+
+	case *ast.UnaryExpr:
+		tp := c.staticType(expr.X)
+		switch {
+		case expr.Op == token.NOT && tp == boolType,
+			(expr.Op == token.SUB || expr.Op == token.ADD) && (tp == intType || tp == float64Type):
+			return tp
+		}
+
+	case *ast.BinaryExpr:
+		switch expr.Op {
+		case token.LAND, token.LOR:
+			if c.operandType(expr.X, expr.Y) == boolType {
+				return boolType
+			}
+
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			switch tp := c.operandType(expr.X, expr.Y); tp {
+			case intType, float64Type, stringType:
+				return boolType
+			case boolType:
+				if expr.Op == token.EQL || expr.Op == token.NEQ {
+					return boolType
+				}
+			}
+
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+			tp := c.operandType(expr.X, expr.Y)
+			switch {
+			case tp == intType,
+				tp == float64Type && expr.Op != token.REM,
+				tp == stringType && expr.Op == token.ADD:
+				return tp
+			}
+		}
+
+	case *ast.CallExpr:
+		// a conversion between int and float64
+		ident, ok := expr.Fun.(*ast.Ident)
+		if !ok || len(expr.Args) != 1 || c.isVar(ident.Name) {
+			break
+		}
+		switch tp := basicTypes[ident.Name]; tp {
+		case intType, float64Type:
+			if argTp := c.staticType(expr.Args[0]); argTp == intType || argTp == float64Type {
+				return tp
+			}
+		}
+	}
+	return nil
+}
+
+// typed compiles expr to an exprCode boxing the value computed unboxed, or
+// returns nil if expr has no static type. Variables are not compiled here
+// since they are referred to as addressable values.
+func (c *compiler) typed(expr ast.Expr) exprCode {
+	switch expr.(type) {
+	case *ast.UnaryExpr, *ast.BinaryExpr, *ast.CallExpr:
+	default:
+		return nil
+	}
+	switch c.staticType(expr) {
+	case intType:
+		code := c.intExpr(expr)
+		return func(fr *frame) (reflect.Value, error) {
+			return reflect.ValueOf(code(fr)), nil
+		}
+	case float64Type:
+		code := c.floatExpr(expr)
+		return func(fr *frame) (reflect.Value, error) {
+			return reflect.ValueOf(code(fr)), nil
+		}
+	case boolType:
+		code := c.boolExpr(expr)
+		return func(fr *frame) (reflect.Value, error) {
+			return reflect.ValueOf(code(fr)), nil
+		}
+	case stringType:
+		code := c.stringExpr(expr)
+		return func(fr *frame) (reflect.Value, error) {
+			return reflect.ValueOf(code(fr)), nil
+		}
+	}
+	return nil
+}
+
+// arith returns the code of x op y for an arithmetic operator op other than
+// %.
+func arith[T int | float64](op token.Token, x, y func(fr *frame) T) func(fr *frame) T {
+	switch op {
+	case token.ADD:
+		return func(fr *frame) T { return x(fr) + y(fr) }
+	case token.SUB:
+		return func(fr *frame) T { return x(fr) - y(fr) }
+	case token.MUL:
+		return func(fr *frame) T { return x(fr) * y(fr) }
+	}
+	return func(fr *frame) T { return x(fr) / y(fr) }
+}
+
+// comparison returns the code of x op y for a comparison operator op.
+func comparison[T int | float64 | string](op token.Token, x, y func(fr *frame) T) boolCode {
+	switch op {
+	case token.EQL:
+		return func(fr *frame) bool { return x(fr) == y(fr) }
+	case token.NEQ:
+		return func(fr *frame) bool { return x(fr) != y(fr) }
+	case token.LSS:
+		return func(fr *frame) bool { return x(fr) < y(fr) }
+	case token.LEQ:
+		return func(fr *frame) bool { return x(fr) <= y(fr) }
+	case token.GTR:
+		return func(fr *frame) bool { return x(fr) > y(fr) }
+	}
+	return func(fr *frame) bool { return x(fr) >= y(fr) }
+}
+
+// intExpr compiles expr, which is typed as int.
+func (c *compiler) intExpr(expr ast.Expr) intCode {
+	if vl, ok := c.constValue(expr, intType); ok {
+		v := int(vl.Int())
+		return func(*frame) int { return v }
+	}
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		slot, _ := c.lookup(expr.Name)
+		if slot.kind == intSlot {
+			return func(fr *frame) int { return fr.ints[slot.idx] }
+		}
+		return func(fr *frame) int { return int(fr.slots[slot.idx].Int()) }
+
+	case *ast.UnaryExpr:
+		x := c.intExpr(expr.X)
+		if expr.Op == token.SUB {
+			return func(fr *frame) int { return -x(fr) }
+		}
+		return x
+
+	case *ast.BinaryExpr:
+		x, y := c.intExpr(expr.X), c.intExpr(expr.Y)
+		if expr.Op == token.REM {
+			return func(fr *frame) int { return x(fr) % y(fr) }
+		}
+		return arith(expr.Op, x, y)
+
+	case *ast.CallExpr:
+		if c.staticType(expr.Args[0]) == float64Type {
+			x := c.floatExpr(expr.Args[0])
+			return func(fr *frame) int { return int(x(fr)) }
+		}
+		return c.intExpr(expr.Args[0])
+	}
+	panic("not an int expression")
+}
+
+// floatExpr compiles expr, which is typed as float64.
+func (c *compiler) floatExpr(expr ast.Expr) floatCode {
+	if vl, ok := c.constValue(expr, float64Type); ok {
+		v := vl.Float()
+		return func(*frame) float64 { return v }
+	}
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		slot, _ := c.lookup(expr.Name)
+		if slot.kind == floatSlot {
+			return func(fr *frame) float64 { return fr.floats[slot.idx] }
+		}
+		return func(fr *frame) float64 { return fr.slots[slot.idx].Float() }
+
+	case *ast.UnaryExpr:
+		x := c.floatExpr(expr.X)
+		if expr.Op == token.SUB {
+			return func(fr *frame) float64 { return -x(fr) }
+		}
+		return x
+
+	case *ast.BinaryExpr:
+		return arith(expr.Op, c.floatExpr(expr.X), c.floatExpr(expr.Y))
+
+	case *ast.CallExpr:
+		if c.staticType(expr.Args[0]) == intType {
+			x := c.intExpr(expr.Args[0])
+			return func(fr *frame) float64 { return float64(x(fr)) }
+		}
+		return c.floatExpr(expr.Args[0])
+	}
+	panic("not a float64 expression")
+}
+
+// boolExpr compiles expr, which is typed as bool.
+func (c *compiler) boolExpr(expr ast.Expr) boolCode {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		if vl := keywordValue(expr.Name); vl != NoValue {
+			v := vl.Bool()
+			return func(*frame) bool { return v }
+		}
+		slot, _ := c.lookup(expr.Name)
+		if slot.kind == boolSlot {
+			return func(fr *frame) bool { return fr.bools[slot.idx] }
+		}
+		return func(fr *frame) bool { return fr.slots[slot.idx].Bool() }
+
+	case *ast.UnaryExpr:
+		x := c.boolExpr(expr.X)
+		return func(fr *frame) bool { return !x(fr) }
+
+	case *ast.BinaryExpr:
+		switch c.operandType(expr.X, expr.Y) {
+		case intType:
+			return comparison(expr.Op, c.intExpr(expr.X), c.intExpr(expr.Y))
+		case float64Type:
+			return comparison(expr.Op, c.floatExpr(expr.X), c.floatExpr(expr.Y))
+		case stringType:
+			return comparison(expr.Op, c.stringExpr(expr.X), c.stringExpr(expr.Y))
+		}
+		x, y := c.boolExpr(expr.X), c.boolExpr(expr.Y)
+		switch expr.Op {
+		case token.LAND:
+			return func(fr *frame) bool { return x(fr) && y(fr) }
+		case token.LOR:
+			return func(fr *frame) bool { return x(fr) || y(fr) }
+		case token.EQL:
+			return func(fr *frame) bool { return x(fr) == y(fr) }
+		}
+		return func(fr *frame) bool { return x(fr) != y(fr) }
+	}
+	panic("not a bool expression")
+}
+
+// stringExpr compiles expr, which is typed as string.
+func (c *compiler) stringExpr(expr ast.Expr) stringCode {
+	if vl, ok := c.constValue(expr, stringType); ok {
+		v := vl.String()
+		return func(*frame) string { return v }
+	}
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		slot, _ := c.lookup(expr.Name)
+		if slot.kind == stringSlot {
+			return func(fr *frame) string { return fr.strs[slot.idx] }
+		}
+		return func(fr *frame) string { return fr.slots[slot.idx].String() }
+
+	case *ast.BinaryExpr:
+		x, y := c.stringExpr(expr.X), c.stringExpr(expr.Y)
+		return func(fr *frame) string {
+			sx, sy := x(fr), y(fr)
+			if err := c.mch.alloc(int64(len(sx)) + int64(len(sy))); err != nil {
+				// recovered by runCompiled
+				panic(err)
+			}
+			return sx + sy
+		}
+	}
+	panic("not a string expression")
+}
+
+// defaultType returns the type of a variable declared with the value of
+// expr, if it is known and can be stored unboxed, or nil.
+func (c *compiler) defaultType(expr ast.Expr) reflect.Type {
+	if vl, ok := c.constValue(expr, nil); ok {
+		if tp := removeBasicLit(vl).Type(); slotKindOf(tp) != valueSlot {
+			return tp
+		}
+		return nil
+	}
+	return c.staticType(expr)
+}
+
+// typedDefine compiles a short variable declaration of a single variable
+// stored unboxed, or returns nil if it can not be.
+func (c *compiler) typedDefine(st *ast.AssignStmt) stmtCode {
+	if c.captures || len(st.Lhs) != 1 || len(st.Rhs) != 1 {
+		return nil
+	}
+	ident, ok := st.Lhs[0].(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	if _, ok := c.scopes[len(c.scopes)-1][ident.Name]; ok {
+		return nil
+	}
+	tp := c.defaultType(st.Rhs[0])
+	if tp == nil {
+		return nil
+	}
+	// The right hand side is compiled before the variable is declared.
+	set := c.typedSetter(tp, st.Rhs[0])
+	slot := c.declare(ident.Name, slotKindOf(tp))
+	return func(fr *frame) error {
+		set(fr, slot)
+		return nil
+	}
+}
+
+// typedSetter returns a function computing expr, typed as tp, to an unboxed
+// slot.
+func (c *compiler) typedSetter(tp reflect.Type, expr ast.Expr) func(fr *frame, slot varSlot) {
+	switch tp {
+	case intType:
+		x := c.intExpr(expr)
+		return func(fr *frame, slot varSlot) { fr.ints[slot.idx] = x(fr) }
+	case float64Type:
+		x := c.floatExpr(expr)
+		return func(fr *frame, slot varSlot) { fr.floats[slot.idx] = x(fr) }
+	case boolType:
+		x := c.boolExpr(expr)
+		return func(fr *frame, slot varSlot) { fr.bools[slot.idx] = x(fr) }
+	}
+	x := c.stringExpr(expr)
+	return func(fr *frame, slot varSlot) { fr.strs[slot.idx] = x(fr) }
+}
+
+// typedAssign compiles an assignment of rhs to the variable lhs, or returns
+// nil if they have no static type in common.
+func (c *compiler) typedAssign(lhs, rhs ast.Expr) stmtCode {
+	ident, ok := lhs.(*ast.Ident)
+	if !ok || keywordValue(ident.Name) != NoValue {
+		return nil
+	}
+	tp := c.varType(ident.Name)
+	if tp == nil || !c.typedAs(rhs, tp) {
+		return nil
+	}
+	slot, _ := c.lookup(ident.Name)
+	if slot.kind != valueSlot {
+		set := c.typedSetter(tp, rhs)
+		return func(fr *frame) error {
+			set(fr, slot)
+			return nil
+		}
+	}
+
+	// a variable declared outside of the loop
+	var set func(fr *frame, v reflect.Value)
+	switch tp {
+	case intType:
+		x := c.intExpr(rhs)
+		set = func(fr *frame, v reflect.Value) { v.SetInt(int64(x(fr))) }
+	case float64Type:
+		x := c.floatExpr(rhs)
+		set = func(fr *frame, v reflect.Value) { v.SetFloat(x(fr)) }
+	case boolType:
+		x := c.boolExpr(rhs)
+		set = func(fr *frame, v reflect.Value) { v.SetBool(x(fr)) }
+	case stringType:
+		x := c.stringExpr(rhs)
+		set = func(fr *frame, v reflect.Value) { v.SetString(x(fr)) }
+	}
+	return func(fr *frame) error {
+		v := fr.slots[slot.idx]
+		if !v.CanSet() {
+			return cannotAssignToErr(lhs)
+		}
+		set(fr, v)
+		return nil
+	}
+}
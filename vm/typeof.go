@@ -0,0 +1,236 @@
+package gsvm
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+)
+
+// TypeOf returns the types of the values expression src evaluates to. Function
+// calls and channel receives in it are not evaluated, their types are derived
+// from the function and channel types.
+func (mch *machine) TypeOf(src string) ([]reflect.Type, error) {
+	expr, err := parser.ParseExprFrom(mch.fset, inputName, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return mch.staticTypes(mch.GlobalNameSpace, expr)
+}
+
+func (mch *machine) staticType(ns NameSpace, expr ast.Expr) (reflect.Type, error) {
+	tps, err := mch.staticTypes(ns, expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tps) != 1 {
+		return nil, cannotDetermineTypeErr(expr)
+	}
+	return tps[0], nil
+}
+
+// methodType returns the type of method name of tp as a method value, i.e.
+// without the receiver.
+func methodType(tp reflect.Type, name string) (reflect.Type, bool) {
+	if tp.Kind() == reflect.Interface {
+		m, ok := tp.MethodByName(name)
+		return m.Type, ok
+	}
+	if tp.Kind() != reflect.Ptr {
+		tp = reflect.PtrTo(tp)
+	}
+	m, ok := tp.MethodByName(name)
+	if !ok {
+		return nil, false
+	}
+	ins := make([]reflect.Type, m.Type.NumIn()-1)
+	for i := range ins {
+		ins[i] = m.Type.In(i + 1)
+	}
+	outs := make([]reflect.Type, m.Type.NumOut())
+	for i := range outs {
+		outs[i] = m.Type.Out(i)
+	}
+	return reflect.FuncOf(ins, outs, m.Type.IsVariadic()), true
+}
+
+func (mch *machine) staticTypes(ns NameSpace, expr ast.Expr) ([]reflect.Type, error) {
+	if isSideEffectFree(expr) {
+		vls, err := mch.evalExpr(ns, expr)
+		if err != nil {
+			return nil, err
+		}
+		tps := make([]reflect.Type, 0, len(vls))
+		for _, vl := range vls {
+			if vl == NoValue {
+				continue
+			}
+			vl = echoValue(vl)
+			if vl.Type() == TypeValueType {
+				return nil, isNotAnExpressionErr(expr, vl.Interface().(TypeValue).Type)
+			}
+			tps = append(tps, vl.Type())
+		}
+		return tps, nil
+	}
+
+	switch expr := expr.(type) {
+	case *ast.ParenExpr:
+		return mch.staticTypes(ns, expr.X)
+
+	case *ast.FuncLit:
+		tp, err := mch.evalType(ns, expr.Type)
+		if err != nil {
+			return nil, err
+		}
+		return []reflect.Type{tp}, nil
+
+	case *ast.CallExpr:
+		switch builtinFunc(expr.Fun) {
+		case "len", "copy":
+			return []reflect.Type{intType}, nil
+		case "delete":
+			return nil, nil
+		case "make":
+			tp, err := mch.evalType(ns, expr.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			return []reflect.Type{tp}, nil
+		case "append":
+			tp, err := mch.staticType(ns, expr.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			return []reflect.Type{tp}, nil
+		}
+
+		if tp, err := mch.evalType(ns, expr.Fun); err == nil {
+			// a conversion
+			return []reflect.Type{tp}, nil
+		}
+		fnTp, err := mch.staticType(ns, expr.Fun)
+		if err != nil {
+			return nil, err
+		}
+		switch fnTp {
+		case GenericFuncType, partialGenericFuncType, InstancesType:
+			return nil, cannotDetermineTypeErr(expr)
+		}
+		if fnTp.Kind() != reflect.Func {
+			return nil, cannotCallNonFunctionErr(expr.Fun, fnTp)
+		}
+		tps := make([]reflect.Type, fnTp.NumOut())
+		for i := range tps {
+			tps[i] = fnTp.Out(i)
+		}
+		return tps, nil
+
+	case *ast.SelectorExpr:
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		if mTp, ok := methodType(tp, expr.Sel.Name); ok {
+			return []reflect.Type{mTp}, nil
+		}
+		if tp.Kind() == reflect.Ptr {
+			tp = tp.Elem()
+		}
+		if tp.Kind() == reflect.Struct {
+			if fld, ok := tp.FieldByName(expr.Sel.Name); ok {
+				return []reflect.Type{fld.Type}, nil
+			}
+		}
+		return nil, undefinedTypeHasNotFieldOrMethod(expr, tp, expr.Sel.Name)
+
+	case *ast.IndexExpr:
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		if tp.Kind() == reflect.Ptr && tp.Elem().Kind() == reflect.Array {
+			tp = tp.Elem()
+		}
+		switch tp.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map:
+			return []reflect.Type{tp.Elem()}, nil
+		case reflect.String:
+			return []reflect.Type{reflect.TypeOf(byte(0))}, nil
+		}
+		return nil, invalidOperationTypeDoesNotSupportIndexingErr(expr, tp.Kind())
+
+	case *ast.SliceExpr:
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		if tp.Kind() == reflect.Ptr && tp.Elem().Kind() == reflect.Array {
+			tp = tp.Elem()
+		}
+		switch tp.Kind() {
+		case reflect.Array:
+			return []reflect.Type{reflect.SliceOf(tp.Elem())}, nil
+		case reflect.Slice, reflect.String:
+			return []reflect.Type{tp}, nil
+		}
+		return nil, cannotSliceErr(expr.X, tp)
+
+	case *ast.StarExpr:
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		if tp.Kind() != reflect.Ptr {
+			return nil, invalidOperationErr("*", tp)
+		}
+		return []reflect.Type{tp.Elem()}, nil
+
+	case *ast.UnaryExpr:
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		switch expr.Op {
+		case token.AND:
+			return []reflect.Type{reflect.PtrTo(tp)}, nil
+		case token.ARROW:
+			if tp.Kind() != reflect.Chan {
+				return nil, invalidOperationErr("<-", tp)
+			}
+			return []reflect.Type{tp.Elem()}, nil
+		case token.NOT:
+			return []reflect.Type{boolType}, nil
+		}
+		return []reflect.Type{tp}, nil
+
+	case *ast.BinaryExpr:
+		switch expr.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ, token.LAND, token.LOR:
+			return []reflect.Type{boolType}, nil
+		}
+		tp, err := mch.staticType(ns, expr.X)
+		if err != nil {
+			return nil, err
+		}
+		if expr.Op == token.SHL || expr.Op == token.SHR || !isUntyped(tp) {
+			return []reflect.Type{tp}, nil
+		}
+		return mch.staticTypes(ns, expr.Y)
+
+	case *ast.TypeAssertExpr:
+		tp, err := mch.evalType(ns, expr.Type)
+		if err != nil {
+			return nil, err
+		}
+		return []reflect.Type{tp}, nil
+
+	case *ast.CompositeLit:
+		tp, err := mch.evalType(ns, expr.Type)
+		if err != nil {
+			return nil, err
+		}
+		return []reflect.Type{tp}, nil
+	}
+	return nil, cannotDetermineTypeErr(expr)
+}
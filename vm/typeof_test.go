@@ -0,0 +1,64 @@
+package gsvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/daviddengcn/go-assert"
+)
+
+func TestTypeOf(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`called := false
+f := func(s string) []int {
+	called = true
+	return []int{len(s)}
+}
+m := map[string]int{}`))
+
+	cases := []struct {
+		src string
+		tps []reflect.Type
+	}{
+		{`1`, []reflect.Type{intLiteralType}},
+		{`m`, []reflect.Type{reflect.TypeOf(map[string]int{})}},
+		{`f("abc")`, []reflect.Type{reflect.TypeOf([]int{})}},
+		{`f("abc")[0] + 1`, []reflect.Type{intType}},
+		{`1 + f("abc")[0]`, []reflect.Type{intType}},
+		{`len(f("x")) > 0`, []reflect.Type{boolType}},
+		{`&f("x")[1:]`, []reflect.Type{reflect.TypeOf(&[]int{})}},
+		{`float64(f("x")[0])`, []reflect.Type{reflect.TypeOf(0.0)}},
+		{`math.Sincos(1)`, []reflect.Type{reflect.TypeOf(0.0), reflect.TypeOf(0.0)}},
+		{`sample.NewOuter().Inner`, nil},
+		{`sample.NewOuter().ID`, []reflect.Type{intType}},
+		{`sample.NewOuter().Count`, []reflect.Type{reflect.TypeOf(func() int { return 0 })}},
+	}
+	for _, c := range cases {
+		tps, err := mch.TypeOf(c.src)
+		if c.tps == nil {
+			assert.NotEquals(t, c.src, err, nil)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.StringEquals(t, c.src, tps, c.tps)
+	}
+	assert.Equals(t, "called", mch.GlobalNameSpace.FindLocal("called").Interface(), false)
+
+	assert.NotEquals(t, "err", func() error { _, err := mch.TypeOf(`int`); return err }(), nil)
+}
+
+func TestGlobalsReset(t *testing.T) {
+	mch := newMachine()
+
+	assert.NoError(t, mch.Run(`x := 1
+type point struct{}`))
+	globals := mch.Globals()
+	assert.Equals(t, "len(globals)", len(globals), 2)
+	assert.Equals(t, "x", globals["x"].Interface(), 1)
+
+	mch.Reset()
+	assert.Equals(t, "len(globals)", len(mch.Globals()), 0)
+	assert.NotEquals(t, "err", mch.Run(`y := x`), nil)
+	assert.NoError(t, mch.Run(`y := math.Sin(0)`))
+}
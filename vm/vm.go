@@ -1,22 +1,69 @@
 package gsvm
 
 import (
+	"context"
 	"errors"
 	"go/ast"
 	"go/parser"
 	"go/scanner"
 	"go/token"
-	"log"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	FragmentErr = errors.New("Fragment")
+	// The underlying error of the RuntimeError when Options.MaxSteps is
+	// exceeded.
+	ErrStepLimit = errors.New("step limit exceeded")
+	// The underlying error of the RuntimeError when Options.MaxAlloc is
+	// exceeded.
+	ErrMemoryLimit = errors.New("memory limit exceeded")
+	// The underlying error of the RuntimeError when a symbol denied by a
+	// Policy is accessed.
+	ErrAccessDenied = errors.New("access denied")
 )
 
 type Machine interface {
 	Run(line string) error
+	// RunContext runs line as Run does, and stops with a RuntimeError of code
+	// Canceled when ctx is done. Cancellation is checked at the start of each
+	// iteration of a loop and each call of a function of the machine, so a
+	// native function blocking, e.g. time.Sleep, is not interrupted.
+	RunContext(ctx context.Context, line string) error
+	// Complete returns the identifier being typed at the end of src, and the
+	// names in scope it can be completed to.
+	Complete(src string) (partial string, candidates []string)
+	// TypeOf returns the types of expression src without evaluating calls in
+	// it.
+	TypeOf(src string) ([]reflect.Type, error)
+	// Globals returns the variables, constants, types and functions defined
+	// at the top level.
+	Globals() map[string]reflect.Value
+	// Reset removes all definitions at the top level.
+	Reset()
+
+	// Define binds value to name at the top level. A reflect.Type is bound as
+	// a type, a Package as a package, a reflect.Value and a function as they
+	// are, and any other value is copied to a new variable.
+	Define(name string, value interface{}) error
+	// EvalExpr evaluates expression src at the top level and returns its
+	// values. Untyped constants are converted to their default types, e.g.
+	// int for 1 and float64 for 1.5, and an integer constant overflowing int,
+	// e.g. math.MaxUint64, is an error.
+	EvalExpr(src string) ([]reflect.Value, error)
+	// Eval evaluates expression src of a single value as EvalExpr does.
+	Eval(src string) (reflect.Value, error)
+	// Get returns the value bound to name at the top level, which is the
+	// variable itself if name is a variable.
+	Get(name string) (reflect.Value, bool)
+	// Call calls the function expression funcName, e.g. "f" or "strings.Join",
+	// with args. A reflect.Value argument is passed as it is, and nil as the
+	// zero value of the parameter.
+	Call(funcName string, args ...interface{}) ([]reflect.Value, error)
 }
 
 type NameSpace interface {
@@ -28,11 +75,23 @@ type NameSpace interface {
 	AddLocal(ident string, v reflect.Value)
 	// Returns a namespace for a new block
 	NewBlock() NameSpace
+	// Returns names of all identifiers visible
+	Names() []string
 }
 
 type theNameSpace struct {
 	Upper     NameSpace
 	LocalVars map[string]reflect.Value
+	// The frame of the function or the inputs the namespace is a block of,
+	// shared by its blocks.
+	frame *walkFrame
+}
+
+// walkFrame holds the innermost statement running in a function or the
+// inputs, where a panic recovered once for the function or the input is
+// reported, as frame does for a compiled loop.
+type walkFrame struct {
+	cur ast.Stmt
 }
 
 func NewNameSpace() NameSpace {
@@ -69,15 +128,125 @@ func (ns *theNameSpace) NewBlock() NameSpace {
 	return NewNameSpaceBlock(ns)
 }
 
+func (ns *theNameSpace) Names() []string {
+	var names []string
+	for name := range ns.LocalVars {
+		names = append(names, name)
+	}
+	if ns.Upper != nil {
+		names = append(names, ns.Upper.Names()...)
+	}
+	return names
+}
+
 func NewNameSpaceBlock(ns NameSpace) NameSpace {
+	blk := &theNameSpace{
+		Upper:     ns,
+		LocalVars: make(map[string]reflect.Value),
+	}
+	if upper, ok := ns.(*theNameSpace); ok {
+		blk.frame = upper.frame
+	}
+	return blk
+}
+
+// newFrameBlock returns a block of ns with a frame of its own, for running a
+// function or the inputs.
+func newFrameBlock(ns NameSpace) *theNameSpace {
 	return &theNameSpace{
 		Upper:     ns,
 		LocalVars: make(map[string]reflect.Value),
+		frame:     &walkFrame{},
+	}
+}
+
+// frameOf returns the frame of ns, or nil if it has none, e.g. it is not a
+// block created by the machine.
+func frameOf(ns NameSpace) *walkFrame {
+	if blk, ok := ns.(*theNameSpace); ok {
+		return blk.frame
+	}
+	return nil
+}
+
+// panicStmt returns the statement a panic is reported at: the innermost one
+// running in fr, or st if it is unknown.
+func panicStmt(fr *walkFrame, st ast.Stmt) ast.Stmt {
+	if fr != nil && fr.cur != nil {
+		return fr.cur
 	}
+	return st
+}
+
+// UnexportedPolicy specifies how selectors on unexported fields of compiled
+// structs are evaluated.
+type UnexportedPolicy int
+
+const (
+	// DenyUnexported reports an error when an unexported field is selected.
+	DenyUnexported UnexportedPolicy = iota
+	// ReadUnexported evaluates an unexported field to a read-only copy of it,
+	// which is useful for inspecting values while debugging. Assigning to the
+	// field is still an error. The values the field refers to through
+	// pointers, slices, maps and interfaces are copied too, so changing the
+	// copy leaves the original intact; channels and functions are shared.
+	ReadUnexported
+)
+
+// Options configures a Machine.
+type Options struct {
+	// How unexported fields are accessed. Default to DenyUnexported.
+	Unexported UnexportedPolicy
+	// If not nil, each value of a bare expression statement at the top level
+	// is bound to a history variable _1, _2, ... and reported to Echo with
+	// the variable name.
+	Echo func(name string, vl reflect.Value)
+	// The maximum number of steps, loop iterations and function calls, each
+	// input runs. 0 for no limit.
+	MaxSteps int64
+	// The maximum time each input runs. 0 for no limit.
+	MaxDuration time.Duration
+	// The maximum number of bytes each input allocates, by make, append,
+	// composite literals and string concatenation. Memory allocated by
+	// native functions called is not accounted. 0 for no limit.
+	MaxAlloc int64
 }
 
 type machine struct {
 	GlobalNameSpace NameSpace
+	Options         Options
+
+	// The namespace GlobalNameSpace is created on
+	initNS NameSpace
+
+	// Number of history variables bound so far.
+	nHistory int
+
+	// Positions of all the inputs, which are kept since functions declared in
+	// them may be called later.
+	fset *token.FileSet
+
+	// For and range statements compiled, by node. nil for the ones not
+	// compilable. The loops of functions are kept, since the functions may be
+	// called later, and the others are dropped at the end of each input, see
+	// forgetLoops.
+	loopsMu sync.Mutex
+	loops   map[ast.Stmt]*loopCode
+	// If true, statements are always run by walking the AST.
+	walkOnly bool
+
+	// The limits of the input running. Goroutines started by earlier inputs
+	// may still be running, so it is replaced, not updated, by each input.
+	limits atomic.Pointer[runLimits]
+}
+
+// runLimits is the state of the limits of an input running.
+type runLimits struct {
+	// The context of the input, and the one with Options.MaxDuration
+	// applied.
+	ctx, limitCtx context.Context
+	// The number of steps run, see tick, and bytes allocated, see alloc.
+	steps, allocated int64
 }
 
 type noValueType interface{}
@@ -106,30 +275,219 @@ func isFragmentError(errList scanner.ErrorList, lastLine int) bool {
 	return len(errList) == 1 && errList[0].Pos.Line >= lastLine
 }
 
+// isEOFError returns true if the only error is an unexpected end of source.
+func isEOFError(errList scanner.ErrorList) bool {
+	return len(errList) == 1 && strings.HasSuffix(errList[0].Msg, "found 'EOF'")
+}
+
+// The name of inputs in positions, e.g. input:3:7
+const inputName = "input"
+
+// The line directives make positions relative to the input.
 const (
 	srcPrefix = `package main; func main() {
+//line ` + inputName + `:1:1
 `
 	srcSuffix = `
 }`
+	// For declarations which can not be parsed as statements, e.g. functions.
+	declSrcPrefix = `package main
+//line ` + inputName + `:1:1
+`
 )
 
-func (mch *machine) Run(line string) error {
-	src := srcPrefix + line + srcSuffix
+// parse parses line as statements, or as top-level declarations if it is not
+// valid statements, with positions added to fs. FragmentErr is returned if
+// line is incomplete.
+func parse(fs *token.FileSet, line string) (stmts []ast.Stmt, decls []ast.Decl, err error) {
+	// the last line of the input with srcSuffix
+	nLines := len(strings.Split(line+srcSuffix, "\n"))
 
-	nLines := len(strings.Split(src, "\n"))
+	f, err := parser.ParseFile(fs, inputName, srcPrefix+line+srcSuffix, 0)
+	if err != nil {
+		if isFragmentError(err.(scanner.ErrorList), nLines) {
+			return nil, nil, FragmentErr
+		}
+		// Try parsing as top-level declarations.
+		declF, declErr := parser.ParseFile(fs, inputName, declSrcPrefix+line, 0)
+		if declErr == nil {
+			return nil, declF.Decls, nil
+		}
+		if isEOFError(declErr.(scanner.ErrorList)) {
+			return nil, nil, FragmentErr
+		}
+		// Try parsing as statements with function declarations in between.
+		if stmts, decls, mixedErr := parseMixed(fs, line); mixedErr == nil || mixedErr == FragmentErr {
+			return stmts, decls, mixedErr
+		}
+		errList := err.(scanner.ErrorList)
+		return nil, nil, &SyntaxError{Location: Location{Pos: errList[0].Pos}, Msg: errList[0].Msg}
+	}
+	return f.Decls[0].(*ast.FuncDecl).Body.List, nil, nil
+}
 
+// funcDeclSpans returns the offsets of the function declarations at the top
+// level of src, which start with "func" and a name at the start of a
+// statement, and end at the end of the statement.
+func funcDeclSpans(src string) (spans [][2]int) {
 	fs := token.NewFileSet()
-	f, err := parser.ParseFile(fs, "", src, 0)
+	file := fs.AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(file, []byte(src), nil, 0)
+
+	depth, start := 0, -1
+	atStmt, afterFunc := true, -1
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		offs := file.Offset(pos)
+		switch tok {
+		case token.LPAREN, token.LBRACE, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACK:
+			depth--
+		}
+		if afterFunc >= 0 && tok == token.IDENT {
+			start = afterFunc
+		}
+		afterFunc = -1
+		if depth == 0 && atStmt && tok == token.FUNC && start < 0 {
+			afterFunc = offs
+		}
+		atStmt = depth == 0 && tok == token.SEMICOLON
+		if atStmt && start >= 0 {
+			if lit == ";" {
+				// not an automatically inserted one
+				offs++
+			}
+			spans = append(spans, [2]int{start, offs})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(src)})
+	}
+	return spans
+}
+
+// blankOut returns src with the bytes in or out of spans replaced by spaces,
+// keeping the newlines, and so the positions, of the rest.
+func blankOut(src string, spans [][2]int, in bool) string {
+	bs := []byte(src)
+	for i := range bs {
+		inSpan := false
+		for _, span := range spans {
+			if i >= span[0] && i < span[1] {
+				inSpan = true
+				break
+			}
+		}
+		if inSpan == in && bs[i] != '\n' {
+			bs[i] = ' '
+		}
+	}
+	return string(bs)
+}
+
+// parseMixed parses line of statements with function declarations in between,
+// e.g. a script, as the statements with the declarations blanked out and the
+// declarations with the statements blanked out.
+func parseMixed(fs *token.FileSet, line string) (stmts []ast.Stmt, decls []ast.Decl, err error) {
+	spans := funcDeclSpans(line)
+	if len(spans) == 0 {
+		return nil, nil, errors.New("no function declarations")
+	}
+	declF, err := parser.ParseFile(fs, inputName, declSrcPrefix+blankOut(line, spans, false), 0)
 	if err != nil {
-		if isFragmentError(err.(scanner.ErrorList), nLines) {
-			return FragmentErr
+		if isEOFError(err.(scanner.ErrorList)) {
+			return nil, nil, FragmentErr
 		}
-		ast.Print(token.NewFileSet(), err)
-		log.Printf("Syntax error: %v %d", err, nLines)
+		return nil, nil, err
+	}
+	stmtSrc := blankOut(line, spans, true)
+	f, err := parser.ParseFile(fs, inputName, srcPrefix+stmtSrc+srcSuffix, 0)
+	if err != nil {
+		if isFragmentError(err.(scanner.ErrorList), len(strings.Split(stmtSrc+srcSuffix, "\n"))) {
+			return nil, nil, FragmentErr
+		}
+		return nil, nil, err
+	}
+	return f.Decls[0].(*ast.FuncDecl).Body.List, declF.Decls, nil
+}
+
+// IsFragment returns true if src is an incomplete input, which Run reports
+// with FragmentErr, e.g. a block with the closing brace missing.
+func IsFragment(src string) bool {
+	_, _, err := parse(token.NewFileSet(), src)
+	return err == FragmentErr
+}
+
+// atPos returns err with the location of node set, unless it has one, which
+// is of the innermost node failed. Branches of control flows are kept intact.
+func (mch *machine) atPos(node ast.Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(BranchErr); ok {
+		return err
+	}
+	pos := mch.fset.Position(node.Pos())
+	if !pos.IsValid() {
 		return err
 	}
+	return withLocation(err, pos, node)
+}
+
+func (mch *machine) Run(line string) error {
+	return mch.RunContext(context.Background(), line)
+}
+
+func (mch *machine) RunContext(ctx context.Context, line string) error {
+	stmts, decls, err := parse(mch.fset, line)
+	if err != nil {
+		return err
+	}
+	if err := mch.check(stmts, decls); err != nil {
+		return err
+	}
+	defer mch.start(ctx)()
+	return mch.runInput(stmts, decls)
+}
+
+// runInput runs the decls and then the stmts of an input in the global
+// namespace. A panic is recovered once for the input, and reported at the
+// innermost statement running.
+func (mch *machine) runInput(stmts []ast.Stmt, decls []ast.Decl) (err error) {
+	fr := frameOf(mch.GlobalNameSpace)
+	if fr != nil {
+		// left by a panic of the last input
+		fr.cur = nil
+	}
+	var top ast.Stmt
+	defer mch.forgetLoops(stmts)
+	defer func() {
+		if r := recover(); r != nil {
+			err = mch.atPos(panicStmt(fr, top), recoveredErr(r))
+		}
+	}()
+
+	for _, decl := range decls {
+		top = &ast.DeclStmt{Decl: decl}
+		if err := mch.runStatement(mch.GlobalNameSpace, top); err != nil {
+			return err
+		}
+	}
 	//	log.Println(line)
-	for _, st := range f.Decls[0].(*ast.FuncDecl).Body.List {
+	for _, st := range stmts {
+		top = st
+		if exprSt, ok := st.(*ast.ExprStmt); ok && mch.Options.Echo != nil {
+			if err := mch.echo(exprSt); err != nil {
+				return err
+			}
+			continue
+		}
 		if err := mch.runStatement(mch.GlobalNameSpace, st); err != nil {
 			return err
 		}
@@ -138,29 +496,102 @@ func (mch *machine) Run(line string) error {
 	return nil
 }
 
+// start resets the limits of the machine for an input run with ctx, returning
+// a function releasing the resources of the limits.
+func (mch *machine) start(ctx context.Context) context.CancelFunc {
+	limits := &runLimits{ctx: ctx, limitCtx: ctx}
+	cancel := context.CancelFunc(func() {})
+	if mch.Options.MaxDuration > 0 {
+		limits.limitCtx, cancel = context.WithTimeout(ctx, mch.Options.MaxDuration)
+	}
+	mch.limits.Store(limits)
+	return cancel
+}
+
+func (mch *machine) Globals() map[string]reflect.Value {
+	globals := make(map[string]reflect.Value)
+	for _, name := range mch.GlobalNameSpace.Names() {
+		if v := mch.GlobalNameSpace.FindLocal(name); v != NoValue {
+			globals[name] = v
+		}
+	}
+	return globals
+}
+
+func (mch *machine) Reset() {
+	mch.GlobalNameSpace = newFrameBlock(mch.initNS)
+	mch.nHistory = 0
+
+	mch.loopsMu.Lock()
+	mch.loops = nil
+	mch.loopsMu.Unlock()
+}
+
 type Package map[string]reflect.Value
 
 var PackageType = reflect.TypeOf(Package(nil))
 
 func New(initNS NameSpace) Machine {
-	return &machine{
-		GlobalNameSpace: initNS.NewBlock(),
+	return NewWithOptions(initNS, Options{})
+}
+
+func NewWithOptions(initNS NameSpace, opts Options) Machine {
+	mch := &machine{
+		GlobalNameSpace: newFrameBlock(initNS),
+		Options:         opts,
+		initNS:          initNS,
+		fset:            token.NewFileSet(),
 	}
+	mch.limits.Store(&runLimits{ctx: context.Background(), limitCtx: context.Background()})
+	return mch
 }
 
 type PackageNameSpace struct {
 	Packages map[string]Package
+	// The import paths of the packages by name, "" for the dot-imported
+	// ones. The name of a package is its path if not in Paths.
+	Paths map[string]string
+	// If not nil, the symbols of the packages Policy denies are bound to
+	// values reporting "access denied" errors, when accessed by the machine.
+	Policy *Policy
+
+	// The packages filtered by Policy, by name
+	filtered map[string]Package
+	mu       sync.Mutex
+}
+
+// packageOf returns the package named name, filtered by p.Policy.
+func (p *PackageNameSpace) packageOf(name string) (Package, bool) {
+	pkg, ok := p.Packages[name]
+	if !ok || p.Policy == nil {
+		return pkg, ok
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if filtered, ok := p.filtered[name]; ok {
+		return filtered, true
+	}
+	pkgPath, ok := p.Paths[name]
+	if !ok {
+		pkgPath = name
+	}
+	if p.filtered == nil {
+		p.filtered = make(map[string]Package)
+	}
+	p.filtered[name] = p.Policy.filter(pkgPath, pkg)
+	return p.filtered[name], true
 }
 
 func (p *PackageNameSpace) Find(ident string) (v reflect.Value) {
 	return p.FindLocal(ident)
 }
 func (p *PackageNameSpace) FindLocal(ident string) (v reflect.Value) {
-	if pkg, ok := p.Packages[ident]; ok {
+	if pkg, ok := p.packageOf(ident); ok {
 		return reflect.ValueOf(pkg)
 	}
 
-	if pkg, ok := p.Packages[""]; ok {
+	if pkg, ok := p.packageOf(""); ok {
 		if v, ok := pkg[ident]; ok {
 			return v
 		}
@@ -174,3 +605,18 @@ func (p *PackageNameSpace) AddLocal(ident string, v reflect.Value) {
 func (p *PackageNameSpace) NewBlock() NameSpace {
 	return NewNameSpaceBlock(p)
 }
+func (p *PackageNameSpace) Names() []string {
+	var names []string
+	for name := range p.Packages {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	dot, _ := p.packageOf("")
+	for name, vl := range dot {
+		if vl.Type() != deniedSymbolType {
+			names = append(names, name)
+		}
+	}
+	return names
+}